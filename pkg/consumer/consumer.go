@@ -0,0 +1,238 @@
+// Package consumer implements the Competing Consumers pattern:
+// a pool of workers receives messages from a MessageSource, runs each one
+// through a stability policy chain and acknowledges it, or returns it
+// to the source with a backoff delay when the processing fails.
+package consumer
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/deadletter"
+	"context"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const DefaultWorkers = 1
+
+// receiveErrorDelay is the pause of a worker after a Receive error
+const receiveErrorDelay = time.Duration(1) * time.Second
+
+// Message is a message of a MessageSource
+type Message struct {
+	ID   string
+	Body interface{}
+	// Attempt is the delivery count, 1 on the first delivery
+	Attempt int
+	// Receipt identifies the delivery for Ack, Nack and Extend
+	Receipt string
+	ctx     context.Context
+}
+
+var _ stability.Contexter = (*Message)(nil)
+var _ stability.IdempotencyKeyer = (*Message)(nil)
+
+// Context returns the context of the processing,
+// so the policies see the message as context-aware
+func (m *Message) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// IdempotencyKey returns the message ID, so stability.Idempotent
+// deduplicates the redeliveries of the message
+func (m *Message) IdempotencyKey() string {
+	return m.ID
+}
+
+// MessageSource is a queue with visibility timeouts (SQS, Pub/Sub, MemoryQueue etc.)
+type MessageSource interface {
+	// Receive blocks until a message is available or ctx is done
+	Receive(ctx context.Context) (*Message, error)
+	// Ack removes the message
+	Ack(ctx context.Context, msg *Message) error
+	// Nack makes the message available again after the delay
+	Nack(ctx context.Context, msg *Message, delay time.Duration) error
+	// Extend keeps the message invisible to the other consumers for d from now
+	Extend(ctx context.Context, msg *Message, d time.Duration) error
+}
+
+type Settings struct {
+	Name string
+	// Workers defaults to DefaultWorkers
+	Workers int
+	// Policies wrap the ProcessFn, the first one is the outermost (see stability.Chain)
+	Policies []stability.Policy
+	// Retry if set retries the processing before the message is Nacked, outside the Policies.
+	// The Nack delay of a failed delivery is the retry backoff (RetrySettings.ExpiryFn)
+	// with tryCnt 0 after the first delivery, the default retry backoff if not set.
+	Retry *stability.RetrySettings
+	// Visibility if set is extended every Visibility/2 while a message is processed
+	Visibility time.Duration
+	// MaxAttempts if set acknowledges a message failed that many times,
+	// sending it to the DeadLetter sink if there is one
+	MaxAttempts int
+	DeadLetter  deadletter.Sink
+	// OnError if set receives the processing and source errors
+	OnError func(msg *Message, err error)
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+// Pool is a pool of competing consumers.
+// The ProcessFn gets the *Message as the input object.
+type Pool struct {
+	name        string
+	source      MessageSource
+	processFn   stability.ProcessFn
+	retry       *stability.Retry
+	visibility  time.Duration
+	maxAttempts int
+	deadLetter  deadletter.Sink
+	onError     func(msg *Message, err error)
+	clock       stability.Clock
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// NewPool starts the workers
+func NewPool(source MessageSource, processFn stability.ProcessFn, settings Settings) *Pool {
+	pool := new(Pool)
+
+	pool.name = settings.Name
+	pool.source = source
+
+	if pool.clock = settings.Clock; pool.clock == nil {
+		pool.clock = stability.SystemClock
+	}
+
+	policies := settings.Policies
+	retrySettings := stability.RetrySettings{Name: settings.Name}
+	if settings.Retry != nil {
+		retrySettings = *settings.Retry
+	}
+	if retrySettings.Clock == nil {
+		retrySettings.Clock = pool.clock
+	}
+	pool.retry = stability.NewRetry(retrySettings)
+	if settings.Retry != nil {
+		policies = append([]stability.Policy{pool.retry}, policies...)
+	}
+	pool.processFn = stability.Chain(processFn, policies...)
+
+	pool.visibility = settings.Visibility
+	pool.maxAttempts = settings.MaxAttempts
+	pool.deadLetter = settings.DeadLetter
+
+	if pool.onError = settings.OnError; pool.onError == nil {
+		pool.onError = func(*Message, error) {}
+	}
+
+	workers := settings.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	var ctx context.Context
+	ctx, pool.cancel = context.WithCancel(context.Background())
+	pool.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work(ctx)
+	}
+
+	return pool
+}
+
+// Stop stops receiving and waits for the messages in flight to be processed
+func (p *Pool) Stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+func (p *Pool) work(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		msg, err := p.source.Receive(ctx)
+		if ctx.Err() != nil {
+			if err == nil && msg != nil {
+				// Received as the pool stopped, give it back to the other consumers
+				if err := p.source.Nack(context.Background(), msg, 0); err != nil {
+					p.onError(msg, err)
+				}
+			}
+			return
+		}
+		if err != nil {
+			p.onError(nil, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.clock.After(receiveErrorDelay):
+			}
+			continue
+		}
+		p.handle(msg)
+	}
+}
+
+// handle processes the message, it isn't interrupted by Stop
+func (p *Pool) handle(msg *Message) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msg.ctx = ctx
+
+	if p.visibility > 0 {
+		go p.extend(ctx, msg)
+	}
+
+	err := p.process(msg)
+	cancel()
+
+	switch {
+	case err == nil:
+		err = p.source.Ack(context.Background(), msg)
+	case p.maxAttempts > 0 && msg.Attempt >= p.maxAttempts:
+		p.onError(msg, err)
+		if p.deadLetter != nil {
+			_ = p.deadLetter.Send(deadletter.New(p.name, msg.Body, err, p.clock.Now()))
+		}
+		err = p.source.Ack(context.Background(), msg)
+	default:
+		p.onError(msg, err)
+		err = p.source.Nack(context.Background(), msg, p.retry.Backoff(msg.Attempt-1))
+	}
+	if err != nil {
+		p.onError(msg, err)
+	}
+}
+
+// process runs processFn converting a panic into the error, so the worker survives it
+// and the message is Nacked (or dead-lettered) like on any failure
+func (p *Pool) process(msg *Message) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &stability.PanicError{Name: p.name, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	_, err = p.processFn(msg)
+	return err
+}
+
+// extend keeps the message invisible until ctx is done
+func (p *Pool) extend(ctx context.Context, msg *Message) {
+	ticker := p.clock.NewTicker(p.visibility / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			if err := p.source.Extend(ctx, msg, p.visibility); err != nil && !errors.Is(err, context.Canceled) {
+				p.onError(msg, err)
+			}
+		}
+	}
+}
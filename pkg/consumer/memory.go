@@ -0,0 +1,173 @@
+package consumer
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultVisibility = time.Duration(30) * time.Second
+
+var (
+	// ErrStaleReceipt is returned for a message delivered again since it was received
+	ErrStaleReceipt = errors.New("consumer: stale receipt")
+)
+
+type MemoryQueueSettings struct {
+	// Visibility is how long a received message is invisible, DefaultVisibility if not set
+	Visibility time.Duration
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+type memoryMessage struct {
+	id        string
+	body      interface{}
+	attempt   int
+	receipt   int
+	visibleAt time.Time
+}
+
+// MemoryQueue is an in-process MessageSource, a received message
+// not acknowledged in the visibility timeout is delivered again
+type MemoryQueue struct {
+	visibility time.Duration
+	clock      stability.Clock
+	// messages are in the order they were sent
+	messages []*memoryMessage
+	nextID   int
+	// sent is closed (and replaced) when a message is sent or made visible
+	sent  chan struct{}
+	mutex sync.Mutex
+}
+
+func NewMemoryQueue(settings MemoryQueueSettings) *MemoryQueue {
+	queue := new(MemoryQueue)
+
+	if queue.visibility = settings.Visibility; queue.visibility <= 0 {
+		queue.visibility = DefaultVisibility
+	}
+
+	if queue.clock = settings.Clock; queue.clock == nil {
+		queue.clock = stability.SystemClock
+	}
+
+	queue.sent = make(chan struct{})
+
+	return queue
+}
+
+// notify must be called under the mutex
+func (q *MemoryQueue) notify() {
+	close(q.sent)
+	q.sent = make(chan struct{})
+}
+
+// Send adds the message and returns its ID
+func (q *MemoryQueue) Send(body interface{}) string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.nextID++
+	id := strconv.Itoa(q.nextID)
+	q.messages = append(q.messages, &memoryMessage{id: id, body: body, visibleAt: q.clock.Now()})
+	q.notify()
+	return id
+}
+
+// Len returns the number of the messages not acknowledged yet
+func (q *MemoryQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.messages)
+}
+
+func (q *MemoryQueue) Receive(ctx context.Context) (*Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		now := q.clock.Now()
+		var next time.Time
+		for _, m := range q.messages {
+			if !now.Before(m.visibleAt) {
+				m.attempt++
+				m.receipt++
+				m.visibleAt = now.Add(q.visibility)
+				return &Message{ID: m.id, Body: m.body, Attempt: m.attempt, Receipt: strconv.Itoa(m.receipt)}, nil
+			}
+			if next.IsZero() || m.visibleAt.Before(next) {
+				next = m.visibleAt
+			}
+		}
+
+		// Wait for a new message or the first invisible one to become visible
+		sent := q.sent
+		var visible <-chan time.Time
+		if !next.IsZero() {
+			visible = q.clock.After(next.Sub(now))
+		}
+		q.mutex.Unlock()
+		select {
+		case <-sent:
+		case <-visible:
+		case <-ctx.Done():
+			q.mutex.Lock()
+			return nil, ctx.Err()
+		}
+		q.mutex.Lock()
+	}
+}
+
+// find returns the index of the message of the receipt, must be called under the mutex
+func (q *MemoryQueue) find(msg *Message) (int, error) {
+	for i, m := range q.messages {
+		if m.id == msg.ID {
+			if strconv.Itoa(m.receipt) != msg.Receipt {
+				return 0, ErrStaleReceipt
+			}
+			return i, nil
+		}
+	}
+	return 0, ErrStaleReceipt
+}
+
+func (q *MemoryQueue) Ack(ctx context.Context, msg *Message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.find(msg)
+	if err != nil {
+		return err
+	}
+	q.messages = append(q.messages[:i], q.messages[i+1:]...)
+	return nil
+}
+
+func (q *MemoryQueue) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.find(msg)
+	if err != nil {
+		return err
+	}
+	q.messages[i].visibleAt = q.clock.Now().Add(delay)
+	q.notify()
+	return nil
+}
+
+func (q *MemoryQueue) Extend(ctx context.Context, msg *Message, d time.Duration) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i, err := q.find(msg)
+	if err != nil {
+		return err
+	}
+	q.messages[i].visibleAt = q.clock.Now().Add(d)
+	return nil
+}
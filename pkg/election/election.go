@@ -0,0 +1,282 @@
+// Package election implements the Leader Election pattern with leases:
+// the candidates keep trying to acquire a lock with a TTL in a LockStore,
+// the holder renews it while it's alive and the others take it over when it expires.
+// Every new leadership gets a greater fencing token, pass it to the
+// resources the leader writes to, so they can reject a deposed leader.
+package election
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultTTL = time.Duration(15) * time.Second
+
+// Lease is the state of a lock
+type Lease struct {
+	// Holder is empty when the lock is free
+	Holder string
+	// Token is the fencing token, it grows with every acquisition
+	// and is kept by the renewals
+	Token   uint64
+	Expires time.Time
+}
+
+// LockStore keeps the leases
+type LockStore interface {
+	// Acquire takes the lock for the holder for ttl if it's free, expired or held by the holder,
+	// it returns the current lease and false if another holder has it
+	Acquire(name, holder string, ttl time.Duration) (Lease, bool, error)
+	// Release frees the lock if the holder has it
+	Release(name, holder string) error
+}
+
+// acquire returns the lease after the holder's acquisition at now, false if the lock is taken
+func acquire(current Lease, holder string, now time.Time, ttl time.Duration) (Lease, bool) {
+	live := current.Holder != "" && now.Before(current.Expires)
+	if live && current.Holder != holder {
+		return current, false
+	}
+
+	token := current.Token
+	if !live {
+		token++
+	}
+	return Lease{Holder: holder, Token: token, Expires: now.Add(ttl)}, true
+}
+
+// release returns the free lease keeping the token
+func release(lease Lease) Lease {
+	return Lease{Token: lease.Token}
+}
+
+type Settings struct {
+	// Name is the name of the lock
+	Name string
+	// ID identifies the candidate, hostname-pid-<n> if not set
+	ID string
+	// Store defaults to a MemoryStore
+	Store LockStore
+	// TTL defaults to DefaultTTL
+	TTL time.Duration
+	// RenewInterval is how often the lock is acquired or renewed,
+	// TTL/3 if not set or not less than TTL/2
+	RenewInterval time.Duration
+	// SafetyMargin ends the leadership that long before the lease expires,
+	// so a leader which can't renew stops before another one may be elected.
+	// It's at least the RenewInterval (the default), which it also is if RenewInterval+SafetyMargin
+	// isn't less than the TTL. The latency of the Acquire is added to it.
+	SafetyMargin time.Duration
+	// OnElected if set is called when the candidate becomes the leader
+	OnElected func(token uint64)
+	// OnRevoked if set is called when the candidate stops being the leader
+	OnRevoked func()
+	// OnError if set receives the Store errors
+	OnError func(err error)
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+// Election is a candidate, it campaigns once
+type Election struct {
+	name          string
+	id            string
+	store         LockStore
+	ttl           time.Duration
+	renewInterval time.Duration
+	safetyMargin  time.Duration
+	onElected     func(token uint64)
+	onRevoked     func()
+	onError       func(err error)
+	clock         stability.Clock
+	leader        bool
+	token         uint64
+	// deadline is the local end of the leadership, SafetyMargin before the lease expires
+	deadline   time.Time
+	resignCh   chan struct{}
+	resignOnce sync.Once
+	mutex      sync.Mutex
+}
+
+var candidateCnt uint64
+var candidateMutex sync.Mutex
+
+func defaultID() string {
+	candidateMutex.Lock()
+	defer candidateMutex.Unlock()
+
+	candidateCnt++
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%d", hostname, os.Getpid(), candidateCnt)
+}
+
+func NewElection(settings Settings) *Election {
+	election := new(Election)
+
+	election.name = settings.Name
+
+	if election.id = settings.ID; election.id == "" {
+		election.id = defaultID()
+	}
+
+	if election.clock = settings.Clock; election.clock == nil {
+		election.clock = stability.SystemClock
+	}
+
+	if election.store = settings.Store; election.store == nil {
+		election.store = NewMemoryStore(election.clock)
+	}
+
+	if election.ttl = settings.TTL; election.ttl <= 0 {
+		election.ttl = DefaultTTL
+	}
+
+	// The renewal must come before the deadline, TTL-SafetyMargin after the acquisition
+	if election.renewInterval = settings.RenewInterval; election.renewInterval <= 0 || 2*election.renewInterval >= election.ttl {
+		election.renewInterval = election.ttl / 3
+	}
+
+	election.safetyMargin = settings.SafetyMargin
+	if election.safetyMargin < election.renewInterval || election.renewInterval+election.safetyMargin >= election.ttl {
+		election.safetyMargin = election.renewInterval
+	}
+
+	if election.onElected = settings.OnElected; election.onElected == nil {
+		election.onElected = func(uint64) {}
+	}
+
+	if election.onRevoked = settings.OnRevoked; election.onRevoked == nil {
+		election.onRevoked = func() {}
+	}
+
+	if election.onError = settings.OnError; election.onError == nil {
+		election.onError = func(error) {}
+	}
+
+	election.resignCh = make(chan struct{})
+
+	return election
+}
+
+// ID returns the candidate ID
+func (e *Election) ID() string {
+	return e.id
+}
+
+// Leader returns the fencing token and true while the candidate is the leader.
+// It checks the local deadline of the lease, so it turns false in time
+// even if the Campaign is stuck in the Store.
+func (e *Election) Leader() (uint64, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.token, e.leader && e.clock.Now().Before(e.deadline)
+}
+
+// state returns the token, the leader flag and the deadline kept by the Campaign
+func (e *Election) state() (uint64, bool, time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.token, e.leader, e.deadline
+}
+
+// Resign stops the Campaign, releasing the lock if the candidate is the leader
+func (e *Election) Resign() {
+	e.resignOnce.Do(func() {
+		close(e.resignCh)
+	})
+}
+
+// Campaign runs the candidate until ctx is done (returning ctx.Err()) or Resign (returning nil).
+// A leader which can't renew the lease because of Store errors is revoked
+// SafetyMargin before the lease expires.
+func (e *Election) Campaign(ctx context.Context) error {
+	for {
+		if _, leader, deadline := e.state(); leader && !e.clock.Now().Before(deadline) {
+			e.revoke()
+		}
+
+		// The lease is counted from before the call, the Store may grant it any time during it
+		start := e.clock.Now()
+		lease, ok, err := e.store.Acquire(e.name, e.id, e.ttl)
+		latency := e.clock.Since(start)
+		token, leader, _ := e.state()
+		renewed := false
+		switch {
+		case err != nil:
+			e.onError(err)
+		case ok:
+			// A new token means the lease expired meanwhile, another leader may have been elected.
+			// A lease which doesn't outlast the margin is no use.
+			deadline := start.Add(e.ttl - e.safetyMargin - latency)
+			live := e.clock.Now().Before(deadline)
+			if leader && (lease.Token != token || !live) {
+				e.revoke()
+			}
+			if live {
+				e.elect(lease.Token, deadline)
+				renewed = true
+			}
+		case leader:
+			e.revoke()
+		}
+
+		// A renewed leader renews again before its deadline (halfway to it if the Acquire was
+		// too slow for the RenewInterval), one which failed to renew wakes up at its deadline to revoke itself
+		wait := e.renewInterval
+		if _, leader, deadline := e.state(); leader {
+			untilDeadline := deadline.Sub(e.clock.Now())
+			switch {
+			case renewed && untilDeadline <= wait:
+				wait = untilDeadline / 2
+			case !renewed && untilDeadline < wait:
+				wait = untilDeadline
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			e.stop()
+			return ctx.Err()
+		case <-e.resignCh:
+			e.stop()
+			return nil
+		case <-e.clock.After(wait):
+		}
+	}
+}
+
+func (e *Election) elect(token uint64, deadline time.Time) {
+	e.mutex.Lock()
+	elected := !e.leader
+	e.leader = true
+	e.token = token
+	e.deadline = deadline
+	e.mutex.Unlock()
+
+	if elected {
+		e.onElected(token)
+	}
+}
+
+func (e *Election) revoke() {
+	e.mutex.Lock()
+	e.leader = false
+	e.mutex.Unlock()
+
+	e.onRevoked()
+}
+
+// stop releases the lock of the leader
+func (e *Election) stop() {
+	if _, leader, _ := e.state(); !leader {
+		return
+	}
+	if err := e.store.Release(e.name, e.id); err != nil {
+		e.onError(err)
+	}
+	e.revoke()
+}
@@ -0,0 +1,88 @@
+package election
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileStore is a LockStore for the processes of a single host: the lease of a lock
+// is kept as JSON in <dir>/<name>.lease, read and written under an OS file lock
+type FileStore struct {
+	dir   string
+	clock stability.Clock
+}
+
+// NewFileStore creates the directory if needed, clock is optional (stability.SystemClock if nil)
+func NewFileStore(dir string, clock stability.Clock) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = stability.SystemClock
+	}
+	return &FileStore{dir: dir, clock: clock}, nil
+}
+
+func (s *FileStore) Acquire(name, holder string, ttl time.Duration) (Lease, bool, error) {
+	var lease Lease
+	var ok bool
+	err := s.update(name, func(current Lease) (Lease, bool) {
+		lease, ok = acquire(current, holder, s.clock.Now(), ttl)
+		return lease, ok
+	})
+	return lease, ok, err
+}
+
+func (s *FileStore) Release(name, holder string) error {
+	return s.update(name, func(current Lease) (Lease, bool) {
+		if current.Holder != holder {
+			return current, false
+		}
+		return release(current), true
+	})
+}
+
+// update applies fn to the lease of the file under the file lock,
+// the lease is written if fn returns true
+func (s *FileStore) update(name string, fn func(current Lease) (Lease, bool)) error {
+	file, err := os.OpenFile(filepath.Join(s.dir, name+".lease"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := lockFile(file); err != nil {
+		return err
+	}
+	defer unlockFile(file)
+
+	var current Lease
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &current); err != nil {
+			return err
+		}
+	}
+
+	lease, write := fn(current)
+	if !write {
+		return nil
+	}
+	if data, err = json.Marshal(lease); err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,19 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package election
+
+import (
+	"errors"
+	"os"
+)
+
+var errFileLockUnsupported = errors.New("file lock isn't supported on this platform")
+
+func lockFile(file *os.File) error {
+	return errFileLockUnsupported
+}
+
+func unlockFile(file *os.File) error {
+	return errFileLockUnsupported
+}
@@ -0,0 +1,43 @@
+package election
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process LockStore, for tests and the candidates of a single process
+type MemoryStore struct {
+	leases map[string]Lease
+	clock  stability.Clock
+	mutex  sync.Mutex
+}
+
+// NewMemoryStore creates a store, clock is optional (stability.SystemClock if nil)
+func NewMemoryStore(clock stability.Clock) *MemoryStore {
+	if clock == nil {
+		clock = stability.SystemClock
+	}
+	return &MemoryStore{leases: make(map[string]Lease), clock: clock}
+}
+
+func (s *MemoryStore) Acquire(name, holder string, ttl time.Duration) (Lease, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	lease, ok := acquire(s.leases[name], holder, s.clock.Now(), ttl)
+	if ok {
+		s.leases[name] = lease
+	}
+	return lease, ok, nil
+}
+
+func (s *MemoryStore) Release(name, holder string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if lease := s.leases[name]; lease.Holder == holder {
+		s.leases[name] = release(lease)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Package health implements the Health Endpoint Monitoring pattern:
+// a Checker runs the registered checks, custom probes and the live state
+// of the stability policies, and serves the liveness and the readiness as JSON.
+// The check results are cached, so frequent probes don't load the dependencies.
+package health
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultCheckTimeout = time.Duration(1) * time.Second
+const DefaultCacheTTL = time.Duration(1) * time.Second
+
+var ErrCheckTimeout = errors.New("health check timed out")
+
+// Status of a check or a report
+type Status string
+
+const (
+	StatusUp   Status = "up"
+	StatusDown Status = "down"
+)
+
+// Check is a health check
+type Check struct {
+	Name string
+	// Probe returns nil when healthy, it should return when ctx is done
+	Probe func(ctx context.Context) error
+	// Critical checks turn the report down, the others are reported only
+	Critical bool
+	// Liveness adds the check to the liveness, the checks are in the readiness only if not set.
+	// Leave it unset for the dependencies, so their outage doesn't restart the process.
+	Liveness bool
+	// Timeout defaults to DefaultCheckTimeout
+	Timeout time.Duration
+}
+
+// BreakerCheck is down while the breaker is open
+func BreakerCheck(breaker *stability.Breaker, critical bool) Check {
+	return Check{
+		Name:     "breaker:" + breaker.Name(),
+		Critical: critical,
+		Probe: func(context.Context) error {
+			if breaker.State() == stability.StateOpen {
+				return stability.ErrOpenState
+			}
+			return nil
+		},
+	}
+}
+
+// ThrottleCheck is down while the throttle has been rejecting the calls for longer than maxSaturation
+func ThrottleCheck(throttle *stability.Throttle, maxSaturation time.Duration, critical bool) Check {
+	return Check{
+		Name:     "throttle:" + throttle.Name(),
+		Critical: critical,
+		Probe: func(context.Context) error {
+			if saturated := throttle.SaturatedFor(); saturated > maxSaturation {
+				return fmt.Errorf("%w for %v", stability.ErrTooManyCalls, saturated)
+			}
+			return nil
+		},
+	}
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name     string        `json:"name"`
+	Status   Status        `json:"status"`
+	Critical bool          `json:"critical"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Time     time.Time     `json:"time"`
+}
+
+// Report is the outcome of the checks
+type Report struct {
+	Status Status   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+type Settings struct {
+	// CacheTTL is how long a result is reused, DefaultCacheTTL if not set
+	CacheTTL time.Duration
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+type Checker struct {
+	checks   []Check
+	cacheTTL time.Duration
+	cache    map[string]Result
+	clock    stability.Clock
+	mutex    sync.Mutex
+}
+
+func NewChecker(settings Settings) *Checker {
+	checker := new(Checker)
+
+	if checker.cacheTTL = settings.CacheTTL; checker.cacheTTL <= 0 {
+		checker.cacheTTL = DefaultCacheTTL
+	}
+
+	if checker.clock = settings.Clock; checker.clock == nil {
+		checker.clock = stability.SystemClock
+	}
+
+	checker.cache = make(map[string]Result)
+
+	return checker
+}
+
+// Register adds the check
+func (c *Checker) Register(check Check) {
+	if check.Timeout <= 0 {
+		check.Timeout = DefaultCheckTimeout
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checks = append(c.checks, check)
+}
+
+// Liveness runs the Liveness checks
+func (c *Checker) Liveness(ctx context.Context) Report {
+	return c.report(ctx, true)
+}
+
+// Readiness runs all the checks
+func (c *Checker) Readiness(ctx context.Context) Report {
+	return c.report(ctx, false)
+}
+
+// LivenessHandler serves the Liveness, 503 when it's down
+func (c *Checker) LivenessHandler() http.Handler {
+	return c.handler(c.Liveness)
+}
+
+// ReadinessHandler serves the Readiness, 503 when it's down
+func (c *Checker) ReadinessHandler() http.Handler {
+	return c.handler(c.Readiness)
+}
+
+func (c *Checker) handler(reportFn func(ctx context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := reportFn(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != StatusUp {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// report runs the checks concurrently
+func (c *Checker) report(ctx context.Context, liveness bool) Report {
+	c.mutex.Lock()
+	var checks []Check
+	for _, check := range c.checks {
+		if !liveness || check.Liveness {
+			checks = append(checks, check)
+		}
+	}
+	c.mutex.Unlock()
+
+	report := Report{Status: StatusUp, Checks: make([]Result, len(checks))}
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+	for i, check := range checks {
+		go func(i int, check Check) {
+			defer wg.Done()
+			report.Checks[i] = c.result(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Critical && result.Status != StatusUp {
+			report.Status = StatusDown
+		}
+	}
+	return report
+}
+
+// result returns the cached result of the check or runs it
+func (c *Checker) result(ctx context.Context, check Check) Result {
+	c.mutex.Lock()
+	cached, ok := c.cache[check.Name]
+	c.mutex.Unlock()
+	if ok && c.clock.Now().Sub(cached.Time) < c.cacheTTL {
+		return cached
+	}
+
+	result := Result{Name: check.Name, Status: StatusUp, Critical: check.Critical, Time: c.clock.Now()}
+	if err := c.probe(ctx, check); err != nil {
+		result.Status = StatusDown
+		result.Error = err.Error()
+	}
+	result.Duration = c.clock.Now().Sub(result.Time)
+
+	// The result of a cancelled request isn't the state of the check
+	if ctx.Err() == nil {
+		c.mutex.Lock()
+		c.cache[check.Name] = result
+		c.mutex.Unlock()
+	}
+	return result
+}
+
+// probe runs the probe within its timeout
+func (c *Checker) probe(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				errCh <- fmt.Errorf("health check panicked: %v", r)
+			}
+		}()
+		errCh <- check.Probe(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.clock.After(check.Timeout):
+		return ErrCheckTimeout
+	}
+}
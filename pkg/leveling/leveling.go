@@ -0,0 +1,307 @@
+// Package leveling implements the Queue-Based Load Leveling pattern:
+// a bounded queue takes the bursts of the producers and a pool of workers
+// drains it at a steady rate, set by a stability.Throttle.
+// A panic of processFn is recovered as a *stability.PanicError and handled as its error.
+package leveling
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"container/list"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const DefaultCapacity = 1000
+const DefaultWorkers = 1
+
+var (
+	// ErrQueueFull is returned by Put with RejectNew when the queue is full
+	ErrQueueFull = errors.New("leveling: queue is full")
+	// ErrStopped is returned by Put after Stop
+	ErrStopped = errors.New("leveling: queue is stopped")
+)
+
+// Overflow is what Put does when the queue is full
+type Overflow int
+
+const (
+	// Block waits for space, or until the context of the item is done
+	Block Overflow = iota
+	// DropOldest removes the oldest item to make space
+	DropOldest
+	// RejectNew returns ErrQueueFull
+	RejectNew
+)
+
+type Settings struct {
+	Name string
+	// Capacity defaults to DefaultCapacity
+	Capacity int
+	// Overflow defaults to Block
+	Overflow Overflow
+	// Workers defaults to DefaultWorkers
+	Workers int
+	// Throttle if set paces the workers, they wait for its tokens
+	Throttle *stability.Throttle
+	// OnError if set receives the failed items
+	OnError func(inObj interface{}, err error)
+	// OnDrop if set receives the items dropped by DropOldest,
+	// it's called by Put after the item is queued
+	OnDrop func(inObj interface{})
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+// Stats are the queue metrics
+type Stats struct {
+	Depth    int
+	Capacity int
+	// Enqueued, Dropped and Rejected count the Put calls
+	Enqueued uint64
+	Dropped  uint64
+	Rejected uint64
+	// Processed counts the items taken by the workers, Failed is a part of them
+	Processed uint64
+	Failed    uint64
+	// AvgWait and MaxWait are the time the processed items spent in the queue
+	AvgWait time.Duration
+	MaxWait time.Duration
+}
+
+type item struct {
+	inObj      interface{}
+	enqueuedAt time.Time
+}
+
+type Queue struct {
+	name      string
+	processFn stability.ProcessFn
+	capacity  int
+	overflow  Overflow
+	throttle  *stability.Throttle
+	onError   func(inObj interface{}, err error)
+	onDrop    func(inObj interface{})
+	clock     stability.Clock
+	items     *list.List
+	// added and taken are closed (and replaced) when an item is added or taken
+	added     chan struct{}
+	taken     chan struct{}
+	stopped   bool
+	stats     Stats
+	totalWait time.Duration
+	mutex     sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// NewQueue starts the workers running processFn on the queued items
+func NewQueue(processFn stability.ProcessFn, settings Settings) *Queue {
+	queue := new(Queue)
+
+	queue.name = settings.Name
+	queue.processFn = processFn
+
+	if queue.capacity = settings.Capacity; queue.capacity <= 0 {
+		queue.capacity = DefaultCapacity
+	}
+
+	queue.overflow = settings.Overflow
+	queue.throttle = settings.Throttle
+
+	if queue.onError = settings.OnError; queue.onError == nil {
+		queue.onError = func(interface{}, error) {}
+	}
+
+	if queue.onDrop = settings.OnDrop; queue.onDrop == nil {
+		queue.onDrop = func(interface{}) {}
+	}
+
+	if queue.clock = settings.Clock; queue.clock == nil {
+		queue.clock = stability.SystemClock
+	}
+
+	queue.items = list.New()
+	queue.added = make(chan struct{})
+	queue.taken = make(chan struct{})
+
+	workers := settings.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	queue.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+
+	return queue
+}
+
+// signal wakes up the goroutines waiting on ch, must be called under the mutex
+func signal(ch *chan struct{}) {
+	close(*ch)
+	*ch = make(chan struct{})
+}
+
+// Put queues the item, see Overflow for a full queue.
+// The context carried by the item (stability.ContextOf) cancels a blocked Put.
+func (q *Queue) Put(inObj interface{}) error {
+	dropped, err := q.put(inObj)
+	// Called without the mutex, OnDrop may use the queue
+	for _, droppedObj := range dropped {
+		q.onDrop(droppedObj)
+	}
+	return err
+}
+
+// put queues the item and returns the items dropped to make space
+func (q *Queue) put(inObj interface{}) ([]interface{}, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var dropped []interface{}
+	for !q.stopped && q.items.Len() >= q.capacity {
+		switch q.overflow {
+		case RejectNew:
+			q.stats.Rejected++
+			return dropped, ErrQueueFull
+		case DropOldest:
+			oldest := q.items.Remove(q.items.Front()).(item)
+			q.stats.Dropped++
+			dropped = append(dropped, oldest.inObj)
+		default:
+			taken := q.taken
+			q.mutex.Unlock()
+			select {
+			case <-taken:
+			case <-stability.ContextOf(inObj).Done():
+				q.mutex.Lock()
+				q.stats.Rejected++
+				return dropped, stability.ContextOf(inObj).Err()
+			}
+			q.mutex.Lock()
+		}
+	}
+
+	if q.stopped {
+		q.stats.Rejected++
+		return dropped, ErrStopped
+	}
+
+	q.items.PushBack(item{inObj: inObj, enqueuedAt: q.clock.Now()})
+	q.stats.Enqueued++
+	signal(&q.added)
+	return dropped, nil
+}
+
+// take returns the next item, false once the queue is stopped and empty
+func (q *Queue) take() (item, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.items.Len() == 0 {
+		if q.stopped {
+			return item{}, false
+		}
+		added := q.added
+		q.mutex.Unlock()
+		<-added
+		q.mutex.Lock()
+	}
+
+	next := q.items.Remove(q.items.Front()).(item)
+	signal(&q.taken)
+	return next, true
+}
+
+// waitForToken blocks until the throttle lets a call through
+func (q *Queue) waitForToken() {
+	if q.throttle == nil {
+		return
+	}
+	for {
+		status := q.throttle.Take()
+		if status.Allowed {
+			if status.Delay > 0 {
+				q.clock.Sleep(status.Delay)
+			}
+			return
+		}
+		wait := status.Reset
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		q.clock.Sleep(wait)
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		next, ok := q.take()
+		if !ok {
+			return
+		}
+
+		q.waitForToken()
+		q.record(q.clock.Since(next.enqueuedAt), false)
+
+		if err := q.process(next.inObj); err != nil {
+			q.record(0, true)
+			q.onError(next.inObj, err)
+		}
+	}
+}
+
+// process runs processFn converting a panic into the error, so the worker survives it
+func (q *Queue) process(inObj interface{}) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &stability.PanicError{Name: q.name, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	_, err = q.processFn(inObj)
+	return err
+}
+
+func (q *Queue) record(wait time.Duration, failed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if failed {
+		q.stats.Failed++
+		return
+	}
+	q.stats.Processed++
+	q.totalWait += wait
+	if wait > q.stats.MaxWait {
+		q.stats.MaxWait = wait
+	}
+}
+
+// Stats returns the current metrics
+func (q *Queue) Stats() Stats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Depth = q.items.Len()
+	stats.Capacity = q.capacity
+	if stats.Processed > 0 {
+		stats.AvgWait = q.totalWait / time.Duration(stats.Processed)
+	}
+	return stats
+}
+
+// Stop rejects new items, waits for the workers to drain the queue and stops them
+func (q *Queue) Stop() {
+	q.mutex.Lock()
+	if !q.stopped {
+		q.stopped = true
+		signal(&q.added)
+		signal(&q.taken)
+	}
+	q.mutex.Unlock()
+
+	q.wg.Wait()
+}
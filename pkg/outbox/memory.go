@@ -0,0 +1,73 @@
+package outbox
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"sync"
+)
+
+// MemoryStore is an in-process Store, for tests
+type MemoryStore struct {
+	events []Event
+	sent   map[int64]bool
+	nextID int64
+	clock  stability.Clock
+	mutex  sync.Mutex
+}
+
+// NewMemoryStore creates a store, clock is optional (stability.SystemClock if nil)
+func NewMemoryStore(clock stability.Clock) *MemoryStore {
+	if clock == nil {
+		clock = stability.SystemClock
+	}
+	return &MemoryStore{sent: make(map[int64]bool), clock: clock}
+}
+
+// Add appends the event and returns it
+func (s *MemoryStore) Add(aggregateKey string, payload []byte) Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextID++
+	event := Event{ID: s.nextID, AggregateKey: aggregateKey, Payload: payload, CreatedAt: s.clock.Now()}
+	s.events = append(s.events, event)
+	return event
+}
+
+// Len returns the number of the unsent events
+func (s *MemoryStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.events) - len(s.sent)
+}
+
+func (s *MemoryStore) Pending(ctx context.Context, limit int, skip []string) ([]Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	skipped := make(map[string]bool, len(skip))
+	for _, key := range skip {
+		skipped[key] = true
+	}
+
+	var events []Event
+	for _, event := range s.events {
+		if len(events) >= limit {
+			break
+		}
+		if !s.sent[event.ID] && !skipped[event.AggregateKey] {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) MarkSent(ctx context.Context, ids []int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range ids {
+		s.sent[id] = true
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package outbox implements the Transactional Outbox pattern:
+// the events are written to an outbox table in the transaction of the business
+// change, and a Relay publishes the unsent ones and marks them sent.
+// Dispatch is at least once: an event published but not marked yet
+// (e.g. the process crashed) is published again. The events of an aggregate
+// are published in order, a failed event holds back the later ones of its aggregate.
+package outbox
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"sort"
+	"time"
+)
+
+const DefaultBatchSize = 100
+const DefaultPollInterval = time.Duration(1) * time.Second
+const DefaultMaxBlocked = 100
+
+// Event is an outbox record, ID grows in the insertion order
+type Event struct {
+	ID           int64
+	AggregateKey string
+	Payload      []byte
+	CreatedAt    time.Time
+}
+
+// Store is the outbox storage
+type Store interface {
+	// Pending returns up to limit unsent events in the ID order,
+	// leaving out the events of the skipped aggregates
+	Pending(ctx context.Context, limit int, skip []string) ([]Event, error)
+	// MarkSent marks the events as sent
+	MarkSent(ctx context.Context, ids []int64) error
+}
+
+type RelaySettings struct {
+	Name string
+	// BatchSize defaults to DefaultBatchSize
+	BatchSize int
+	// PollInterval defaults to DefaultPollInterval
+	PollInterval time.Duration
+	// MaxBlocked ends a RelayOnce pass once that many aggregates failed,
+	// so the skip list of Store.Pending stays short. DefaultMaxBlocked if not set.
+	MaxBlocked int
+	// Retry and Breaker if set wrap the publishing, named after the relay
+	Retry   *stability.RetrySettings
+	Breaker *stability.BreakerSettings
+	// OnError if set receives the events which failed to publish
+	OnError func(event Event, err error)
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+type Relay struct {
+	name         string
+	store        Store
+	publishFn    stability.ProcessFn
+	batchSize    int
+	pollInterval time.Duration
+	maxBlocked   int
+	onError      func(event Event, err error)
+	clock        stability.Clock
+}
+
+// NewRelay builds the relay of the store.
+// publishFn gets the Event bound to the context of the relay (stability.ContextObj).
+func NewRelay(store Store, publishFn stability.ProcessFn, settings RelaySettings) *Relay {
+	relay := new(Relay)
+
+	relay.name = settings.Name
+	relay.store = store
+
+	if relay.batchSize = settings.BatchSize; relay.batchSize <= 0 {
+		relay.batchSize = DefaultBatchSize
+	}
+
+	if relay.pollInterval = settings.PollInterval; relay.pollInterval <= 0 {
+		relay.pollInterval = DefaultPollInterval
+	}
+
+	if relay.maxBlocked = settings.MaxBlocked; relay.maxBlocked <= 0 {
+		relay.maxBlocked = DefaultMaxBlocked
+	}
+
+	if relay.onError = settings.OnError; relay.onError == nil {
+		relay.onError = func(Event, error) {}
+	}
+
+	if relay.clock = settings.Clock; relay.clock == nil {
+		relay.clock = stability.SystemClock
+	}
+
+	var policies []stability.Policy
+	if settings.Retry != nil {
+		retrySettings := *settings.Retry
+		retrySettings.Name = relay.name
+		if retrySettings.Clock == nil {
+			retrySettings.Clock = relay.clock
+		}
+		policies = append(policies, stability.NewRetry(retrySettings))
+	}
+	if settings.Breaker != nil {
+		breakerSettings := *settings.Breaker
+		breakerSettings.Name = relay.name
+		if breakerSettings.Clock == nil {
+			breakerSettings.Clock = relay.clock
+		}
+		policies = append(policies, stability.NewBreaker(breakerSettings))
+	}
+	relay.publishFn = stability.Chain(publishFn, policies...)
+
+	return relay
+}
+
+// RelayOnce publishes the pending events and returns the number of the events marked sent.
+// A page holding an aggregate which failed is fetched again past the blocked aggregates,
+// so a failing aggregate doesn't hold back the others. The pass ends at a call
+// rejected by the policies (e.g. an open breaker) or after MaxBlocked failed aggregates.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	total := 0
+	blocked := make(map[string]bool)
+	for {
+		var skip []string
+		for key := range blocked {
+			skip = append(skip, key)
+		}
+		sort.Strings(skip)
+		events, err := r.store.Pending(ctx, r.batchSize, skip)
+		if err != nil {
+			return total, err
+		}
+
+		n, next, err := r.publish(ctx, events, blocked)
+		total += n
+		if err != nil || !next || len(events) < r.batchSize || len(blocked) >= r.maxBlocked || ctx.Err() != nil {
+			return total, err
+		}
+	}
+}
+
+// publish publishes the events in order, a failed event holds back
+// the later events of its aggregate, and marks the published ones sent.
+// It returns whether the next page is worth fetching: an aggregate was blocked
+// and no call was rejected, the policies would reject the next ones too.
+func (r *Relay) publish(ctx context.Context, events []Event, blocked map[string]bool) (int, bool, error) {
+	var sent []int64
+	newlyBlocked, rejected := false, false
+	for _, event := range events {
+		if ctx.Err() != nil {
+			break
+		}
+		if blocked[event.AggregateKey] {
+			continue
+		}
+		if _, err := r.publishFn(stability.WithContext(ctx, event)); err != nil {
+			r.onError(event, err)
+			if stability.IsRejected(err) {
+				rejected = true
+				break
+			}
+			blocked[event.AggregateKey] = true
+			newlyBlocked = true
+			continue
+		}
+		sent = append(sent, event.ID)
+	}
+
+	next := newlyBlocked && !rejected
+	if len(sent) == 0 {
+		return 0, next, ctx.Err()
+	}
+	// The context may be done, the published events are still marked
+	if err := r.store.MarkSent(context.Background(), sent); err != nil {
+		return 0, next, err
+	}
+	return len(sent), next, ctx.Err()
+}
+
+// Run relays the events until ctx is done.
+// A full batch is followed by the next one at once, otherwise it waits for the PollInterval.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || n < r.batchSize {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-r.clock.After(r.pollInterval):
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package outbox
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQLStore keeps the outbox in a database/sql table:
+//
+//	CREATE TABLE outbox (
+//	    id            INTEGER PRIMARY KEY AUTOINCREMENT, -- BIGSERIAL etc.
+//	    aggregate_key VARCHAR(255) NOT NULL,
+//	    payload       BLOB NOT NULL,                     -- BYTEA etc.
+//	    created_at    TIMESTAMP NOT NULL,
+//	    sent_at       TIMESTAMP NULL
+//	);
+//	CREATE INDEX outbox_unsent ON outbox (sent_at, id);
+
+const DefaultTable = "outbox"
+
+// Execer is implemented by *sql.DB and *sql.Tx
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+type SQLStoreSettings struct {
+	// Table defaults to DefaultTable
+	Table string
+	// Placeholder returns the placeholder of the n-th (from 1) argument,
+	// "?" if not set, e.g. "$n" for PostgreSQL
+	Placeholder func(n int) string
+	// Clock stamps created_at and sent_at, stability.SystemClock if not set
+	Clock stability.Clock
+}
+
+type SQLStore struct {
+	db          *sql.DB
+	table       string
+	placeholder func(n int) string
+	clock       stability.Clock
+}
+
+func NewSQLStore(db *sql.DB, settings SQLStoreSettings) *SQLStore {
+	store := new(SQLStore)
+
+	store.db = db
+
+	if store.table = settings.Table; store.table == "" {
+		store.table = DefaultTable
+	}
+
+	if store.placeholder = settings.Placeholder; store.placeholder == nil {
+		store.placeholder = func(int) string { return "?" }
+	}
+
+	if store.clock = settings.Clock; store.clock == nil {
+		store.clock = stability.SystemClock
+	}
+
+	return store
+}
+
+// Add inserts the event, pass the transaction of the business change as tx
+func (s *SQLStore) Add(ctx context.Context, tx Execer, aggregateKey string, payload []byte) error {
+	query := fmt.Sprintf("INSERT INTO %s (aggregate_key, payload, created_at) VALUES (%s, %s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	_, err := tx.ExecContext(ctx, query, aggregateKey, payload, s.clock.Now().UTC())
+	return err
+}
+
+func (s *SQLStore) Pending(ctx context.Context, limit int, skip []string) ([]Event, error) {
+	var args []interface{}
+	where := "sent_at IS NULL"
+	if len(skip) > 0 {
+		placeholders := make([]string, len(skip))
+		for i, key := range skip {
+			args = append(args, key)
+			placeholders[i] = s.placeholder(i + 1)
+		}
+		where += fmt.Sprintf(" AND aggregate_key NOT IN (%s)", strings.Join(placeholders, ", "))
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf("SELECT id, aggregate_key, payload, created_at FROM %s WHERE %s ORDER BY id LIMIT %s",
+		s.table, where, s.placeholder(len(args)))
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		if err := rows.Scan(&event.ID, &event.AggregateKey, &event.Payload, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLStore) MarkSent(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	args := []interface{}{s.clock.Now().UTC()}
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		args = append(args, id)
+		placeholders[i] = s.placeholder(i + 2)
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET sent_at = %s WHERE id IN (%s)",
+		s.table, s.placeholder(1), strings.Join(placeholders, ", "))
+	_, err := s.db.ExecContext(ctx, query, args...)
+	return err
+}
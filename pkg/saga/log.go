@@ -0,0 +1,60 @@
+package saga
+
+import (
+	"sync"
+)
+
+// Log keeps the progress of the sagas, so an interrupted one can be resumed
+type Log interface {
+	// Save stores the state, replacing the previous one of the same Saga and ID
+	Save(state State) error
+	// Load returns the state of the saga, false if there is none
+	Load(saga, id string) (State, bool, error)
+	// Unfinished returns the states of the saga which aren't Finished:
+	// Running, Compensating or CompensationFailed
+	Unfinished(saga string) ([]State, error)
+}
+
+// MemoryLog is an in-process Log, for tests and single-process use
+type MemoryLog struct {
+	states map[string]State
+	mutex  sync.Mutex
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{states: make(map[string]State)}
+}
+
+func memoryLogKey(saga, id string) string {
+	return saga + ":" + id
+}
+
+func (l *MemoryLog) Save(state State) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state.Outputs = append([][]byte(nil), state.Outputs...)
+	l.states[memoryLogKey(state.Saga, state.ID)] = state
+	return nil
+}
+
+func (l *MemoryLog) Load(saga, id string) (State, bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	state, ok := l.states[memoryLogKey(saga, id)]
+	return state, ok, nil
+}
+
+func (l *MemoryLog) Unfinished(saga string) ([]State, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var states []State
+	for _, state := range l.states {
+		if state.Saga == saga && !state.Status.Finished() {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
@@ -0,0 +1,292 @@
+// Package saga implements the Saga (Compensating Transaction) pattern:
+// the steps of a saga run in order, and when one fails the compensations
+// of the completed ones run in the reverse order.
+// The progress is saved to a Log after every step, so a saga interrupted
+// by a crash is resumed from the step it was on. That step may run again,
+// the actions and the compensations should be idempotent.
+package saga
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var ErrAborted = errors.New("saga aborted")
+var ErrNotFound = errors.New("saga not found")
+
+// Status of a saga
+type Status int
+
+const (
+	// Running runs the steps forward
+	Running Status = iota
+	// Completed ran all the steps
+	Completed
+	// Compensating runs the compensations backward
+	Compensating
+	// Compensated undid the completed steps after a failure
+	Compensated
+	// CompensationFailed stopped at a failed compensation,
+	// Resume runs the compensations again from it
+	CompensationFailed
+)
+
+// Finished reports whether there is nothing left to resume
+func (s Status) Finished() bool {
+	return s == Completed || s == Compensated
+}
+
+// State is the progress of a saga kept in the Log
+type State struct {
+	Saga string
+	ID   string
+	// Status of the saga
+	Status Status
+	// Step is the index of the next step to run while Running,
+	// of the next step to compensate while compensating
+	Step int
+	// Outputs[0] is the encoded input of the saga, Outputs[i+1] the output of the step i
+	Outputs [][]byte
+	// FailedStep and Error describe the failure which started the compensation
+	FailedStep string
+	Error      string
+}
+
+// Error is returned by an aborted saga, errors.Is(err, ErrAborted) holds
+type Error struct {
+	Saga string
+	ID   string
+	// Step is the name of the failed step, Err its error
+	Step string
+	Err  error
+	// CompensateStep and CompensateErr are set when a compensation failed too
+	CompensateStep string
+	CompensateErr  error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("saga %s %s aborted at %s: %v", e.Saga, e.ID, e.Step, e.Err)
+	if e.CompensateErr != nil {
+		msg += fmt.Sprintf(", compensating %s: %v", e.CompensateStep, e.CompensateErr)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrAborted
+}
+
+// Step of a saga
+type Step struct {
+	Name string
+	// Action gets the output of the previous step, the input of the saga for the first one
+	Action stability.ProcessFn
+	// Compensate if set undoes the completed Action, it gets the output of the Action.
+	// A failed Action isn't compensated.
+	Compensate stability.ProcessFn
+	// Policies wrap the Action, CompensatePolicies the Compensate (e.g. Retry)
+	Policies           []stability.Policy
+	CompensatePolicies []stability.Policy
+}
+
+type Settings struct {
+	Name string
+	// Log defaults to a MemoryLog
+	Log Log
+	// Encode and Decode convert the input and the step outputs for the Log,
+	// JSON if not set (so a resumed saga gets maps, float64 etc.)
+	Encode func(obj interface{}) ([]byte, error)
+	Decode func(data []byte) (interface{}, error)
+}
+
+type step struct {
+	name       string
+	action     stability.ProcessFn
+	compensate stability.ProcessFn
+}
+
+type Saga struct {
+	name   string
+	steps  []step
+	log    Log
+	encode func(obj interface{}) ([]byte, error)
+	decode func(data []byte) (interface{}, error)
+}
+
+func defaultDecode(data []byte) (interface{}, error) {
+	var obj interface{}
+	err := json.Unmarshal(data, &obj)
+	return obj, err
+}
+
+func NewSaga(steps []Step, settings Settings) *Saga {
+	saga := new(Saga)
+
+	saga.name = settings.Name
+
+	for _, s := range steps {
+		compensate := s.Compensate
+		if compensate != nil {
+			compensate = stability.Chain(compensate, s.CompensatePolicies...)
+		}
+		saga.steps = append(saga.steps, step{
+			name:       s.Name,
+			action:     stability.Chain(s.Action, s.Policies...),
+			compensate: compensate,
+		})
+	}
+
+	if saga.log = settings.Log; saga.log == nil {
+		saga.log = NewMemoryLog()
+	}
+
+	if saga.encode = settings.Encode; saga.encode == nil {
+		saga.encode = json.Marshal
+	}
+
+	if saga.decode = settings.Decode; saga.decode == nil {
+		saga.decode = defaultDecode
+	}
+
+	return saga
+}
+
+// Run runs the saga with the input and returns the output of the last step,
+// or an *Error after the compensation. If the Log has the id the saga is resumed instead.
+func (s *Saga) Run(id string, inObj interface{}) (interface{}, error) {
+	state, ok, err := s.log.Load(s.name, id)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return s.resume(state)
+	}
+
+	data, err := s.encode(inObj)
+	if err != nil {
+		return nil, err
+	}
+	state = State{Saga: s.name, ID: id, Status: Running, Outputs: [][]byte{data}}
+	if err := s.log.Save(state); err != nil {
+		return nil, err
+	}
+	return s.run(&state, []interface{}{inObj}, nil)
+}
+
+// Resume continues the saga from the Log, a finished one returns its outcome again
+func (s *Saga) Resume(id string) (interface{}, error) {
+	state, ok, err := s.log.Load(s.name, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return s.resume(state)
+}
+
+// ResumeAll resumes the unfinished sagas of the Log one by one,
+// their outcomes are in the Log. It returns the Log error only.
+func (s *Saga) ResumeAll() error {
+	states, err := s.log.Unfinished(s.name)
+	if err != nil {
+		return err
+	}
+	for _, state := range states {
+		_, _ = s.resume(state)
+	}
+	return nil
+}
+
+func (s *Saga) resume(state State) (interface{}, error) {
+	values := make([]interface{}, len(state.Outputs))
+	for i, data := range state.Outputs {
+		value, err := s.decode(data)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return s.run(&state, values, nil)
+}
+
+// run continues the saga from the state, values are the decoded Outputs
+// and failErr is the error of the failed step if known
+func (s *Saga) run(state *State, values []interface{}, failErr error) (interface{}, error) {
+	for state.Status == Running && state.Step < len(s.steps) {
+		step := s.steps[state.Step]
+		outObj, err := step.action(values[state.Step])
+		if err != nil {
+			failErr = err
+			state.Status = Compensating
+			state.FailedStep = step.name
+			state.Error = err.Error()
+			state.Step--
+			if err := s.log.Save(*state); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		data, err := s.encode(outObj)
+		if err != nil {
+			return nil, err
+		}
+		state.Outputs = append(state.Outputs, data)
+		values = append(values, outObj)
+		state.Step++
+		if err := s.log.Save(*state); err != nil {
+			return nil, err
+		}
+	}
+
+	if state.Status == Running {
+		state.Status = Completed
+		if err := s.log.Save(*state); err != nil {
+			return nil, err
+		}
+	}
+	if state.Status == Completed {
+		return values[len(values)-1], nil
+	}
+
+	if failErr == nil {
+		failErr = errors.New(state.Error)
+	}
+	sagaErr := &Error{Saga: s.name, ID: state.ID, Step: state.FailedStep, Err: failErr}
+	if state.Status == Compensated {
+		return nil, sagaErr
+	}
+
+	state.Status = Compensating
+	for state.Step >= 0 {
+		step := s.steps[state.Step]
+		if step.compensate != nil {
+			if _, err := step.compensate(values[state.Step+1]); err != nil {
+				sagaErr.CompensateStep = step.name
+				sagaErr.CompensateErr = err
+				state.Status = CompensationFailed
+				if err := s.log.Save(*state); err != nil {
+					return nil, err
+				}
+				return nil, sagaErr
+			}
+		}
+		state.Step--
+		if err := s.log.Save(*state); err != nil {
+			return nil, err
+		}
+	}
+
+	state.Status = Compensated
+	if err := s.log.Save(*state); err != nil {
+		return nil, err
+	}
+	return nil, sagaErr
+}
@@ -0,0 +1,243 @@
+package stability
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimiter limits the number of concurrent calls and discovers
+// the limit from the observed latency and errors instead of a static setting:
+// the limit grows while the latency is stable and shrinks on errors or latency spikes.
+// A call over the limit is rejected with ErrLimitExceeded.
+
+const DefaultInitialLimit = 20
+const DefaultMinLimit = 1
+const DefaultMaxLimit = 1000
+const DefaultBackoffRatio = 0.9
+const DefaultMinRTTWindow = time.Duration(1) * time.Minute
+
+var (
+	// ErrLimitExceeded is returned when the concurrency limit is reached
+	ErrLimitExceeded = errors.New("concurrency limit exceeded")
+)
+
+type AdaptiveAlgorithm int
+
+const (
+	// AIMD adds 1 to the limit per successful call and multiplies it
+	// by BackoffRatio per failed (or slower than LatencyThreshold) call
+	AIMD AdaptiveAlgorithm = iota
+	// Vegas estimates the queue from the ratio of the minimal and the current latency
+	// and keeps it small
+	Vegas
+	// Gradient2 compares the current latency to its long term average
+	// and scales the limit by the ratio
+	Gradient2
+)
+
+// gradient2Window is the number of samples of the long term latency average
+const gradient2Window = 100
+
+type AdaptiveLimiterSettings struct {
+	Name string
+	// Algorithm defaults to AIMD
+	Algorithm AdaptiveAlgorithm
+	// InitialLimit, MinLimit and MaxLimit default to
+	// DefaultInitialLimit, DefaultMinLimit and DefaultMaxLimit
+	InitialLimit uint32
+	MinLimit     uint32
+	MaxLimit     uint32
+	// BackoffRatio is the AIMD decrease, DefaultBackoffRatio if not set
+	BackoffRatio float64
+	// LatencyThreshold if set makes AIMD treat slower calls as failed
+	LatencyThreshold time.Duration
+	// MinRTTWindow is how long the minimal latency of Vegas is kept,
+	// then the next sample starts a new minimum so the limit follows
+	// a dependency which became slower for good. DefaultMinRTTWindow if not set.
+	MinRTTWindow time.Duration
+	// IsDropped reports whether the error means the dependency is overloaded,
+	// all errors do if not set
+	IsDropped func(err error) bool
+	// EventBus if set receives CallRejected events
+	EventBus *EventBus
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type AdaptiveLimiter struct {
+	name             string
+	algorithm        AdaptiveAlgorithm
+	minLimit         float64
+	maxLimit         float64
+	backoffRatio     float64
+	latencyThreshold time.Duration
+	minRTTWindow     time.Duration
+	isDropped        func(err error) bool
+	eventBus         *EventBus
+	clock            Clock
+	limit            float64
+	inFlight         uint32
+	minRTT           time.Duration
+	minRTTAt         time.Time
+	longRTT          float64
+	mutex            sync.Mutex
+}
+
+func NewAdaptiveLimiter(settings AdaptiveLimiterSettings) *AdaptiveLimiter {
+	limiter := new(AdaptiveLimiter)
+
+	limiter.name = settings.Name
+	limiter.algorithm = settings.Algorithm
+
+	limiter.minLimit = DefaultMinLimit
+	if settings.MinLimit > 0 {
+		limiter.minLimit = float64(settings.MinLimit)
+	}
+
+	limiter.maxLimit = DefaultMaxLimit
+	if settings.MaxLimit > 0 {
+		limiter.maxLimit = float64(settings.MaxLimit)
+	}
+
+	limiter.limit = DefaultInitialLimit
+	if settings.InitialLimit > 0 {
+		limiter.limit = float64(settings.InitialLimit)
+	}
+	limiter.limit = math.Max(limiter.minLimit, math.Min(limiter.maxLimit, limiter.limit))
+
+	if limiter.backoffRatio = settings.BackoffRatio; limiter.backoffRatio <= 0 || limiter.backoffRatio >= 1 {
+		limiter.backoffRatio = DefaultBackoffRatio
+	}
+
+	limiter.latencyThreshold = settings.LatencyThreshold
+
+	if limiter.minRTTWindow = settings.MinRTTWindow; limiter.minRTTWindow <= 0 {
+		limiter.minRTTWindow = DefaultMinRTTWindow
+	}
+
+	if limiter.isDropped = settings.IsDropped; limiter.isDropped == nil {
+		limiter.isDropped = func(err error) bool { return err != nil }
+	}
+
+	limiter.eventBus = settings.EventBus
+	limiter.clock = clockOrDefault(settings.Clock)
+
+	return limiter
+}
+
+// Limit returns the current concurrency limit
+func (l *AdaptiveLimiter) Limit() uint32 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return uint32(l.limit)
+}
+
+// InFlight returns the number of running calls
+func (l *AdaptiveLimiter) InFlight() uint32 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.inFlight
+}
+
+// acquire returns the number of calls in flight including this one, 0 if it's rejected
+func (l *AdaptiveLimiter) acquire() uint32 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.inFlight >= uint32(l.limit) {
+		return 0
+	}
+	l.inFlight++
+	return l.inFlight
+}
+
+// log10 is the step of Vegas, at least 1
+func log10(limit float64) float64 {
+	return math.Max(1, math.Floor(math.Log10(limit)))
+}
+
+// release records the sample of the finished call and updates the limit
+func (l *AdaptiveLimiter) release(rtt time.Duration, inFlight uint32, dropped bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inFlight--
+
+	if now := l.clock.Now(); l.minRTT == 0 || rtt < l.minRTT || now.Sub(l.minRTTAt) >= l.minRTTWindow {
+		l.minRTT = rtt
+		l.minRTTAt = now
+	}
+	if l.longRTT == 0 {
+		l.longRTT = float64(rtt)
+	} else {
+		l.longRTT += (float64(rtt) - l.longRTT) / gradient2Window
+	}
+
+	if l.algorithm == AIMD && l.latencyThreshold > 0 && rtt > l.latencyThreshold {
+		dropped = true
+	}
+
+	// Don't grow the limit while the calls don't even use half of it
+	if !dropped && float64(inFlight)*2 < l.limit {
+		return
+	}
+
+	limit := l.limit
+	switch l.algorithm {
+	case Vegas:
+		step := log10(limit)
+		queue := limit
+		if rtt > 0 {
+			queue = limit * (1 - float64(l.minRTT)/float64(rtt))
+		}
+		switch {
+		case dropped:
+			limit -= step
+		case queue <= step:
+			limit += 6 * step
+		case queue < 3*step:
+			limit += step
+		case queue > 6*step:
+			limit -= step
+		}
+	case Gradient2:
+		gradient := 0.5
+		if !dropped && rtt > 0 {
+			gradient = math.Max(0.5, math.Min(1, 1.5*l.longRTT/float64(rtt)))
+		}
+		newLimit := limit*gradient + math.Sqrt(limit)
+		limit = limit*0.8 + newLimit*0.2
+	default:
+		if dropped {
+			limit *= l.backoffRatio
+		} else {
+			limit++
+		}
+	}
+
+	l.limit = math.Max(l.minLimit, math.Min(l.maxLimit, limit))
+}
+
+func (l *AdaptiveLimiter) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		inFlight := l.acquire()
+		if inFlight == 0 {
+			l.eventBus.Publish(Event{Type: CallRejected, Name: l.name, Time: l.clock.Now(), Err: ErrLimitExceeded})
+			return nil, ErrLimitExceeded
+		}
+
+		// A panic counts as a dropped call
+		start := l.clock.Now()
+		dropped := true
+		defer func() {
+			l.release(l.clock.Since(start), inFlight, dropped)
+		}()
+
+		res, err := processFn(inObj)
+		dropped = l.isDropped(err)
+
+		return res, err
+	}
+}
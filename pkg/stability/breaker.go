@@ -7,6 +7,7 @@ import (
 )
 
 const DefaultFailureThreshold = 1
+const DefaultBreakerStateTTL = time.Duration(10) * time.Minute
 
 func defaultBreakerExpiryFn(tryCnt int) time.Duration {
 	return time.Millisecond * time.Duration((2<<tryCnt)*10)
@@ -21,6 +22,21 @@ type BreakerSettings struct {
 	Name             string
 	FailureThreshold uint32
 	ExpiryFn         func(tryCnt int) time.Duration
+	// EventBus if set receives BreakerOpened, BreakerHalfOpened,
+	// BreakerClosed and CallRejected events
+	EventBus *EventBus
+	// Tracer if set records rejections on the span
+	// carried by the input object's context
+	Tracer Tracer
+	// Clock defaults to SystemClock
+	Clock Clock
+	// Store if set keeps the breaker state shared by the instances
+	// using the same Name, see StateStore
+	Store StateStore
+	// StateTTL is how long the Store keeps the failures after the last one,
+	// DefaultBreakerStateTTL if not set. The failures further apart are
+	// counted as consecutive, like the in-process breaker does.
+	StateTTL time.Duration
 }
 
 type Breaker struct {
@@ -29,6 +45,11 @@ type Breaker struct {
 	consecutiveFailures uint32
 	expiryFn            func(tryCnt int) time.Duration
 	lastAttempt         time.Time
+	eventBus            *EventBus
+	tracer              Tracer
+	clock               Clock
+	store               StateStore
+	stateTTL            time.Duration
 	mutex               sync.Mutex
 }
 
@@ -45,13 +66,60 @@ func NewBreaker(settings BreakerSettings) *Breaker {
 		breaker.expiryFn = defaultBreakerExpiryFn
 	}
 
+	breaker.eventBus = settings.EventBus
+	breaker.tracer = settings.Tracer
+	breaker.clock = clockOrDefault(settings.Clock)
+	breaker.store = settings.Store
+
+	if breaker.stateTTL = settings.StateTTL; breaker.stateTTL <= 0 {
+		breaker.stateTTL = DefaultBreakerStateTTL
+	}
+
 	return breaker
 }
 
+// BreakerState is the state of a breaker
+type BreakerState int
+
+const (
+	StateClosed BreakerState = iota
+	StateOpen
+	// StateHalfOpen lets a trial call through
+	StateHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Name returns the breaker name
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the state the next call would see
+func (b *Breaker) State() BreakerState {
+	eventType, _, err := b.checkState()
+	switch {
+	case err != nil:
+		return StateOpen
+	case eventType == BreakerHalfOpened:
+		return StateHalfOpen
+	}
+	return StateClosed
+}
+
 func (b *Breaker) GetProcessorFn(processFn ProcessFn) ProcessFn {
 	return func(inObj interface{}) (interface{}, error) {
 
 		if err := b.beforeProcess(); err != nil {
+			addSpanEvent(b.tracer, inObj, SpanEventBreakerRejected, Attr{Key: "policy", Value: b.name})
 			return nil, err
 		}
 
@@ -66,21 +134,59 @@ func (b *Breaker) GetProcessorFn(processFn ProcessFn) ProcessFn {
 }
 
 func (b *Breaker) afterProcess(err error) error {
+	eventType, failures := b.registerResult(err)
+	if eventType != 0 {
+		b.eventBus.Publish(Event{Type: eventType, Name: b.name, Time: b.clock.Now(), Attempt: int(failures), Err: err})
+	}
+
+	return err
+}
+
+// registerResult updates the counters and returns
+// the state transition event type (0 if the state is not changed)
+func (b *Breaker) registerResult(err error) (EventType, uint32) {
+	if b.store != nil {
+		return b.registerSharedResult(err)
+	}
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
-	b.lastAttempt = time.Now()
+	b.lastAttempt = b.clock.Now()
 
 	if err != nil {
 		b.consecutiveFailures++
-	} else {
-		b.consecutiveFailures = 0
+		if b.consecutiveFailures >= b.failureThreshold {
+			return BreakerOpened, b.consecutiveFailures
+		}
+		return 0, b.consecutiveFailures
 	}
 
-	return err
+	wasOpen := b.consecutiveFailures >= b.failureThreshold
+	b.consecutiveFailures = 0
+	if wasOpen {
+		return BreakerClosed, 0
+	}
+
+	return 0, 0
 }
 
 func (b *Breaker) beforeProcess() error {
+	eventType, failures, err := b.checkState()
+	if eventType != 0 {
+		b.eventBus.Publish(Event{Type: eventType, Name: b.name, Time: b.clock.Now(), Attempt: int(failures), Err: err})
+	}
+
+	return err
+}
+
+// checkState returns ErrOpenState if the call must be rejected
+// and the event type to publish (0 if the breaker is closed)
+func (b *Breaker) checkState() (EventType, uint32, error) {
+	if b.store != nil {
+		return b.checkSharedState()
+	}
+
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
@@ -89,15 +195,17 @@ func (b *Breaker) beforeProcess() error {
 
 	// If we in Open state
 	if d >= 0 {
-		now := time.Now()
+		now := b.clock.Now()
 		shouldRetryAt := b.lastAttempt.Add(b.expiryFn(d))
 		// We are in Open state wait
 		if now.Before(shouldRetryAt){
-			return ErrOpenState
+			return CallRejected, b.consecutiveFailures, ErrOpenState
 		}
+		// Expiry passed, let a trial call through
+		return BreakerHalfOpened, b.consecutiveFailures, nil
 	}
 
-	return nil
+	return 0, b.consecutiveFailures, nil
 }
 
 //func Breaker___(circuit Circuit, failureThreshold uint) Circuit {
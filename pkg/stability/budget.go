@@ -0,0 +1,74 @@
+package stability
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A latency budget is the deadline of the whole call chain.
+// It's carried by the context of the input object: the context deadline
+// or a deadline set by WithBudget, whichever is earlier. WithBudget
+// doesn't cancel the context, so it works with any Clock.
+// Each policy reads the remaining budget: Timeout narrows its timeout to it,
+// Retry skips an attempt which can't finish in it and Throttle doesn't wait past it.
+
+var (
+	// ErrBudgetExceeded matches every *BudgetExceededError with errors.Is
+	ErrBudgetExceeded = errors.New("latency budget exceeded")
+)
+
+// BudgetExceededError is returned when the remaining budget is too small for the call.
+// Err is the error of the last attempt, if there was one.
+type BudgetExceededError struct {
+	Name      string
+	Remaining time.Duration
+	Err       error
+}
+
+func (e *BudgetExceededError) Error() string {
+	msg := fmt.Sprintf("%s: latency budget exceeded, %v left", e.Name, e.Remaining)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BudgetExceededError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BudgetExceededError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+type budgetKey struct{}
+
+// WithBudget returns ctx carrying the budget deadline,
+// an earlier budget already carried by ctx is kept
+func WithBudget(ctx context.Context, deadline time.Time) context.Context {
+	if current, ok := BudgetDeadline(ctx); ok && current.Before(deadline) {
+		return ctx
+	}
+	return context.WithValue(ctx, budgetKey{}, deadline)
+}
+
+// BudgetDeadline returns the earlier of the budget and the deadline of ctx
+func BudgetDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if budget, hasBudget := ctx.Value(budgetKey{}).(time.Time); hasBudget && (!ok || budget.Before(deadline)) {
+		deadline, ok = budget, true
+	}
+	return deadline, ok
+}
+
+// RemainingBudget returns the budget left for the input object,
+// false if its context has no deadline
+func RemainingBudget(inObj interface{}, clock Clock) (time.Duration, bool) {
+	deadline, ok := BudgetDeadline(ContextOf(inObj))
+	if !ok {
+		return 0, false
+	}
+	return deadline.Sub(clockOrDefault(clock).Now()), true
+}
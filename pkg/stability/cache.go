@@ -0,0 +1,272 @@
+package stability
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Cache memoizes the results of the ProcessFn by the key of the input object.
+// Concurrent misses of a key make one call, the others wait for its result.
+// The cached results are shared by the callers and must not be modified.
+//
+// After the TTL an entry may still be used:
+//   - within StaleWhileRevalidate it's returned at once and refreshed in the background
+//     (the refresh gets the input object of the caller which triggered it, bound to
+//     a context of its own cancelled after the RefreshTimeout, see BindContext)
+//   - within StaleIfError it replaces the error of a failed call,
+//     e.g. ErrOpenState of a Breaker wrapped by the Cache
+
+const DefaultCacheTTL = time.Duration(1) * time.Minute
+const DefaultCacheMaxEntries = 10000
+const DefaultCacheRefreshTimeout = time.Duration(10) * time.Second
+
+type CacheSettings struct {
+	Name string
+	// KeyFn takes the key from the input object, fmt.Sprint(inObj) if not set
+	KeyFn func(inObj interface{}) string
+	// TTL defaults to DefaultCacheTTL
+	TTL time.Duration
+	// MaxEntries defaults to DefaultCacheMaxEntries,
+	// the least recently used entry is evicted above it
+	MaxEntries int
+	// NegativeTTL if set caches the errors for it
+	NegativeTTL          time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// RefreshTimeout bounds the background refresh, DefaultCacheRefreshTimeout if not set
+	RefreshTimeout time.Duration
+	// Fallback reports whether a stale entry may replace the error,
+	// all errors if not set. Used with StaleIfError only.
+	Fallback func(err error) bool
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type cacheEntry struct {
+	key        string
+	res        interface{}
+	err        error
+	expiresAt  time.Time
+	refreshing bool
+}
+
+type Cache struct {
+	name                 string
+	keyFn                func(inObj interface{}) string
+	ttl                  time.Duration
+	maxEntries           int
+	negativeTTL          time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	refreshTimeout       time.Duration
+	fallback             func(err error) bool
+	clock                Clock
+	entries              map[string]*list.Element
+	lru                  *list.List
+	flights              flightGroup
+	mutex                sync.Mutex
+}
+
+func NewCache(settings CacheSettings) *Cache {
+	cache := new(Cache)
+
+	cache.name = settings.Name
+
+	if cache.keyFn = settings.KeyFn; cache.keyFn == nil {
+		cache.keyFn = defaultKeyFn
+	}
+
+	if cache.ttl = settings.TTL; cache.ttl <= 0 {
+		cache.ttl = DefaultCacheTTL
+	}
+
+	if cache.maxEntries = settings.MaxEntries; cache.maxEntries <= 0 {
+		cache.maxEntries = DefaultCacheMaxEntries
+	}
+
+	cache.negativeTTL = settings.NegativeTTL
+	cache.staleWhileRevalidate = settings.StaleWhileRevalidate
+	cache.staleIfError = settings.StaleIfError
+
+	if cache.refreshTimeout = settings.RefreshTimeout; cache.refreshTimeout <= 0 {
+		cache.refreshTimeout = DefaultCacheRefreshTimeout
+	}
+
+	if cache.fallback = settings.Fallback; cache.fallback == nil {
+		cache.fallback = func(err error) bool { return true }
+	}
+
+	cache.clock = clockOrDefault(settings.Clock)
+	cache.flights.clock = cache.clock
+	cache.entries = make(map[string]*list.Element)
+	cache.lru = list.New()
+
+	return cache
+}
+
+// Len returns the number of cached entries, the expired ones included
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// Invalidate removes the entry of the key
+func (c *Cache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// remove must be called under the mutex
+func (c *Cache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// get returns a copy of the entry, dropping it if it's too old to be used at all
+func (c *Cache) get(key string, now time.Time) (cacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+
+	keep := c.staleWhileRevalidate
+	if c.staleIfError > keep {
+		keep = c.staleIfError
+	}
+	if entry.err != nil {
+		keep = 0
+	}
+	if !now.Before(entry.expiresAt.Add(keep)) {
+		c.remove(element)
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(element)
+	return *entry, true
+}
+
+func (c *Cache) set(key string, res interface{}, err error, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := &cacheEntry{key: key, res: res, err: err, expiresAt: c.clock.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// startRefresh marks the entry as refreshing, false if it already is
+func (c *Cache) startRefresh(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok || element.Value.(*cacheEntry).refreshing {
+		return false
+	}
+	element.Value.(*cacheEntry).refreshing = true
+	return true
+}
+
+func (c *Cache) stopRefresh(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// load calls processFn once for the concurrent callers of the key
+func (c *Cache) load(key string, inObj interface{}, processFn ProcessFn) (interface{}, error) {
+	res, err, _ := c.flights.do(key, 0, func() (interface{}, error) {
+		res, err := processFn(inObj)
+		if err == nil {
+			c.set(key, res, nil, c.ttl)
+			return res, nil
+		}
+
+		if c.staleIfError > 0 && c.fallback(err) {
+			if entry, ok := c.get(key, c.clock.Now()); ok && entry.err == nil && c.clock.Now().Before(entry.expiresAt.Add(c.staleIfError)) {
+				return entry.res, nil
+			}
+		}
+
+		if c.negativeTTL > 0 {
+			c.set(key, res, err, c.negativeTTL)
+		}
+		return res, err
+	})
+	return res, err
+}
+
+// refresh reloads the stale entry, a failure or a panic keeps it.
+// The panic is recovered, nothing waits for the background call to raise it in.
+// The context of the caller which triggered it may be done before it runs,
+// so the input object gets a context of its own limited by the RefreshTimeout.
+func (c *Cache) refresh(key string, inObj interface{}, processFn ProcessFn) {
+	defer c.stopRefresh(key)
+	defer func() {
+		_ = recover()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A ticker, unlike After, is stopped when the refresh returns first
+	timer := c.clock.NewTicker(c.refreshTimeout)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	refreshObj, _ := BindContext(inObj, WithBudget(ctx, c.clock.Now().Add(c.refreshTimeout)))
+
+	_, _, _ = c.flights.do(key, 0, func() (interface{}, error) {
+		res, err := processFn(refreshObj)
+		if err == nil {
+			c.set(key, res, nil, c.ttl)
+		}
+		return res, err
+	})
+}
+
+func (c *Cache) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		key := c.keyFn(inObj)
+		now := c.clock.Now()
+
+		if entry, ok := c.get(key, now); ok {
+			if now.Before(entry.expiresAt) {
+				return entry.res, entry.err
+			}
+			if entry.err == nil && now.Before(entry.expiresAt.Add(c.staleWhileRevalidate)) {
+				if c.startRefresh(key) {
+					go c.refresh(key, inObj, processFn)
+				}
+				return entry.res, nil
+			}
+		}
+
+		return c.load(key, inObj, processFn)
+	}
+}
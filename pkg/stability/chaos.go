@@ -0,0 +1,240 @@
+package stability
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultInjector wraps a ProcessFn and injects errors, latency, panics
+// or dropped responses for chaos testing. The faults are picked either
+// by the configured probabilities from a seeded random source
+// or by a script such as "fail 3, succeed 2", so a test run is reproducible.
+
+const DefaultInjectedLatency = time.Duration(100) * time.Millisecond
+
+var (
+	// ErrInjectedFault is returned by FaultError if no other error is configured
+	ErrInjectedFault = errors.New("injected fault")
+	// ErrInjectedDrop is returned by FaultDrop: the call was made, but its response is lost
+	ErrInjectedDrop = errors.New("injected fault: response dropped")
+)
+
+type Fault int
+
+const (
+	// NoFault calls the wrapped function as is
+	NoFault Fault = iota
+	// FaultError returns an error without calling the wrapped function
+	FaultError
+	// FaultLatency sleeps for the configured latency and calls the wrapped function
+	FaultLatency
+	// FaultPanic panics without calling the wrapped function
+	FaultPanic
+	// FaultDrop calls the wrapped function and returns ErrInjectedDrop instead of its result
+	FaultDrop
+)
+
+var faultNames = map[string]Fault{
+	"succeed": NoFault, "ok": NoFault,
+	"fail": FaultError, "error": FaultError,
+	"delay": FaultLatency, "latency": FaultLatency,
+	"panic": FaultPanic,
+	"drop":  FaultDrop,
+}
+
+func (f Fault) String() string {
+	switch f {
+	case NoFault:
+		return "succeed"
+	case FaultError:
+		return "fail"
+	case FaultLatency:
+		return "delay"
+	case FaultPanic:
+		return "panic"
+	case FaultDrop:
+		return "drop"
+	}
+	return "unknown"
+}
+
+// FaultStep is a script step: Fault is injected Count times in a row.
+// Count <= 0 repeats the step for ever.
+type FaultStep struct {
+	Fault Fault
+	Count int
+}
+
+// ParseFaultScript parses a script like "fail 3, succeed 2, panic, drop 1".
+// Step names are succeed (ok), fail (error), delay (latency), panic and drop.
+// A step without a count is injected once, a step with count 0 for ever.
+func ParseFaultScript(script string) ([]FaultStep, error) {
+	var steps []FaultStep
+	for _, s := range strings.Split(script, ",") {
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("fault script: bad step %q", s)
+		}
+
+		fault, ok := faultNames[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("fault script: unknown fault %q", fields[0])
+		}
+
+		step := FaultStep{Fault: fault, Count: 1}
+		if len(fields) == 2 {
+			cnt, err := strconv.Atoi(fields[1])
+			if err != nil || cnt < 0 {
+				return nil, fmt.Errorf("fault script: bad count in step %q", s)
+			}
+			step.Count = cnt
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+type FaultInjectorSettings struct {
+	Name string
+	// Enabled must be set to inject anything,
+	// a disabled injector calls the wrapped function as is
+	Enabled bool
+	// Seed of the random source used for the probabilities
+	Seed int64
+	// Probabilities (0..1) of the faults, their sum should not exceed 1
+	ErrorRate   float64
+	LatencyRate float64
+	PanicRate   float64
+	DropRate    float64
+	// Latency added by FaultLatency, DefaultInjectedLatency if not set
+	Latency time.Duration
+	// Err is returned by FaultError, ErrInjectedFault if not set
+	Err error
+	// Script if set is used instead of the probabilities.
+	// When the script is over the injector stops injecting
+	// unless RepeatScript is set.
+	Script       []FaultStep
+	RepeatScript bool
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type FaultInjector struct {
+	name         string
+	enabled      bool
+	rnd          *rand.Rand
+	errorRate    float64
+	latencyRate  float64
+	panicRate    float64
+	dropRate     float64
+	latency      time.Duration
+	err          error
+	script       []FaultStep
+	repeatScript bool
+	scriptStep   int
+	stepCnt      int
+	clock        Clock
+	mutex        sync.Mutex
+}
+
+func NewFaultInjector(settings FaultInjectorSettings) *FaultInjector {
+	injector := new(FaultInjector)
+
+	injector.name = settings.Name
+	injector.enabled = settings.Enabled
+	injector.rnd = rand.New(rand.NewSource(settings.Seed))
+	injector.errorRate = settings.ErrorRate
+	injector.latencyRate = settings.LatencyRate
+	injector.panicRate = settings.PanicRate
+	injector.dropRate = settings.DropRate
+
+	if injector.latency = settings.Latency; injector.latency <= 0 {
+		injector.latency = DefaultInjectedLatency
+	}
+
+	if injector.err = settings.Err; injector.err == nil {
+		injector.err = ErrInjectedFault
+	}
+
+	injector.script = append([]FaultStep(nil), settings.Script...)
+	injector.repeatScript = settings.RepeatScript
+	injector.clock = clockOrDefault(settings.Clock)
+
+	return injector
+}
+
+// nextFault picks the fault for the next call
+func (f *FaultInjector) nextFault() Fault {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.enabled {
+		return NoFault
+	}
+
+	if len(f.script) > 0 {
+		return f.nextScriptFault()
+	}
+
+	r := f.rnd.Float64()
+	for _, c := range []struct {
+		fault Fault
+		rate  float64
+	}{{FaultError, f.errorRate}, {FaultLatency, f.latencyRate}, {FaultPanic, f.panicRate}, {FaultDrop, f.dropRate}} {
+		if r < c.rate {
+			return c.fault
+		}
+		r -= c.rate
+	}
+	return NoFault
+}
+
+// nextScriptFault must be called under the mutex
+func (f *FaultInjector) nextScriptFault() Fault {
+	for {
+		if f.scriptStep >= len(f.script) {
+			if !f.repeatScript {
+				return NoFault
+			}
+			f.scriptStep = 0
+		}
+
+		step := f.script[f.scriptStep]
+		if step.Count <= 0 {
+			return step.Fault
+		}
+		if f.stepCnt < step.Count {
+			f.stepCnt++
+			return step.Fault
+		}
+
+		f.scriptStep++
+		f.stepCnt = 0
+	}
+}
+
+func (f *FaultInjector) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		switch f.nextFault() {
+		case FaultError:
+			return nil, f.err
+		case FaultLatency:
+			f.clock.Sleep(f.latency)
+		case FaultPanic:
+			panic(fmt.Sprintf("%s: injected panic", f.name))
+		case FaultDrop:
+			_, _ = processFn(inObj)
+			return nil, ErrInjectedDrop
+		}
+
+		return processFn(inObj)
+	}
+}
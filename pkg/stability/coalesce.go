@@ -0,0 +1,54 @@
+package stability
+
+import "time"
+
+// Coalesce collapses the concurrent calls with the same key into one call
+// of the ProcessFn, all the callers get its result (shared, it must not be modified).
+// With MaxShare set a call running longer than it isn't joined anymore,
+// the next caller starts a new one, so a hung call doesn't hold every caller.
+
+type CoalesceSettings struct {
+	Name string
+	// KeyFn takes the key from the input object, fmt.Sprint(inObj) if not set
+	KeyFn func(inObj interface{}) string
+	// MaxShare if set limits how long a call is shared
+	MaxShare time.Duration
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type Coalesce struct {
+	name     string
+	keyFn    func(inObj interface{}) string
+	maxShare time.Duration
+	flights  flightGroup
+}
+
+func NewCoalesce(settings CoalesceSettings) *Coalesce {
+	coalesce := new(Coalesce)
+
+	coalesce.name = settings.Name
+
+	if coalesce.keyFn = settings.KeyFn; coalesce.keyFn == nil {
+		coalesce.keyFn = defaultKeyFn
+	}
+
+	coalesce.maxShare = settings.MaxShare
+	coalesce.flights.clock = clockOrDefault(settings.Clock)
+
+	return coalesce
+}
+
+// Waiting returns the number of callers waiting for the call in progress of the key
+func (c *Coalesce) Waiting(key string) int {
+	return c.flights.waiting(key)
+}
+
+func (c *Coalesce) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		res, err, _ := c.flights.do(c.keyFn(inObj), c.maxShare, func() (interface{}, error) {
+			return processFn(inObj)
+		})
+		return res, err
+	}
+}
@@ -0,0 +1,69 @@
+package stability
+
+import (
+	"context"
+	"net/http"
+)
+
+// ProcessFn takes a bare interface{} so it stays compatible with
+// yapgo pipeline stages. A context.Context travels to the policies
+// inside the input object instead: any input that implements Contexter
+// (*http.Request does) makes the wrapped call context-aware.
+
+// Contexter is implemented by input objects which carry a context
+type Contexter interface {
+	Context() context.Context
+}
+
+// ContextBinder is implemented by input objects which can carry
+// another context, BindContext returns the copy bound to ctx
+type ContextBinder interface {
+	BindContext(ctx context.Context) interface{}
+}
+
+// ContextObj binds an input object to a context.
+// The wrapped ProcessFn receives the ContextObj itself
+// and gets the original input back from Obj.
+type ContextObj struct {
+	Ctx context.Context
+	Obj interface{}
+}
+
+// WithContext returns the input object bound to ctx
+func WithContext(ctx context.Context, inObj interface{}) ContextObj {
+	return ContextObj{Ctx: ctx, Obj: inObj}
+}
+
+func (c ContextObj) Context() context.Context {
+	if c.Ctx == nil {
+		return context.Background()
+	}
+	return c.Ctx
+}
+
+func (c ContextObj) BindContext(ctx context.Context) interface{} {
+	return WithContext(ctx, c.Obj)
+}
+
+// BindContext returns the input object carrying ctx instead of its context,
+// ok is false if the object is neither a ContextBinder nor a *http.Request
+func BindContext(inObj interface{}, ctx context.Context) (interface{}, bool) {
+	switch obj := inObj.(type) {
+	case ContextBinder:
+		return obj.BindContext(ctx), true
+	case *http.Request:
+		return obj.WithContext(ctx), true
+	}
+	return inObj, false
+}
+
+// ContextOf returns the context carried by the input object
+// or context.Background() if it has none
+func ContextOf(inObj interface{}) context.Context {
+	if c, ok := inObj.(Contexter); ok {
+		if ctx := c.Context(); ctx != nil {
+			return ctx
+		}
+	}
+	return context.Background()
+}
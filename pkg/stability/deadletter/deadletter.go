@@ -0,0 +1,143 @@
+// Package deadletter captures the inputs which failed all the policies,
+// together with their errors, attempt count and timestamps, so they
+// can be inspected and replayed instead of disappearing.
+package deadletter
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"errors"
+	"time"
+)
+
+// Letter is a failed input. Err is kept in memory only,
+// the error messages are in Error and Errors.
+type Letter struct {
+	Name  string      `json:"name,omitempty"`
+	Input interface{} `json:"input"`
+	Error string      `json:"error"`
+	// Errors has the error of every attempt
+	Errors   []string `json:"errors"`
+	Attempts int      `json:"attempts"`
+	// FirstAttempt and LastAttempt are zero if the call had no Retry
+	FirstAttempt time.Time `json:"first_attempt"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	// Time is when the letter was created
+	Time     time.Time `json:"time"`
+	Rejected bool      `json:"rejected,omitempty"`
+	Err      error     `json:"-"`
+}
+
+// New builds the letter of the failed input,
+// the attempts are taken from a stability.RetryError in the chain of err
+// (see stability.RetrySettings.ReturnRetryError)
+func New(name string, inObj interface{}, err error, now time.Time) Letter {
+	letter := Letter{
+		Name:     name,
+		Input:    inObj,
+		Error:    err.Error(),
+		Errors:   []string{err.Error()},
+		Attempts: 1,
+		Time:     now,
+		Rejected: stability.IsRejected(err),
+		Err:      err,
+	}
+
+	var retryErr *stability.RetryError
+	if errors.As(err, &retryErr) {
+		letter.Errors = letter.Errors[:0]
+		for _, attemptErr := range retryErr.Errors {
+			letter.Errors = append(letter.Errors, attemptErr.Error())
+		}
+		letter.Attempts = retryErr.Attempts()
+		letter.FirstAttempt = retryErr.First
+		letter.LastAttempt = retryErr.Last
+	}
+
+	return letter
+}
+
+// Sink receives the letters
+type Sink interface {
+	Send(letter Letter) error
+}
+
+// SinkFunc adapts a function to Sink
+type SinkFunc func(letter Letter) error
+
+func (f SinkFunc) Send(letter Letter) error {
+	return f(letter)
+}
+
+// ChanSink sends the letters to ch, it blocks while ch is full
+func ChanSink(ch chan<- Letter) Sink {
+	return SinkFunc(func(letter Letter) error {
+		ch <- letter
+		return nil
+	})
+}
+
+type Settings struct {
+	Name string
+	Sink Sink
+	// OnSendError if set receives the letters the Sink failed to take
+	OnSendError func(letter Letter, err error)
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+// Policy sends the input of every failed call to the Sink
+// and returns the error unchanged. Put it outside the other policies
+// to capture the inputs which exhausted them.
+type Policy struct {
+	name        string
+	sink        Sink
+	onSendError func(letter Letter, err error)
+	clock       stability.Clock
+}
+
+func NewPolicy(settings Settings) *Policy {
+	policy := new(Policy)
+
+	policy.name = settings.Name
+	policy.sink = settings.Sink
+
+	if policy.onSendError = settings.OnSendError; policy.onSendError == nil {
+		policy.onSendError = func(Letter, error) {}
+	}
+
+	if policy.clock = settings.Clock; policy.clock == nil {
+		policy.clock = stability.SystemClock
+	}
+
+	return policy
+}
+
+// Send sends the letter of the failed input to the Sink
+func (p *Policy) Send(inObj interface{}, err error) {
+	letter := New(p.name, inObj, err, p.clock.Now())
+	if sendErr := p.sink.Send(letter); sendErr != nil {
+		p.onSendError(letter, sendErr)
+	}
+}
+
+func (p *Policy) GetProcessorFn(processFn stability.ProcessFn) stability.ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		res, err := processFn(inObj)
+		if err != nil {
+			p.Send(inObj, err)
+		}
+		return res, err
+	}
+}
+
+// Replay feeds the inputs of the letters to processFn
+// and returns the letters of the inputs which failed again, dated on the policy Clock
+func (p *Policy) Replay(letters []Letter, processFn stability.ProcessFn) []Letter {
+	var failed []Letter
+	for _, letter := range letters {
+		if _, err := processFn(letter.Input); err != nil {
+			failed = append(failed, New(letter.Name, letter.Input, err, p.clock.Now()))
+		}
+	}
+	return failed
+}
@@ -0,0 +1,91 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileSink appends the letters to a JSON lines file, one letter per line.
+// The Input must be encodable with encoding/json.
+type FileSink struct {
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// NewFileSink opens the file for appending, creating it if needed
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Send writes the letter with a single write, so a crash can't interleave lines
+func (s *FileSink) Send(letter Letter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.file.Write(line)
+	return err
+}
+
+// Close syncs and closes the file
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.file.Sync(); err != nil {
+		_ = s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+// ReadFile reads the letters written by a FileSink.
+// decode builds the Input from its JSON, if not set
+// the Input is decoded into interface{} (maps, []interface{}, float64 etc.).
+func ReadFile(path string, decode func(input json.RawMessage) (interface{}, error)) ([]Letter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var letters []Letter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var letter Letter
+		var input json.RawMessage
+		letter.Input = &input
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return letters, err
+		}
+
+		if decode != nil {
+			letter.Input, err = decode(input)
+		} else {
+			letter.Input = nil
+			err = json.Unmarshal(input, &letter.Input)
+		}
+		if err != nil {
+			return letters, err
+		}
+
+		letters = append(letters, letter)
+	}
+
+	return letters, scanner.Err()
+}
@@ -0,0 +1,166 @@
+package stability
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened inside a policy
+type EventType int
+
+const (
+	// BreakerOpened is published when the breaker reaches its failure threshold
+	// or when a half-open trial call fails again
+	BreakerOpened EventType = iota + 1
+	// BreakerHalfOpened is published when the expiry passed and a trial call is let through
+	BreakerHalfOpened
+	// BreakerClosed is published when a call succeeds after the breaker has been open
+	BreakerClosed
+	// CallRejected is published when the breaker rejects a call with ErrOpenState
+	CallRejected
+	// RetryScheduled is published before Retry sleeps and calls the function again
+	RetryScheduled
+	// RetryExhausted is published when Retry gives up and returns the last error
+	RetryExhausted
+	// TokensExhausted is published when Throttle rejects a call because the bucket is empty
+	TokensExhausted
+	// PanicRecovered is published when Recover converts a panic into a *PanicError
+	PanicRecovered
+)
+
+var eventTypeNames = map[EventType]string{
+	BreakerOpened:     "BreakerOpened",
+	BreakerHalfOpened: "BreakerHalfOpened",
+	BreakerClosed:     "BreakerClosed",
+	CallRejected:      "CallRejected",
+	RetryScheduled:    "RetryScheduled",
+	RetryExhausted:    "RetryExhausted",
+	TokensExhausted:   "TokensExhausted",
+	PanicRecovered:    "PanicRecovered",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Event is published by a policy on its EventBus.
+// Attempt, Delay and Err are filled in only when they make sense
+// for the event type (e.g. Delay for RetryScheduled)
+type Event struct {
+	Type    EventType
+	Name    string
+	Time    time.Time
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+// EventFilter reports whether a subscriber is interested in the event
+type EventFilter func(Event) bool
+
+// ByName accepts events published by the policies with given names
+func ByName(names ...string) EventFilter {
+	return func(e Event) bool {
+		for _, name := range names {
+			if e.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ByType accepts events of given types
+func ByType(types ...EventType) EventFilter {
+	return func(e Event) bool {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+type subscriber struct {
+	fn      func(Event)
+	filters []EventFilter
+}
+
+func (s subscriber) accepts(e Event) bool {
+	for _, filter := range s.filters {
+		if !filter(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// EventBus delivers policy events to subscribers.
+// The same bus may be shared by any number of policies,
+// the events are told apart by the policy name.
+// A nil *EventBus is valid and drops everything published on it.
+type EventBus struct {
+	subscribers map[uint64]subscriber
+	nextID      uint64
+	mutex       sync.RWMutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[uint64]subscriber)}
+}
+
+// Subscribe registers a callback which is called synchronously
+// by the publishing policy for every event accepted by all the filters.
+// The callback must be fast and must not call the publishing policy.
+// The returned function removes the subscription.
+func (b *EventBus) Subscribe(fn func(Event), filters ...EventFilter) (unsubscribe func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = subscriber{fn: fn, filters: filters}
+
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// SubscribeChan is like Subscribe but sends events to the channel.
+// The send never blocks a policy: if the channel is full the event is dropped,
+// so give the channel a buffer big enough for the consumer.
+func (b *EventBus) SubscribeChan(ch chan<- Event, filters ...EventFilter) (unsubscribe func()) {
+	return b.Subscribe(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}, filters...)
+}
+
+// Publish delivers the event to the interested subscribers
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	// Collect the subscribers first, so a callback may (un)subscribe
+	b.mutex.RLock()
+	interested := make([]subscriber, 0, len(b.subscribers))
+	for _, s := range b.subscribers {
+		if s.accepts(e) {
+			interested = append(interested, s)
+		}
+	}
+	b.mutex.RUnlock()
+
+	for _, s := range interested {
+		s.fn(e)
+	}
+}
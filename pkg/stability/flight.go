@@ -0,0 +1,75 @@
+package stability
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errFlightPanicked is returned to the callers sharing a call which panicked,
+// the panic itself propagates in the caller which ran it
+var errFlightPanicked = errors.New("shared call panicked")
+
+// flightCall is a call in progress shared by the callers with the same key
+type flightCall struct {
+	done    chan struct{}
+	started time.Time
+	waiters int
+	res     interface{}
+	err     error
+}
+
+// flightGroup runs one call per key at a time, the callers
+// with the same key wait for it and get its result
+type flightGroup struct {
+	clock Clock
+	calls map[string]*flightCall
+	mutex sync.Mutex
+}
+
+// do runs fn or waits for the call in progress with the same key.
+// If maxAge > 0 a call running longer than it is not joined, a new one is started.
+// shared reports whether the result came from another caller's call.
+func (g *flightGroup) do(key string, maxAge time.Duration, fn func() (interface{}, error)) (res interface{}, err error, shared bool) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok && (maxAge <= 0 || g.clock.Since(c.started) < maxAge) {
+		c.waiters++
+		g.mutex.Unlock()
+		<-c.done
+		return c.res, c.err, true
+	}
+	c := &flightCall{done: make(chan struct{}), started: g.clock.Now()}
+	g.calls[key] = c
+	g.mutex.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			c.err = errFlightPanicked
+		}
+		g.mutex.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mutex.Unlock()
+		close(c.done)
+	}()
+
+	c.res, c.err = fn()
+	returned = true
+
+	return c.res, c.err, false
+}
+
+// waiting returns the number of callers waiting for the call of the key
+func (g *flightGroup) waiting(key string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+package httpx
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ByClientIP is the default RateLimiterSettings.KeyFn: the IP of the remote address.
+// Behind a proxy use ByHeader("X-Forwarded-For") or a custom function.
+func ByClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader keys the requests by a header value, e.g. an API key
+func ByHeader(name string) func(*http.Request) string {
+	return func(req *http.Request) string {
+		return req.Header.Get(name)
+	}
+}
+
+type RateLimiterSettings struct {
+	Name string
+	// KeyFn picks the client key, ByClientIP if not set
+	KeyFn func(*http.Request) string
+	// Throttle settings of every key's bucket
+	Throttle stability.ThrottleSettings
+	// Overrides replace the Throttle settings for some keys
+	Overrides map[string]stability.ThrottleSettings
+	// RejectStatus is the status of a rejected request,
+	// http.StatusTooManyRequests if not set (use http.StatusServiceUnavailable for load shedding)
+	RejectStatus int
+	// MaxKeys bounds the number of tracked keys, stability.DefaultMaxKeys if not set.
+	// While all of them are throttled the requests of new keys are rejected.
+	MaxKeys int
+	// IdleTTL evicts the buckets of the keys not seen for that long,
+	// once they have refilled if not set (see stability.KeyedThrottleSettings)
+	IdleTTL time.Duration
+	// Clock defaults to SystemClock
+	Clock stability.Clock
+}
+
+// RateLimiter is a http middleware keeping a Throttle per client key.
+// It sets the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// and rejects the requests over the limit with Retry-After.
+// With the LeakyBucket algorithm the queued requests wait for their turn,
+// a request which goes away meanwhile gives it back.
+type RateLimiter struct {
+	keyFn        func(*http.Request) string
+	throttle     *stability.KeyedThrottle
+	rejectStatus int
+}
+
+func NewRateLimiter(settings RateLimiterSettings) *RateLimiter {
+	limiter := new(RateLimiter)
+
+	if limiter.keyFn = settings.KeyFn; limiter.keyFn == nil {
+		limiter.keyFn = ByClientIP
+	}
+
+	if limiter.rejectStatus = settings.RejectStatus; limiter.rejectStatus == 0 {
+		limiter.rejectStatus = http.StatusTooManyRequests
+	}
+
+	limiter.throttle = stability.NewKeyedThrottle(stability.KeyedThrottleSettings{
+		Name:      settings.Name,
+		Throttle:  settings.Throttle,
+		Overrides: settings.Overrides,
+		MaxKeys:   settings.MaxKeys,
+		IdleTTL:   settings.IdleTTL,
+		Clock:     settings.Clock,
+	})
+
+	return limiter
+}
+
+// Evict drops the key's bucket, the key starts over with a full one
+func (l *RateLimiter) Evict(key string) {
+	l.throttle.Evict(key)
+}
+
+// Len returns the number of tracked keys
+func (l *RateLimiter) Len() int {
+	return l.throttle.Len()
+}
+
+// ceilSeconds rounds the duration up to whole seconds for the headers
+func ceilSeconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+// Middleware wraps the handler with the rate limiter
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status, err := l.throttle.Wait(l.keyFn(req), req)
+
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.FormatUint(uint64(status.Limit), 10))
+		header.Set("RateLimit-Remaining", strconv.FormatUint(uint64(status.Remaining), 10))
+		header.Set("RateLimit-Reset", ceilSeconds(status.Reset))
+
+		if !status.Allowed {
+			header.Set("Retry-After", ceilSeconds(status.Reset))
+			http.Error(w, http.StatusText(l.rejectStatus), l.rejectStatus)
+			return
+		}
+		if err != nil {
+			// The request gave up waiting for its turn
+			http.Error(w, http.StatusText(l.rejectStatus), l.rejectStatus)
+			return
+		}
+
+		next.ServeHTTP(w, req)
+	})
+}
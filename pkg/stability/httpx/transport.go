@@ -0,0 +1,300 @@
+// Package httpx applies the stability patterns to net/http
+package httpx
+
+import (
+	"bytes"
+	"cloud-design-patterns/pkg/stability"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultMaxRetryAfter = time.Duration(1) * time.Minute
+
+// StatusError is returned to the policies for a response classified as a failure,
+// so the breaker counts it and the retry retries it.
+// Transport.RoundTrip returns the response of the last attempt, not the error.
+type StatusError struct {
+	Response   *http.Response
+	retryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Response.Request.Method, e.Response.Request.URL, e.Response.Status)
+}
+
+// RetryAfter returns the delay requested by the Retry-After header (0 if there is none)
+func (e *StatusError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// ByHost is the default TransportSettings.KeyFn: one set of policies per host
+func ByHost(req *http.Request) string {
+	return req.URL.Host
+}
+
+// ByRoute keeps one set of policies per method, host and path
+func ByRoute(req *http.Request) string {
+	return req.Method + " " + req.URL.Host + req.URL.Path
+}
+
+// IsServerFailure is the default TransportSettings.IsFailure: 5xx and 429 responses
+func IsServerFailure(res *http.Response) bool {
+	return res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests
+}
+
+// IsIdempotent reports whether the request may be sent more than once:
+// the method is idempotent or the request has an Idempotency-Key header
+func IsIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+// ParseRetryAfter parses the Retry-After header value, seconds or an HTTP date
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type TransportSettings struct {
+	Name string
+	// Transport sends the requests, http.DefaultTransport if not set
+	Transport http.RoundTripper
+	// KeyFn picks the set of policies for the request, ByHost if not set
+	KeyFn func(*http.Request) string
+	// IsFailure classifies the responses, IsServerFailure if not set
+	IsFailure func(*http.Response) bool
+	// MaxRetryAfter caps the delay a server may ask for with Retry-After,
+	// DefaultMaxRetryAfter if not set
+	MaxRetryAfter time.Duration
+	// MaxKeys bounds the number of the keys with policies, stability.DefaultMaxKeys if not set.
+	// Over it the least recently used key with a closed (or no) breaker is dropped,
+	// the oldest one if all the breakers are open.
+	MaxKeys int
+	// Every key gets its own policies created from these settings,
+	// the key is appended to the policy name. A nil settings disables the policy.
+	// Only idempotent requests (see IsIdempotent) are retried.
+	// The Retry Clock, stability.SystemClock if not set, dates the Retry-After headers.
+	Retry    *stability.RetrySettings
+	Throttle *stability.ThrottleSettings
+	Breaker  *stability.BreakerSettings
+}
+
+// Transport is a http.RoundTripper which sends the requests through
+// Retry, Throttle and Breaker (in this order, retry is the outermost)
+type Transport struct {
+	name          string
+	transport     http.RoundTripper
+	keyFn         func(*http.Request) string
+	isFailure     func(*http.Response) bool
+	maxRetryAfter time.Duration
+	maxKeys       int
+	clock         stability.Clock
+	retry         *stability.RetrySettings
+	throttle      *stability.ThrottleSettings
+	breaker       *stability.BreakerSettings
+	lru           *list.List
+	keys          map[string]*list.Element
+	mutex         sync.Mutex
+}
+
+// keyPolicies are the policies of a key
+type keyPolicies struct {
+	key       string
+	processFn stability.ProcessFn
+	breaker   *stability.Breaker
+}
+
+func NewTransport(settings TransportSettings) *Transport {
+	transport := new(Transport)
+
+	transport.name = settings.Name
+
+	if transport.transport = settings.Transport; transport.transport == nil {
+		transport.transport = http.DefaultTransport
+	}
+
+	if transport.keyFn = settings.KeyFn; transport.keyFn == nil {
+		transport.keyFn = ByHost
+	}
+
+	if transport.isFailure = settings.IsFailure; transport.isFailure == nil {
+		transport.isFailure = IsServerFailure
+	}
+
+	if transport.maxRetryAfter = settings.MaxRetryAfter; transport.maxRetryAfter <= 0 {
+		transport.maxRetryAfter = DefaultMaxRetryAfter
+	}
+
+	if transport.maxKeys = settings.MaxKeys; transport.maxKeys <= 0 {
+		transport.maxKeys = stability.DefaultMaxKeys
+	}
+
+	transport.clock = stability.SystemClock
+	if settings.Retry != nil && settings.Retry.Clock != nil {
+		transport.clock = settings.Retry.Clock
+	}
+
+	transport.retry = settings.Retry
+	transport.throttle = settings.Throttle
+	transport.breaker = settings.Breaker
+	transport.lru = list.New()
+	transport.keys = make(map[string]*list.Element)
+
+	return transport
+}
+
+func (t *Transport) policyName(name, key string) string {
+	if name == "" {
+		name = t.name
+	}
+	return fmt.Sprintf("%s[%s]", name, key)
+}
+
+// getProcessorFn returns the policies of the key, creating them on the first use
+func (t *Transport) getProcessorFn(key string) stability.ProcessFn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e, ok := t.keys[key]; ok {
+		t.lru.MoveToFront(e)
+		return e.Value.(*keyPolicies).processFn
+	}
+
+	entry := &keyPolicies{key: key}
+	var policies []stability.Policy
+	if t.retry != nil {
+		settings := *t.retry
+		settings.Name = t.policyName(settings.Name, key)
+		policies = append(policies, stability.NewRetry(settings))
+	}
+	if t.throttle != nil {
+		settings := *t.throttle
+		settings.Name = t.policyName(settings.Name, key)
+		policies = append(policies, stability.NewThrottle(settings))
+	}
+	if t.breaker != nil {
+		settings := *t.breaker
+		settings.Name = t.policyName(settings.Name, key)
+		entry.breaker = stability.NewBreaker(settings)
+		policies = append(policies, entry.breaker)
+	}
+	entry.processFn = stability.Chain(t.send, policies...)
+
+	if t.lru.Len() >= t.maxKeys {
+		t.evict()
+	}
+	t.keys[key] = t.lru.PushFront(entry)
+	return entry.processFn
+}
+
+// evict drops the least recently used key, keeping the open breakers
+// if it can. It must be called under the mutex.
+func (t *Transport) evict() {
+	// The back of the list is the least recently used key
+	victim := t.lru.Back()
+	for e := victim; e != nil; e = e.Prev() {
+		if breaker := e.Value.(*keyPolicies).breaker; breaker == nil || breaker.State() == stability.StateClosed {
+			victim = e
+			break
+		}
+	}
+	t.lru.Remove(victim)
+	delete(t.keys, victim.Value.(*keyPolicies).key)
+}
+
+// Len returns the number of the keys with policies
+func (t *Transport) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.lru.Len()
+}
+
+// send makes one attempt. The request body is taken from GetBody,
+// so every attempt sends the whole body.
+func (t *Transport) send(inObj interface{}) (interface{}, error) {
+	req := inObj.(*http.Request)
+
+	attempt := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, stability.Permanent(err)
+		}
+		attempt.Body = body
+	}
+
+	res, err := t.transport.RoundTrip(attempt)
+	if err == nil && t.isFailure(res) {
+		// Keep the body of the failed response readable,
+		// it's returned to the caller if this is the last attempt
+		body, readErr := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		if readErr != nil {
+			err = readErr
+		} else {
+			retryAfter, _ := ParseRetryAfter(res.Header.Get("Retry-After"), t.clock.Now())
+			if retryAfter > t.maxRetryAfter {
+				retryAfter = t.maxRetryAfter
+			}
+			err = &StatusError{Response: res, retryAfter: retryAfter}
+		}
+	}
+
+	if err != nil && !IsIdempotent(req) {
+		err = stability.Permanent(err)
+	}
+	return res, err
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			// Buffer the body once, so the attempts can rewind it
+			body, err := io.ReadAll(req.Body)
+			_ = req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+		} else {
+			// The attempts send copies from GetBody
+			defer req.Body.Close()
+		}
+	}
+
+	res, err := t.getProcessorFn(t.keyFn(req))(req)
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			return statusErr.Response, nil
+		}
+		return nil, err
+	}
+
+	return res.(*http.Response), nil
+}
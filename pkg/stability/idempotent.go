@@ -0,0 +1,264 @@
+package stability
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Idempotent makes the calls with the same idempotency key run once:
+// the result of the first successful call is kept in the Store for the TTL
+// and returned to the duplicates. A failed call leaves nothing behind,
+// so it may be retried. While the first call runs the duplicates wait
+// for its result or get ErrInProgress.
+//
+// The call is marked as pending in the Store with an owner token for PendingTTL,
+// and the marker is extended every PendingTTL/3 while the call runs, so only
+// the marker of a crashed process expires. The owner replaces or frees the marker
+// with CompareAndSet on its token, it never overwrites the marker of another call.
+// A Store error fails the call: running it twice is what the policy prevents.
+
+const DefaultIdempotencyTTL = time.Duration(24) * time.Hour
+const DefaultPendingTTL = time.Duration(1) * time.Minute
+const DefaultIdempotencyPollInterval = time.Duration(100) * time.Millisecond
+
+var (
+	// ErrInProgress is returned to a duplicate while the first call is running
+	ErrInProgress = errors.New("call with the same idempotency key is in progress")
+)
+
+type DuplicateMode int
+
+const (
+	// DuplicateWait makes the duplicate wait for the result of the first call
+	DuplicateWait DuplicateMode = iota
+	// DuplicateReject returns ErrInProgress to the duplicate
+	DuplicateReject
+)
+
+const (
+	idempotentPending = 'p'
+	idempotentResult  = 'r'
+	// idempotentFree is left by a failed call, the next call takes over the key
+	idempotentFree = 'f'
+)
+
+// IdempotencyKeyer is implemented by the input objects which carry
+// their idempotency key, e.g. a message keeping its ID across the redeliveries
+type IdempotencyKeyer interface {
+	IdempotencyKey() string
+}
+
+// IdempotencyKey is the default IdempotentSettings.KeyFn: the key of an IdempotencyKeyer
+// or the string input itself, looking through a ContextObj. The other input objects
+// have no key, fmt.Sprint would print the state of a delivery (attempt, context etc.)
+// and the duplicates would get different keys.
+func IdempotencyKey(inObj interface{}) string {
+	if c, ok := inObj.(ContextObj); ok {
+		inObj = c.Obj
+	}
+	switch obj := inObj.(type) {
+	case IdempotencyKeyer:
+		return obj.IdempotencyKey()
+	case string:
+		return obj
+	}
+	return ""
+}
+
+type IdempotentSettings struct {
+	Name string
+	// KeyFn takes the idempotency key from the input object, IdempotencyKey if not set.
+	// The calls with an empty key aren't deduplicated.
+	KeyFn func(inObj interface{}) string
+	// Store defaults to a MemoryStore
+	Store StateStore
+	// TTL defaults to DefaultIdempotencyTTL
+	TTL time.Duration
+	// PendingTTL defaults to DefaultPendingTTL
+	PendingTTL time.Duration
+	// OnDuplicate defaults to DuplicateWait
+	OnDuplicate DuplicateMode
+	// PollInterval is how often a waiting duplicate checks the Store,
+	// DefaultIdempotencyPollInterval if not set
+	PollInterval time.Duration
+	// Encode and Decode convert the result for the Store,
+	// JSON if not set (so the duplicates get maps, float64 etc.)
+	Encode func(res interface{}) ([]byte, error)
+	Decode func(data []byte) (interface{}, error)
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type Idempotent struct {
+	name         string
+	keyFn        func(inObj interface{}) string
+	store        StateStore
+	ttl          time.Duration
+	pendingTTL   time.Duration
+	onDuplicate  DuplicateMode
+	pollInterval time.Duration
+	encode       func(res interface{}) ([]byte, error)
+	decode       func(data []byte) (interface{}, error)
+	clock        Clock
+}
+
+func defaultDecode(data []byte) (interface{}, error) {
+	var res interface{}
+	err := json.Unmarshal(data, &res)
+	return res, err
+}
+
+func NewIdempotent(settings IdempotentSettings) *Idempotent {
+	idempotent := new(Idempotent)
+
+	idempotent.name = settings.Name
+	idempotent.clock = clockOrDefault(settings.Clock)
+
+	if idempotent.keyFn = settings.KeyFn; idempotent.keyFn == nil {
+		idempotent.keyFn = IdempotencyKey
+	}
+
+	if idempotent.store = settings.Store; idempotent.store == nil {
+		idempotent.store = NewMemoryStore(idempotent.clock)
+	}
+
+	if idempotent.ttl = settings.TTL; idempotent.ttl <= 0 {
+		idempotent.ttl = DefaultIdempotencyTTL
+	}
+
+	if idempotent.pendingTTL = settings.PendingTTL; idempotent.pendingTTL <= 0 {
+		idempotent.pendingTTL = DefaultPendingTTL
+	}
+
+	idempotent.onDuplicate = settings.OnDuplicate
+
+	if idempotent.pollInterval = settings.PollInterval; idempotent.pollInterval <= 0 {
+		idempotent.pollInterval = DefaultIdempotencyPollInterval
+	}
+
+	if idempotent.encode = settings.Encode; idempotent.encode == nil {
+		idempotent.encode = json.Marshal
+	}
+
+	if idempotent.decode = settings.Decode; idempotent.decode == nil {
+		idempotent.decode = defaultDecode
+	}
+
+	return idempotent
+}
+
+// Forget removes the stored result of the key, the next call with it runs again
+func (i *Idempotent) Forget(key string) error {
+	return i.store.Delete(i.storeKey(key))
+}
+
+func (i *Idempotent) storeKey(key string) string {
+	return "idempotent:" + i.name + ":" + key
+}
+
+// pendingMarker returns a pending marker with a new owner token
+func pendingMarker() []byte {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		// Unique enough for a marker without the entropy
+		return []byte(string(idempotentPending) + time.Now().Format(time.RFC3339Nano))
+	}
+	return append([]byte{idempotentPending}, hex.EncodeToString(token)...)
+}
+
+// run makes the first call of the key, which is marked as pending by the marker
+func (i *Idempotent) run(storeKey string, marker []byte, inObj interface{}, processFn ProcessFn) (interface{}, error) {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go i.extend(storeKey, marker, stopCh, doneCh)
+	defer func() {
+		close(stopCh)
+		<-doneCh
+	}()
+
+	res, err := processFn(inObj)
+	if err != nil {
+		_, _ = i.store.CompareAndSet(storeKey, marker, []byte{idempotentFree}, i.pendingTTL)
+		return res, err
+	}
+
+	data, encodeErr := i.encode(res)
+	if encodeErr == nil {
+		// A lost marker means another call took over, its result stays
+		_, encodeErr = i.store.CompareAndSet(storeKey, marker, append([]byte{idempotentResult}, data...), i.ttl)
+	}
+	if encodeErr != nil {
+		// The call succeeded, only its duplicates will run again
+		_, _ = i.store.CompareAndSet(storeKey, marker, []byte{idempotentFree}, i.pendingTTL)
+	}
+
+	return res, nil
+}
+
+// extend keeps the marker alive until stopCh is closed or the marker is lost
+func (i *Idempotent) extend(storeKey string, marker []byte, stopCh, doneCh chan struct{}) {
+	defer close(doneCh)
+
+	ticker := i.clock.NewTicker(i.pendingTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C():
+			if stored, err := i.store.CompareAndSet(storeKey, marker, marker, i.pendingTTL); err == nil && !stored {
+				return
+			}
+		}
+	}
+}
+
+func (i *Idempotent) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		key := i.keyFn(inObj)
+		if key == "" {
+			return processFn(inObj)
+		}
+		storeKey := i.storeKey(key)
+
+		for {
+			value, ok, err := i.store.Get(storeKey)
+			if err != nil {
+				return nil, err
+			}
+
+			// old is nil for a missing key, the free value left by a failed call otherwise
+			var old []byte
+			if ok {
+				if len(value) > 0 && value[0] == idempotentResult {
+					return i.decode(value[1:])
+				}
+				if len(value) > 0 && value[0] == idempotentPending {
+					if i.onDuplicate == DuplicateReject {
+						return nil, ErrInProgress
+					}
+					select {
+					case <-i.clock.After(i.pollInterval):
+					case <-ContextOf(inObj).Done():
+						return nil, ContextOf(inObj).Err()
+					}
+					continue
+				}
+				old = value
+			}
+
+			marker := pendingMarker()
+			stored, err := i.store.CompareAndSet(storeKey, old, marker, i.pendingTTL)
+			if err != nil {
+				return nil, err
+			}
+			if stored {
+				return i.run(storeKey, marker, inObj, processFn)
+			}
+			// Another call took the key meanwhile, look again
+		}
+	}
+}
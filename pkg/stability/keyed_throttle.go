@@ -0,0 +1,271 @@
+package stability
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// KeyedThrottle keeps an independent Throttle per key taken from the input object,
+// e.g. "3 failed login attempts per account in 24 hours".
+// The memory is bounded: the least recently used refilled keys are evicted
+// over MaxKeys and the keys idle for IdleTTL are evicted too.
+// An evicted key starts over with a full bucket, so a key is evicted only
+// once its bucket would have refilled anyway. When MaxKeys are tracked
+// and none of them can be evicted yet, the calls of a new key are rejected.
+
+const DefaultMaxKeys = 10000
+
+type KeyedThrottleSettings struct {
+	Name string
+	// KeyFn takes the key from the input object, fmt.Sprint(inObj) if not set
+	KeyFn func(inObj interface{}) string
+	// Throttle settings shared by the keys.
+	// The per key throttle is named Name[key].
+	Throttle ThrottleSettings
+	// Overrides replace the shared settings for some keys
+	Overrides map[string]ThrottleSettings
+	// MaxKeys bounds the number of tracked keys, DefaultMaxKeys if not set
+	MaxKeys int
+	// IdleTTL evicts the keys not used for that long, but not before their bucket is full again.
+	// If not set a key is evicted as soon as its bucket has refilled.
+	IdleTTL time.Duration
+	// Clock defaults to SystemClock, it's passed to the per key throttles too
+	Clock Clock
+}
+
+type keyedBucket struct {
+	key      string
+	throttle *Throttle
+	lastSeen time.Time
+	// refill is the refill time of the bucket, the idle keys are swept after idleTTL,
+	// never if it's 0 (the state isn't kept in the bucket and IdleTTL isn't set)
+	refill  time.Duration
+	idleTTL time.Duration
+}
+
+// refilledAt returns when the unused bucket is full again and may be evicted over MaxKeys
+func (b *keyedBucket) refilledAt() time.Time {
+	return b.lastSeen.Add(b.refill)
+}
+
+// refillTime is how long an unused bucket takes to be full again
+func refillTime(settings ThrottleSettings) time.Duration {
+	// The state isn't kept in the bucket
+	if settings.Limiter != nil || settings.Store != nil {
+		return 0
+	}
+
+	maxTokens := settings.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
+	}
+	refillTokensCnt := settings.RefillTokensCnt
+	if refillTokensCnt <= 0 {
+		refillTokensCnt = DefaultRefillTokensCnt
+	}
+	refillInterval := settings.RefillInterval
+	if refillInterval <= 0 {
+		refillInterval = DefaultRefillInterval
+	}
+
+	switch settings.Algorithm {
+	case FixedWindow, SlidingWindowLog:
+		return refillInterval
+	case SlidingWindowCounter:
+		// The previous window still counts during the current one
+		return 2 * refillInterval
+	}
+	return time.Duration((maxTokens+refillTokensCnt-1)/refillTokensCnt) * refillInterval
+}
+
+type KeyedThrottle struct {
+	name      string
+	keyFn     func(inObj interface{}) string
+	throttle  ThrottleSettings
+	overrides map[string]ThrottleSettings
+	maxKeys   int
+	idleTTL   time.Duration
+	clock     Clock
+	lru       *list.List
+	buckets   map[string]*list.Element
+	mutex     sync.Mutex
+}
+
+func defaultKeyFn(inObj interface{}) string {
+	return fmt.Sprint(inObj)
+}
+
+func NewKeyedThrottle(settings KeyedThrottleSettings) *KeyedThrottle {
+	throttle := new(KeyedThrottle)
+
+	throttle.name = settings.Name
+
+	if throttle.keyFn = settings.KeyFn; throttle.keyFn == nil {
+		throttle.keyFn = defaultKeyFn
+	}
+
+	throttle.throttle = settings.Throttle
+	throttle.overrides = settings.Overrides
+
+	if throttle.maxKeys = settings.MaxKeys; throttle.maxKeys <= 0 {
+		throttle.maxKeys = DefaultMaxKeys
+	}
+
+	throttle.idleTTL = settings.IdleTTL
+	throttle.clock = clockOrDefault(settings.Clock)
+	throttle.lru = list.New()
+	throttle.buckets = make(map[string]*list.Element)
+
+	return throttle
+}
+
+// getThrottle returns the key's throttle, creating it on the first use.
+// It returns nil and the time until a key can be evicted if MaxKeys are tracked.
+func (k *KeyedThrottle) getThrottle(key string) (*Throttle, time.Duration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	now := k.clock.Now()
+
+	// The back of the list is the least recently used key
+	for e := k.lru.Back(); e != nil; e = k.lru.Back() {
+		if bucket := e.Value.(*keyedBucket); bucket.idleTTL <= 0 || now.Sub(bucket.lastSeen) < bucket.idleTTL {
+			break
+		}
+		k.removeElement(e)
+	}
+
+	if e, ok := k.buckets[key]; ok {
+		bucket := e.Value.(*keyedBucket)
+		bucket.lastSeen = now
+		k.lru.MoveToFront(e)
+		return bucket.throttle, 0
+	}
+
+	if k.lru.Len() >= k.maxKeys && !k.evictOne(now) {
+		return nil, k.nextEvictable().Sub(now)
+	}
+
+	settings := k.settings(key)
+	settings.Name = k.name + "[" + key + "]"
+	settings.Clock = k.clock
+
+	refill := refillTime(settings)
+	idleTTL := k.idleTTL
+	if idleTTL < refill {
+		idleTTL = refill
+	}
+
+	bucket := &keyedBucket{key: key, throttle: NewThrottle(settings), lastSeen: now, refill: refill, idleTTL: idleTTL}
+	k.buckets[key] = k.lru.PushFront(bucket)
+
+	return bucket.throttle, 0
+}
+
+// settings returns the throttle settings of the key
+func (k *KeyedThrottle) settings(key string) ThrottleSettings {
+	if settings, ok := k.overrides[key]; ok {
+		return settings
+	}
+	return k.throttle
+}
+
+// evictOne drops the least recently used bucket which can be evicted,
+// the keys with an override may keep their buckets longer than the older keys.
+// It must be called under the mutex.
+func (k *KeyedThrottle) evictOne(now time.Time) bool {
+	for e := k.lru.Back(); e != nil; e = e.Prev() {
+		if !now.Before(e.Value.(*keyedBucket).refilledAt()) {
+			k.removeElement(e)
+			return true
+		}
+	}
+	return false
+}
+
+// nextEvictable returns when the first bucket can be evicted, it must be called under the mutex
+func (k *KeyedThrottle) nextEvictable() time.Time {
+	var next time.Time
+	for e := k.lru.Back(); e != nil; e = e.Prev() {
+		if at := e.Value.(*keyedBucket).refilledAt(); next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+// removeElement must be called under the mutex
+func (k *KeyedThrottle) removeElement(e *list.Element) {
+	k.lru.Remove(e)
+	delete(k.buckets, e.Value.(*keyedBucket).key)
+}
+
+// Take takes a token from the key's bucket, see Throttle.Take
+func (k *KeyedThrottle) Take(key string) ThrottleStatus {
+	throttle, wait := k.getThrottle(key)
+	if throttle == nil {
+		return k.rejectNewKey(key, wait)
+	}
+	return throttle.Take()
+}
+
+// Wait takes a token from the key's bucket like Take and waits for the turn
+// of an allowed call (ThrottleStatus.Delay, LeakyBucket only) on the context of inObj.
+// The call which gives up on its budget or context returns the turn and the error.
+func (k *KeyedThrottle) Wait(key string, inObj interface{}) (ThrottleStatus, error) {
+	throttle, wait := k.getThrottle(key)
+	if throttle == nil {
+		return k.rejectNewKey(key, wait), nil
+	}
+
+	status := throttle.Take()
+	if status.Allowed && status.Delay > 0 {
+		if err := throttle.wait(inObj, status.Delay); err != nil {
+			return status, err
+		}
+	}
+	return status, nil
+}
+
+// rejectNewKey is the status of a new key while MaxKeys are tracked
+func (k *KeyedThrottle) rejectNewKey(key string, wait time.Duration) ThrottleStatus {
+	settings := k.settings(key)
+	k.throttle.EventBus.Publish(Event{Type: TokensExhausted, Name: k.name + "[" + key + "]", Time: k.clock.Now()})
+
+	limit := settings.MaxTokens
+	if limit <= 0 {
+		limit = DefaultMaxTokens
+	}
+	return ThrottleStatus{Limit: limit, Reset: wait}
+}
+
+// Evict drops the key's bucket, the key starts over with a full one
+func (k *KeyedThrottle) Evict(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if e, ok := k.buckets[key]; ok {
+		k.removeElement(e)
+	}
+}
+
+// Len returns the number of tracked keys
+func (k *KeyedThrottle) Len() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.lru.Len()
+}
+
+func (k *KeyedThrottle) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		key := k.keyFn(inObj)
+		throttle, wait := k.getThrottle(key)
+		if throttle == nil {
+			k.rejectNewKey(key, wait)
+			return "", ErrTooManyCalls
+		}
+		return throttle.GetProcessorFn(processFn)(inObj)
+	}
+}
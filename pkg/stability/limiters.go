@@ -0,0 +1,274 @@
+package stability
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is the algorithm behind a Throttle.
+// Take is called for every call with the current time,
+// the implementations must be safe for concurrent use.
+type Limiter interface {
+	Take(now time.Time) ThrottleStatus
+}
+
+// LimiterCanceler is implemented by the limiters which reserve a turn (LeakyBucket),
+// Cancel gives back the turn of an allowed call which gave up waiting for it
+type LimiterCanceler interface {
+	Cancel(now time.Time)
+}
+
+// NewLimiter builds the limiter of the algorithm.
+// See ThrottleAlgorithm for the meaning of the parameters.
+func NewLimiter(algorithm ThrottleAlgorithm, maxTokens, refillTokensCnt uint32, refillInterval time.Duration) Limiter {
+	switch algorithm {
+	case FixedWindow:
+		return &fixedWindow{limit: maxTokens, interval: refillInterval}
+	case SlidingWindowLog:
+		return &slidingWindowLog{limit: maxTokens, interval: refillInterval}
+	case SlidingWindowCounter:
+		return &slidingWindowCounter{limit: maxTokens, interval: refillInterval}
+	case GCRA:
+		return &gcra{burst: maxTokens, emission: emissionInterval(refillTokensCnt, refillInterval)}
+	case LeakyBucket:
+		return &leakyBucket{capacity: maxTokens, emission: emissionInterval(refillTokensCnt, refillInterval)}
+	}
+
+	return &tokenBucket{
+		maxTokens:       maxTokens,
+		tokensInBucket:  maxTokens,
+		refillTokensCnt: refillTokensCnt,
+		refillInterval:  refillInterval,
+	}
+}
+
+// emissionInterval is the time between two calls at the rate
+func emissionInterval(refillTokensCnt uint32, refillInterval time.Duration) time.Duration {
+	if emission := refillInterval / time.Duration(refillTokensCnt); emission > 0 {
+		return emission
+	}
+	return 1
+}
+
+func positive(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+type tokenBucket struct {
+	maxTokens       uint32
+	tokensInBucket  uint32
+	refillTokensCnt uint32
+	refillInterval  time.Duration
+	lastRefill      time.Time
+	mutex           sync.Mutex
+}
+
+// refill adds the tokens for every refill interval passed since the last refill.
+// The first call only starts the refill period.
+// Must be called under the mutex.
+func (b *tokenBucket) refill(now time.Time) {
+	if b.lastRefill.IsZero() {
+		b.lastRefill = now
+		return
+	}
+
+	intervals := now.Sub(b.lastRefill) / b.refillInterval
+	if intervals <= 0 {
+		return
+	}
+
+	b.lastRefill = b.lastRefill.Add(intervals * b.refillInterval)
+	if tokens := uint64(b.tokensInBucket) + uint64(intervals)*uint64(b.refillTokensCnt); tokens < uint64(b.maxTokens) {
+		b.tokensInBucket = uint32(tokens)
+	} else {
+		b.tokensInBucket = b.maxTokens
+	}
+}
+
+func (b *tokenBucket) Take(now time.Time) ThrottleStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+
+	status := ThrottleStatus{Limit: b.maxTokens, Reset: b.lastRefill.Add(b.refillInterval).Sub(now)}
+	if b.tokensInBucket > 0 {
+		b.tokensInBucket--
+		status.Allowed = true
+	}
+	status.Remaining = b.tokensInBucket
+
+	return status
+}
+
+type fixedWindow struct {
+	limit       uint32
+	interval    time.Duration
+	windowStart time.Time
+	count       uint32
+	mutex       sync.Mutex
+}
+
+func (w *fixedWindow) Take(now time.Time) ThrottleStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if windowStart := now.Truncate(w.interval); !windowStart.Equal(w.windowStart) {
+		w.windowStart = windowStart
+		w.count = 0
+	}
+
+	status := ThrottleStatus{Limit: w.limit, Reset: w.windowStart.Add(w.interval).Sub(now)}
+	if w.count < w.limit {
+		w.count++
+		status.Allowed = true
+	}
+	status.Remaining = w.limit - w.count
+
+	return status
+}
+
+type slidingWindowLog struct {
+	limit    uint32
+	interval time.Duration
+	log      []time.Time
+	mutex    sync.Mutex
+}
+
+func (w *slidingWindowLog) Take(now time.Time) ThrottleStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// Drop the calls which left the window
+	expired := 0
+	for expired < len(w.log) && !w.log[expired].Add(w.interval).After(now) {
+		expired++
+	}
+	w.log = w.log[expired:]
+
+	status := ThrottleStatus{Limit: w.limit}
+	if uint32(len(w.log)) < w.limit {
+		w.log = append(w.log, now)
+		status.Allowed = true
+	}
+	status.Remaining = w.limit - uint32(len(w.log))
+	if len(w.log) > 0 {
+		status.Reset = w.log[0].Add(w.interval).Sub(now)
+	}
+
+	return status
+}
+
+type slidingWindowCounter struct {
+	limit       uint32
+	interval    time.Duration
+	windowStart time.Time
+	count       uint32
+	prevCount   uint32
+	mutex       sync.Mutex
+}
+
+func (w *slidingWindowCounter) Take(now time.Time) ThrottleStatus {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if windowStart := now.Truncate(w.interval); !windowStart.Equal(w.windowStart) {
+		if windowStart.Equal(w.windowStart.Add(w.interval)) {
+			w.prevCount = w.count
+		} else {
+			w.prevCount = 0
+		}
+		w.windowStart = windowStart
+		w.count = 0
+	}
+
+	// The previous window is weighted by its part still inside the sliding window
+	prevWeight := 1 - float64(now.Sub(w.windowStart))/float64(w.interval)
+	estimate := float64(w.prevCount)*prevWeight + float64(w.count)
+
+	status := ThrottleStatus{Limit: w.limit, Reset: w.windowStart.Add(w.interval).Sub(now)}
+	if estimate+1 <= float64(w.limit) {
+		w.count++
+		estimate++
+		status.Allowed = true
+	}
+	if remaining := float64(w.limit) - estimate; remaining > 0 {
+		status.Remaining = uint32(remaining)
+	}
+
+	return status
+}
+
+// gcra keeps the theoretical arrival time of the next call
+type gcra struct {
+	burst    uint32
+	emission time.Duration
+	tat      time.Time
+	mutex    sync.Mutex
+}
+
+func (g *gcra) Take(now time.Time) ThrottleStatus {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	tolerance := g.emission * time.Duration(g.burst)
+
+	status := ThrottleStatus{Limit: g.burst}
+	if newTat := tat.Add(g.emission); newTat.Sub(now) <= tolerance {
+		g.tat = newTat
+		tat = newTat
+		status.Allowed = true
+	}
+	status.Remaining = uint32(positive(tolerance-tat.Sub(now)) / g.emission)
+	status.Reset = positive(tat.Add(g.emission).Sub(now) - tolerance)
+
+	return status
+}
+
+// leakyBucket keeps the time the next queued call may go
+type leakyBucket struct {
+	capacity uint32
+	emission time.Duration
+	next     time.Time
+	mutex    sync.Mutex
+}
+
+func (b *leakyBucket) Take(now time.Time) ThrottleStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.next.Before(now) {
+		b.next = now
+	}
+	delay := b.next.Sub(now)
+	queued := uint32(delay / b.emission)
+
+	status := ThrottleStatus{Limit: b.capacity}
+	if queued < b.capacity {
+		b.next = b.next.Add(b.emission)
+		queued++
+		status.Allowed = true
+		status.Delay = delay
+	}
+	status.Remaining = b.capacity - queued
+	status.Reset = positive(b.next.Sub(now) - b.emission*time.Duration(b.capacity-1))
+
+	return status
+}
+
+func (b *leakyBucket) Cancel(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// The calls queued after the cancelled one move up
+	if b.next = b.next.Add(-b.emission); b.next.Before(now) {
+		b.next = now
+	}
+}
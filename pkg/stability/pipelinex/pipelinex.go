@@ -0,0 +1,137 @@
+// Package pipelinex connects the stability policies with yapgo pipeline stages.
+// Stage turns a policy chain into a pipeline.StageFn which routes the
+// policy rejections (stability.IsRejected) and the business errors
+// to separate handlers, with a shared or per-worker policy chain.
+// The inputs of the failed calls may be kept in a dead-letter sink,
+// yapgo itself drops them.
+package pipelinex
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/deadletter"
+
+	"github.com/lissdx/yapgo/pkg/pipeline"
+)
+
+type StageSettings struct {
+	// Name is the name of the dead letters
+	Name string
+	// Policies wrap the ProcessFn, the first one is the outermost (see stability.Chain).
+	// They are shared by the workers of the stage.
+	Policies []stability.Policy
+	// NewPolicies if set builds the policies of every worker instead of Policies,
+	// it's called on each Run of the pipeline for worker = 0 .. FanSize-1
+	NewPolicies func(worker int) []stability.Policy
+	// FanSize is the number of workers, 1 if not set
+	FanSize uint64
+	// OnError receives the errors of the calls, they are dropped if not set
+	OnError pipeline.ErrorProcessFn
+	// OnRejected receives the rejections, OnError if not set
+	OnRejected pipeline.ErrorProcessFn
+	// IsRejected tells the rejections from the other errors, stability.IsRejected if not set
+	IsRejected func(err error) bool
+	// DeadLetter if set receives the inputs of the failed and rejected calls
+	DeadLetter deadletter.Sink
+	// Clock stamps the dead letters, stability.SystemClock if not set
+	Clock stability.Clock
+}
+
+// ProcessFn converts a stability.ProcessFn to a pipeline.ProcessFn
+func ProcessFn(processFn stability.ProcessFn) pipeline.ProcessFn {
+	return pipeline.ProcessFn(processFn)
+}
+
+// ToChan returns an error handler sending the errors to ch
+func ToChan(ch chan<- error) pipeline.ErrorProcessFn {
+	return func(err error) {
+		ch <- err
+	}
+}
+
+// Stage returns a pipeline stage running processFn wrapped with the policies
+func Stage(processFn stability.ProcessFn, settings StageSettings) pipeline.StageFn {
+	fanSize := settings.FanSize
+	if fanSize <= 0 {
+		fanSize = 1
+	}
+
+	isRejected := settings.IsRejected
+	if isRejected == nil {
+		isRejected = stability.IsRejected
+	}
+
+	onError := settings.OnError
+	if onError == nil {
+		onError = func(error) {}
+	}
+
+	onRejected := settings.OnRejected
+	if onRejected == nil {
+		onRejected = onError
+	}
+
+	var deadLetter *deadletter.Policy
+	if settings.DeadLetter != nil {
+		deadLetter = deadletter.NewPolicy(deadletter.Settings{
+			Name: settings.Name, Sink: settings.DeadLetter, OnSendError: func(letter deadletter.Letter, err error) {
+				onError(err)
+			},
+			Clock: settings.Clock,
+		})
+	}
+
+	errorFn := func(inObj interface{}, err error) {
+		if deadLetter != nil {
+			deadLetter.Send(inObj, err)
+		}
+		if isRejected(err) {
+			onRejected(err)
+			return
+		}
+		onError(err)
+	}
+
+	shared := stability.Chain(processFn, settings.Policies...)
+
+	return func(doneCh, inStream pipeline.ReadOnlyStream) pipeline.ReadOnlyStream {
+		var outStreams []pipeline.ReadOnlyStream
+		for i := uint64(0); i < fanSize; i++ {
+			workerFn := shared
+			if settings.NewPolicies != nil {
+				workerFn = stability.Chain(processFn, settings.NewPolicies(int(i))...)
+			}
+			outStreams = append(outStreams, worker(doneCh, inStream, workerFn, errorFn))
+		}
+
+		if len(outStreams) == 1 {
+			return outStreams[0]
+		}
+		return pipeline.MergeChannels(doneCh, outStreams)
+	}
+}
+
+// AddStage appends the Stage to the pipeline
+func AddStage(p *pipeline.Pipeline, processFn stability.ProcessFn, settings StageSettings) {
+	*p = append(*p, Stage(processFn, settings))
+}
+
+// worker processes the inStream like a yapgo stage
+func worker(doneCh, inStream pipeline.ReadOnlyStream, processFn stability.ProcessFn, errorFn func(inObj interface{}, err error)) pipeline.ReadOnlyStream {
+	outStream := make(chan interface{})
+	go func() {
+		defer close(outStream)
+		for inObj := range pipeline.OrDone(doneCh, inStream) {
+			outObj, err := processFn(inObj)
+			if err != nil {
+				errorFn(inObj, err)
+				continue
+			}
+			select {
+			case <-doneCh:
+				return
+			case outStream <- outObj:
+			}
+		}
+	}()
+	return outStream
+}
@@ -0,0 +1,77 @@
+package stability
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// The Recover policy converts a panic of the wrapped ProcessFn into a *PanicError,
+// so one bad message can't crash a pipeline stage and the whole process.
+// Put it inside a Breaker to count the panics as breaker failures:
+//	Chain(processFn, breaker, recover)
+
+// PanicError is returned by Recover when the wrapped function panics
+type PanicError struct {
+	Name  string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: recovered panic: %v", e.Name, e.Value)
+}
+
+// Unwrap returns the panic value if it's an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+type RecoverSettings struct {
+	Name string
+	// OnPanic if set is called with every recovered panic,
+	// e.g. to log the stack trace
+	OnPanic func(inObj interface{}, panicErr *PanicError)
+	// EventBus if set receives PanicRecovered events
+	EventBus *EventBus
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type Recover struct {
+	name     string
+	onPanic  func(inObj interface{}, panicErr *PanicError)
+	eventBus *EventBus
+	clock    Clock
+}
+
+func NewRecover(settings RecoverSettings) *Recover {
+	recoverer := new(Recover)
+
+	recoverer.name = settings.Name
+	recoverer.onPanic = settings.OnPanic
+	recoverer.eventBus = settings.EventBus
+	recoverer.clock = clockOrDefault(settings.Clock)
+
+	return recoverer
+}
+
+func (r *Recover) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (res interface{}, err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				panicErr := &PanicError{Name: r.name, Value: v, Stack: debug.Stack()}
+				res, err = nil, panicErr
+
+				r.eventBus.Publish(Event{Type: PanicRecovered, Name: r.name, Time: r.clock.Now(), Err: panicErr})
+				if r.onPanic != nil {
+					r.onPanic(inObj, panicErr)
+				}
+			}
+		}()
+
+		return processFn(inObj)
+	}
+}
@@ -0,0 +1,388 @@
+// Package redisstore implements stability.StateStore on top of Redis.
+// It speaks the RESP protocol directly over net.Conn and uses only
+// GET, SET, INCRBY, DEL, WATCH, MULTI and EXEC, so any server
+// compatible with them (e.g. stabilitytest.RedisServer) works.
+package redisstore
+
+import (
+	"bufio"
+	"bytes"
+	"cloud-design-patterns/pkg/stability"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultDialTimeout = time.Duration(5) * time.Second
+const DefaultCommandTimeout = time.Duration(1) * time.Second
+const DefaultMaxIdleConns = 4
+
+var (
+	// ErrClosed is returned when the store is used after Close
+	ErrClosed = errors.New("redisstore: store is closed")
+)
+
+// Error is an error reply of the server
+type Error struct {
+	Message string
+}
+
+func (e *Error) Error() string {
+	return "redisstore: " + e.Message
+}
+
+type Settings struct {
+	// Addr is host:port of the server
+	Addr     string
+	Password string
+	DB       int
+	// Prefix is prepended to every key
+	Prefix string
+	// DialTimeout defaults to DefaultDialTimeout
+	DialTimeout time.Duration
+	// CommandTimeout is the read/write deadline of a command, DefaultCommandTimeout if not set.
+	// It keeps a hung server from blocking the calls of the shared policies.
+	CommandTimeout time.Duration
+	// MaxIdleConns defaults to DefaultMaxIdleConns
+	MaxIdleConns int
+}
+
+// Store is a stability.StateStore keeping the state in Redis
+type Store struct {
+	addr        string
+	password    string
+	db          int
+	prefix      string
+	dialTimeout time.Duration
+	cmdTimeout  time.Duration
+	idle        []*conn
+	maxIdle     int
+	closed      bool
+	mutex       sync.Mutex
+}
+
+var _ stability.StateStore = (*Store)(nil)
+
+func New(settings Settings) *Store {
+	store := new(Store)
+
+	store.addr = settings.Addr
+	store.password = settings.Password
+	store.db = settings.DB
+	store.prefix = settings.Prefix
+
+	if store.dialTimeout = settings.DialTimeout; store.dialTimeout <= 0 {
+		store.dialTimeout = DefaultDialTimeout
+	}
+
+	if store.cmdTimeout = settings.CommandTimeout; store.cmdTimeout <= 0 {
+		store.cmdTimeout = DefaultCommandTimeout
+	}
+
+	if store.maxIdle = settings.MaxIdleConns; store.maxIdle <= 0 {
+		store.maxIdle = DefaultMaxIdleConns
+	}
+
+	return store
+}
+
+// Close closes the idle connections, the store must not be used after it
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	for _, c := range s.idle {
+		_ = c.netConn.Close()
+	}
+	s.idle = nil
+	return nil
+}
+
+// getConn returns an idle connection or dials a new one
+func (s *Store) getConn() (*conn, error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mutex.Unlock()
+		return c, nil
+	}
+	s.mutex.Unlock()
+
+	netConn, err := net.DialTimeout("tcp", s.addr, s.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{netConn: netConn, r: bufio.NewReader(netConn), w: bufio.NewWriter(netConn), timeout: s.cmdTimeout}
+
+	if s.password != "" {
+		if _, err := c.do("AUTH", s.password); err != nil {
+			_ = netConn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			_ = netConn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// putConn returns the connection to the pool.
+// A broken connection is closed: its protocol state is unknown.
+func (s *Store) putConn(c *conn) {
+	if c.broken {
+		_ = c.netConn.Close()
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || len(s.idle) >= s.maxIdle {
+		_ = c.netConn.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+// withConn runs fn on a pooled connection
+func (s *Store) withConn(fn func(c *conn) error) error {
+	c, err := s.getConn()
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	s.putConn(c)
+	return err
+}
+
+func (s *Store) do(args ...string) (reply interface{}, err error) {
+	err = s.withConn(func(c *conn) error {
+		reply, err = c.do(args...)
+		return err
+	})
+	return
+}
+
+// setArgs builds the SET command, ttl > 0 adds PX
+func (s *Store) setArgs(key string, value []byte, ttl time.Duration, flags ...string) []string {
+	args := []string{"SET", s.prefix + key, string(value)}
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms <= 0 {
+			ms = 1
+		}
+		args = append(args, "PX", strconv.FormatInt(ms, 10))
+	}
+	return append(args, flags...)
+}
+
+func (s *Store) Get(key string) ([]byte, bool, error) {
+	reply, err := s.do("GET", s.prefix+key)
+	if err != nil {
+		return nil, false, err
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redisstore: unexpected GET reply %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *Store) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(s.setArgs(key, value, ttl)...)
+	return err
+}
+
+func (s *Store) Incr(key string, delta int64, ttl time.Duration) (n int64, err error) {
+	err = s.withConn(func(c *conn) error {
+		if ttl > 0 {
+			// Create the key with the expiry, INCRBY keeps it
+			if _, err := c.do(s.setArgs(key, []byte("0"), ttl, "NX")...); err != nil {
+				return err
+			}
+		}
+
+		reply, err := c.do("INCRBY", s.prefix+key, strconv.FormatInt(delta, 10))
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if n, ok = reply.(int64); !ok {
+			return fmt.Errorf("redisstore: unexpected INCRBY reply %v", reply)
+		}
+		return nil
+	})
+	return
+}
+
+func (s *Store) CompareAndSet(key string, old, value []byte, ttl time.Duration) (stored bool, err error) {
+	if old == nil {
+		reply, err := s.do(s.setArgs(key, value, ttl, "NX")...)
+		return reply != nil, err
+	}
+
+	err = s.withConn(func(c *conn) (err error) {
+		// A failed transaction may leave the WATCH or the MULTI active,
+		// the connection isn't reused by the next caller
+		defer func() {
+			if err != nil {
+				c.broken = true
+			}
+		}()
+
+		if _, err := c.do("WATCH", s.prefix+key); err != nil {
+			return err
+		}
+
+		current, err := c.do("GET", s.prefix+key)
+		if err != nil {
+			return err
+		}
+		if currentValue, ok := current.([]byte); !ok || !bytes.Equal(currentValue, old) {
+			_, err := c.do("UNWATCH")
+			return err
+		}
+
+		if _, err := c.do("MULTI"); err != nil {
+			return err
+		}
+		if _, err := c.do(s.setArgs(key, value, ttl)...); err != nil {
+			_, _ = c.do("DISCARD")
+			return err
+		}
+
+		// EXEC replies with a nil array if the watched key was changed
+		reply, err := c.do("EXEC")
+		stored = err == nil && reply != nil
+		return err
+	})
+	return
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+type conn struct {
+	netConn net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+	// broken is set by a network error or a failed transaction, the connection must be closed
+	broken bool
+}
+
+// do sends the command and reads the reply within the timeout.
+// The reply is a string (simple string), int64, []byte (bulk string),
+// []interface{} (array) or nil. An error reply is returned as *Error.
+func (c *conn) do(args ...string) (interface{}, error) {
+	reply, err := c.roundTrip(args...)
+	var replyErr *Error
+	if err != nil && !errors.As(err, &replyErr) {
+		c.broken = true
+	}
+	return reply, err
+}
+
+func (c *conn) roundTrip(args ...string) (interface{}, error) {
+	if c.timeout > 0 {
+		if err := c.netConn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	if err := WriteCommand(c.w, args...); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.r)
+}
+
+// WriteCommand writes the command as a RESP array of bulk strings
+func WriteCommand(w io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redisstore: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// ReadReply reads a RESP reply, see conn.do for the types
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redisstore: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &Error{Message: line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = ReadReply(r); err != nil {
+				var replyErr *Error
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = replyErr
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redisstore: unknown reply type %q", line)
+}
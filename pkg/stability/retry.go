@@ -2,6 +2,7 @@ package stability
 
 import (
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -12,6 +13,63 @@ var (
 	ErrRetry = errors.New("circuit breaker is open")
 )
 
+// PermanentError marks an error which Retry must not retry,
+// e.g. a failed non-idempotent call
+type PermanentError struct {
+	Err error
+}
+
+// Permanent wraps err so Retry returns it at once
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// RetryError is returned when all the attempts failed if RetrySettings.ReturnRetryError is set,
+// it unwraps to the error of the last attempt
+type RetryError struct {
+	Name string
+	// Errors has the error of every attempt
+	Errors []error
+	// First and Last are the start times of the first and the last attempt
+	First time.Time
+	Last  time.Time
+}
+
+// Attempts returns the number of the attempts made
+func (e *RetryError) Attempts() int {
+	return len(e.Errors)
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s: %d attempts failed: %v", e.Name, len(e.Errors), e.Unwrap())
+}
+
+func (e *RetryError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1]
+}
+
+// RetryAfterError is implemented by errors which know how long
+// to wait before the next attempt, e.g. a response with the Retry-After header.
+// Retry waits for the longer of RetryAfter() and its own backoff.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
 func defaultRetryExpiryFn(tryCnt int) time.Duration {
 	return time.Millisecond * time.Duration((2<<tryCnt)*10)
 }
@@ -20,6 +78,17 @@ type RetrySettings struct {
 	Name           string
 	RetryThreshold uint32
 	ExpiryFn       func(tryCnt int) time.Duration
+	// EventBus if set receives RetryScheduled and RetryExhausted events
+	EventBus *EventBus
+	// Tracer if set records attempts and backoff delays on the span
+	// carried by the input object's context
+	Tracer Tracer
+	// ReturnRetryError if set makes the exhausted retry return a *RetryError
+	// with the error of every attempt (see deadletter.New) instead of the error
+	// of the last attempt, so compare the errors with errors.Is then
+	ReturnRetryError bool
+	// Clock defaults to SystemClock
+	Clock Clock
 }
 
 type Retry struct {
@@ -27,6 +96,10 @@ type Retry struct {
 	retryThreshold uint32
 	expiryFn       func(tryCnt int) time.Duration
 	lastAttempt    time.Time
+	eventBus       *EventBus
+	tracer         Tracer
+	retryError     bool
+	clock          Clock
 	mutex          sync.Mutex
 }
 
@@ -44,23 +117,71 @@ func NewRetry(settings RetrySettings) *Retry {
 		retry.expiryFn = defaultRetryExpiryFn
 	}
 
+	retry.eventBus = settings.EventBus
+	retry.tracer = settings.Tracer
+	retry.retryError = settings.ReturnRetryError
+	retry.clock = clockOrDefault(settings.Clock)
+
 	return retry
 }
 
+// Backoff returns the delay after the failed attempt tryCnt (0 after the first one)
+func (r *Retry) Backoff(tryCnt int) time.Duration {
+	return r.expiryFn(tryCnt)
+}
+
 func (r *Retry) GetProcessorFn(processFn ProcessFn) ProcessFn {
 	return func(inObj interface{}) (interface{}, error) {
+		if remaining, ok := RemainingBudget(inObj, r.clock); ok && remaining <= 0 {
+			return nil, &BudgetExceededError{Name: r.name, Remaining: remaining}
+		}
 
+		retryErr := &RetryError{Name: r.name}
 		for retCnt := 0;; retCnt++ {
+			addSpanEvent(r.tracer, inObj, SpanEventRetryAttempt, Attr{Key: "policy", Value: r.name}, Attr{Key: "attempt", Value: retCnt + 1})
+			start := r.clock.Now()
 			res, err := processFn(inObj)
-			if err == nil || uint32(retCnt) >= r.retryThreshold{
+			if err == nil {
 				return res, err
 			}
+			var permanentErr *PermanentError
+			if errors.As(err, &permanentErr) {
+				return res, permanentErr.Err
+			}
+			if retCnt == 0 {
+				retryErr.First = start
+			}
+			retryErr.Last = start
+			retryErr.Errors = append(retryErr.Errors, err)
+			if uint32(retCnt) >= r.retryThreshold{
+				r.eventBus.Publish(Event{Type: RetryExhausted, Name: r.name, Time: r.clock.Now(), Attempt: retCnt + 1, Err: err})
+				if !r.retryError {
+					return res, err
+				}
+				return res, retryErr
+			}
+
+			delay := r.expiryFn(retCnt)
+			var retryAfterErr RetryAfterError
+			if errors.As(err, &retryAfterErr) && retryAfterErr.RetryAfter() > delay {
+				delay = retryAfterErr.RetryAfter()
+			}
 
-			time.Sleep(r.expiryFn(retCnt))
-			//select {
-			//case <- time.After(r.expiryFn(retCnt)):
-			//
-			//}
+			// Skip the attempt if it can't finish in the budget,
+			// assuming it takes as long as the last one
+			if remaining, ok := RemainingBudget(inObj, r.clock); ok && remaining < delay+r.clock.Since(start) {
+				budgetErr := &BudgetExceededError{Name: r.name, Remaining: remaining, Err: err}
+				r.eventBus.Publish(Event{Type: RetryExhausted, Name: r.name, Time: r.clock.Now(), Attempt: retCnt + 1, Err: budgetErr})
+				return res, budgetErr
+			}
+
+			r.eventBus.Publish(Event{Type: RetryScheduled, Name: r.name, Time: r.clock.Now(), Attempt: retCnt + 1, Delay: delay, Err: err})
+			addSpanEvent(r.tracer, inObj, SpanEventRetryBackoff, Attr{Key: "policy", Value: r.name}, Attr{Key: "delay", Value: delay})
+			select {
+			case <-r.clock.After(delay):
+			case <-ContextOf(inObj).Done():
+				return res, ContextOf(inObj).Err()
+			}
 		}
 	}
-}
\ No newline at end of file
+}
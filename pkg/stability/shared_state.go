@@ -0,0 +1,259 @@
+package stability
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The policies keep their state in a StateStore when one is set in the settings.
+// A store error never blocks the calls: the breaker lets the call through
+// and the throttle allows it, so a store outage degrades to no protection
+// instead of a full outage.
+
+// maxCASAttempts bounds the compare-and-set loop of a contended key,
+// the call is rejected when it's exceeded
+const maxCASAttempts = 16
+
+// NewStoreLimiter builds a limiter which keeps its state under the key of the store.
+// TokenBucket, FixedWindow and GCRA are supported,
+// the other algorithms fall back to a local NewLimiter.
+func NewStoreLimiter(store StateStore, key string, algorithm ThrottleAlgorithm, maxTokens, refillTokensCnt uint32, refillInterval time.Duration) Limiter {
+	switch algorithm {
+	case TokenBucket:
+		return &storeTokenBucket{store: store, key: key, maxTokens: maxTokens, refillTokensCnt: refillTokensCnt, refillInterval: refillInterval}
+	case FixedWindow:
+		return &storeFixedWindow{store: store, key: key, limit: maxTokens, interval: refillInterval}
+	case GCRA:
+		return &storeGCRA{store: store, key: key, burst: maxTokens, emission: emissionInterval(refillTokensCnt, refillInterval)}
+	}
+	return NewLimiter(algorithm, maxTokens, refillTokensCnt, refillInterval)
+}
+
+// failOpen is the status returned on a store error
+func failOpen(limit uint32) ThrottleStatus {
+	return ThrottleStatus{Allowed: true, Limit: limit}
+}
+
+type storeTokenBucket struct {
+	store           StateStore
+	key             string
+	maxTokens       uint32
+	refillTokensCnt uint32
+	refillInterval  time.Duration
+}
+
+func (b *storeTokenBucket) Take(now time.Time) ThrottleStatus {
+	// The state expires once the bucket would be full again anyway
+	ttl := time.Duration(b.maxTokens/b.refillTokensCnt+2) * b.refillInterval
+
+	for i := 0; i < maxCASAttempts; i++ {
+		old, ok, err := b.store.Get(b.key)
+		if err != nil {
+			return failOpen(b.maxTokens)
+		}
+
+		tokens, lastRefill := b.maxTokens, now
+		if ok {
+			var tokensInBucket uint32
+			var lastRefillNanos int64
+			if _, err := fmt.Sscanf(string(old), "%d:%d", &tokensInBucket, &lastRefillNanos); err == nil {
+				tokens, lastRefill = tokensInBucket, time.Unix(0, lastRefillNanos)
+			}
+		} else {
+			old = nil
+		}
+
+		if intervals := now.Sub(lastRefill) / b.refillInterval; intervals > 0 {
+			lastRefill = lastRefill.Add(intervals * b.refillInterval)
+			if refilled := uint64(tokens) + uint64(intervals)*uint64(b.refillTokensCnt); refilled < uint64(b.maxTokens) {
+				tokens = uint32(refilled)
+			} else {
+				tokens = b.maxTokens
+			}
+		}
+
+		status := ThrottleStatus{Limit: b.maxTokens, Reset: lastRefill.Add(b.refillInterval).Sub(now)}
+		if tokens > 0 {
+			tokens--
+			status.Allowed = true
+		}
+		status.Remaining = tokens
+
+		value := []byte(fmt.Sprintf("%d:%d", tokens, lastRefill.UnixNano()))
+		stored, err := b.store.CompareAndSet(b.key, old, value, ttl)
+		if err != nil {
+			return failOpen(b.maxTokens)
+		}
+		if stored {
+			return status
+		}
+	}
+
+	return ThrottleStatus{Limit: b.maxTokens}
+}
+
+type storeFixedWindow struct {
+	store    StateStore
+	key      string
+	limit    uint32
+	interval time.Duration
+}
+
+func (w *storeFixedWindow) Take(now time.Time) ThrottleStatus {
+	windowStart := now.Truncate(w.interval)
+	key := w.key + ":" + strconv.FormatInt(windowStart.UnixNano(), 10)
+
+	count, err := w.store.Incr(key, 1, 2*w.interval)
+	if err != nil {
+		return failOpen(w.limit)
+	}
+
+	status := ThrottleStatus{Limit: w.limit, Reset: windowStart.Add(w.interval).Sub(now)}
+	if count <= int64(w.limit) {
+		status.Allowed = true
+		status.Remaining = w.limit - uint32(count)
+	}
+
+	return status
+}
+
+type storeGCRA struct {
+	store    StateStore
+	key      string
+	burst    uint32
+	emission time.Duration
+}
+
+func (g *storeGCRA) Take(now time.Time) ThrottleStatus {
+	tolerance := g.emission * time.Duration(g.burst)
+
+	for i := 0; i < maxCASAttempts; i++ {
+		old, ok, err := g.store.Get(g.key)
+		if err != nil {
+			return failOpen(g.burst)
+		}
+
+		tat := now
+		if ok {
+			if tatNanos, err := strconv.ParseInt(string(old), 10, 64); err == nil && time.Unix(0, tatNanos).After(now) {
+				tat = time.Unix(0, tatNanos)
+			}
+		} else {
+			old = nil
+		}
+
+		status := ThrottleStatus{Limit: g.burst}
+		newTat := tat.Add(g.emission)
+		if newTat.Sub(now) > tolerance {
+			status.Remaining = uint32(positive(tolerance-tat.Sub(now)) / g.emission)
+			status.Reset = positive(newTat.Sub(now) - tolerance)
+			return status
+		}
+		status.Allowed = true
+		status.Remaining = uint32(positive(tolerance-newTat.Sub(now)) / g.emission)
+		status.Reset = positive(newTat.Add(g.emission).Sub(now) - tolerance)
+
+		stored, err := g.store.CompareAndSet(g.key, old, []byte(strconv.FormatInt(newTat.UnixNano(), 10)), newTat.Sub(now))
+		if err != nil {
+			return failOpen(g.burst)
+		}
+		if stored {
+			return status
+		}
+	}
+
+	return ThrottleStatus{Limit: g.burst}
+}
+
+// Breaker state in the store: the consecutive failures counter
+// and the time of the last attempt (unix nanoseconds).
+// After a failure the keys expire StateTTL (or twice the current open period if it's longer)
+// after the last attempt, once the breaker is closed twice the first open period,
+// so the state of a breaker which is no longer used doesn't stay in the store.
+
+func (b *Breaker) failuresKey() string {
+	return "breaker:" + b.name + ":failures"
+}
+
+func (b *Breaker) lastAttemptKey() string {
+	return "breaker:" + b.name + ":last"
+}
+
+// loadSharedState returns zero values if the store fails
+func (b *Breaker) loadSharedState() (uint32, time.Time) {
+	var failures uint32
+	var lastAttempt time.Time
+
+	if value, ok, err := b.store.Get(b.failuresKey()); err == nil && ok {
+		if n, err := strconv.ParseUint(string(value), 10, 32); err == nil {
+			failures = uint32(n)
+		}
+	}
+	if value, ok, err := b.store.Get(b.lastAttemptKey()); err == nil && ok {
+		if nanos, err := strconv.ParseInt(string(value), 10, 64); err == nil {
+			lastAttempt = time.Unix(0, nanos)
+		}
+	}
+
+	return failures, lastAttempt
+}
+
+func (b *Breaker) checkSharedState() (EventType, uint32, error) {
+	failures, lastAttempt := b.loadSharedState()
+
+	if d := int(failures) - int(b.failureThreshold); d >= 0 {
+		if b.clock.Now().Before(lastAttempt.Add(b.expiryFn(d))) {
+			return CallRejected, failures, ErrOpenState
+		}
+		return BreakerHalfOpened, failures, nil
+	}
+
+	return 0, failures, nil
+}
+
+// sharedTTL is the expiry of the breaker keys after the given failures
+func (b *Breaker) sharedTTL(failures int64) time.Duration {
+	if failures <= 0 {
+		return 2 * b.expiryFn(0)
+	}
+	d := int(failures) - int(b.failureThreshold)
+	if d < 0 {
+		d = 0
+	}
+	if ttl := 2 * b.expiryFn(d); ttl > b.stateTTL {
+		return ttl
+	}
+	return b.stateTTL
+}
+
+func (b *Breaker) registerSharedResult(err error) (EventType, uint32) {
+	now := []byte(strconv.FormatInt(b.clock.Now().UnixNano(), 10))
+	_ = b.store.Set(b.lastAttemptKey(), now, b.sharedTTL(0))
+
+	if err != nil {
+		failures, storeErr := b.store.Incr(b.failuresKey(), 1, b.sharedTTL(1))
+		if storeErr != nil {
+			return 0, 0
+		}
+
+		// Incr keeps the expiry of the creation, extend both keys to the open period
+		ttl := b.sharedTTL(failures)
+		value := []byte(strconv.FormatInt(failures, 10))
+		_, _ = b.store.CompareAndSet(b.failuresKey(), value, value, ttl)
+		_, _ = b.store.CompareAndSet(b.lastAttemptKey(), now, now, ttl)
+
+		if failures >= int64(b.failureThreshold) {
+			return BreakerOpened, uint32(failures)
+		}
+		return 0, uint32(failures)
+	}
+
+	failures, _ := b.loadSharedState()
+	_ = b.store.Set(b.failuresKey(), []byte("0"), b.sharedTTL(0))
+	if failures >= b.failureThreshold {
+		return BreakerClosed, 0
+	}
+
+	return 0, 0
+}
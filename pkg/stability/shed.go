@@ -0,0 +1,239 @@
+package stability
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LoadShedder drops low priority calls first when the process is overloaded.
+// The load is the highest of the configured signals, each scaled so 1 means
+// the limit is reached: calls in flight / MaxInFlight, queue wait / MaxQueueWait
+// and CPU usage / MaxCPU. A call is shed when the load reaches the threshold
+// of its priority (the threshold of the lowest known priority for an unknown one),
+// PriorityCritical calls are never shed.
+
+const DefaultCPUSampleInterval = time.Duration(1) * time.Second
+
+// Priority of a call, a lower value is more important
+type Priority int
+
+const (
+	PriorityCritical Priority = iota
+	PriorityHigh
+	PriorityNormal
+	PriorityBatch
+	PriorityBackground
+)
+
+var priorityNames = map[Priority]string{
+	PriorityCritical:   "critical",
+	PriorityHigh:       "high",
+	PriorityNormal:     "normal",
+	PriorityBatch:      "batch",
+	PriorityBackground: "background",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// DefaultShedThresholds are the loads at which the priorities are shed
+var DefaultShedThresholds = map[Priority]float64{
+	PriorityHigh:       1.2,
+	PriorityNormal:     1,
+	PriorityBatch:      0.9,
+	PriorityBackground: 0.8,
+}
+
+var (
+	// ErrShed matches every *ShedError with errors.Is
+	ErrShed = errors.New("call shed")
+)
+
+// ShedError is returned for a call dropped by the LoadShedder
+type ShedError struct {
+	Name     string
+	Priority Priority
+	Load     float64
+}
+
+func (e *ShedError) Error() string {
+	return fmt.Sprintf("%s: %s call shed at load %.2f", e.Name, e.Priority, e.Load)
+}
+
+func (e *ShedError) Is(target error) bool {
+	return target == ErrShed
+}
+
+type LoadShedderSettings struct {
+	Name string
+	// Priority returns the priority of the input object, PriorityNormal for all if not set
+	Priority func(inObj interface{}) Priority
+	// Thresholds overrides DefaultShedThresholds per priority.
+	// A priority without a threshold gets the one of the lowest priority
+	// (the greatest value) which has a threshold.
+	Thresholds map[Priority]float64
+	// MaxInFlight if set is the number of concurrent calls the process handles
+	MaxInFlight uint32
+	// EnqueuedAt if set returns the time the input object was queued,
+	// MaxQueueWait is the acceptable wait
+	EnqueuedAt   func(inObj interface{}) time.Time
+	MaxQueueWait time.Duration
+	// CPUSampler if set returns the CPU usage in [0, 1],
+	// it's called at most once per CPUSampleInterval (DefaultCPUSampleInterval if not set).
+	// MaxCPU is the acceptable usage.
+	CPUSampler        func() float64
+	CPUSampleInterval time.Duration
+	MaxCPU            float64
+	// EventBus if set receives CallRejected events
+	EventBus *EventBus
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type LoadShedder struct {
+	name              string
+	priorityFn        func(inObj interface{}) Priority
+	thresholds        map[Priority]float64
+	lowestPriority    Priority
+	maxInFlight       uint32
+	enqueuedAt        func(inObj interface{}) time.Time
+	maxQueueWait      time.Duration
+	cpuSampler        func() float64
+	cpuSampleInterval time.Duration
+	maxCPU            float64
+	eventBus          *EventBus
+	clock             Clock
+	inFlight          uint32
+	cpu               float64
+	cpuSampledAt      time.Time
+	mutex             sync.Mutex
+}
+
+func NewLoadShedder(settings LoadShedderSettings) *LoadShedder {
+	shedder := new(LoadShedder)
+
+	shedder.name = settings.Name
+
+	if shedder.priorityFn = settings.Priority; shedder.priorityFn == nil {
+		shedder.priorityFn = func(interface{}) Priority { return PriorityNormal }
+	}
+
+	shedder.thresholds = make(map[Priority]float64)
+	for priority, threshold := range DefaultShedThresholds {
+		shedder.thresholds[priority] = threshold
+	}
+	for priority, threshold := range settings.Thresholds {
+		shedder.thresholds[priority] = threshold
+	}
+	for priority := range shedder.thresholds {
+		if priority > shedder.lowestPriority {
+			shedder.lowestPriority = priority
+		}
+	}
+
+	shedder.maxInFlight = settings.MaxInFlight
+
+	if settings.MaxQueueWait > 0 {
+		shedder.enqueuedAt = settings.EnqueuedAt
+		shedder.maxQueueWait = settings.MaxQueueWait
+	}
+
+	if settings.MaxCPU > 0 {
+		shedder.cpuSampler = settings.CPUSampler
+		shedder.maxCPU = settings.MaxCPU
+	}
+	if shedder.cpuSampleInterval = settings.CPUSampleInterval; shedder.cpuSampleInterval <= 0 {
+		shedder.cpuSampleInterval = DefaultCPUSampleInterval
+	}
+
+	shedder.eventBus = settings.EventBus
+	shedder.clock = clockOrDefault(settings.Clock)
+
+	return shedder
+}
+
+// InFlight returns the number of running calls
+func (s *LoadShedder) InFlight() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inFlight
+}
+
+// Load returns the current load without the queue wait of a particular call
+func (s *LoadShedder) Load() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load(nil)
+}
+
+// load must be called under the mutex, inObj is nil if there's no call
+func (s *LoadShedder) load(inObj interface{}) float64 {
+	var load float64
+
+	if s.maxInFlight > 0 {
+		load = float64(s.inFlight) / float64(s.maxInFlight)
+	}
+
+	if s.enqueuedAt != nil && inObj != nil {
+		if enqueuedAt := s.enqueuedAt(inObj); !enqueuedAt.IsZero() {
+			if queueLoad := float64(s.clock.Since(enqueuedAt)) / float64(s.maxQueueWait); queueLoad > load {
+				load = queueLoad
+			}
+		}
+	}
+
+	if s.cpuSampler != nil {
+		if now := s.clock.Now(); s.cpuSampledAt.IsZero() || now.Sub(s.cpuSampledAt) >= s.cpuSampleInterval {
+			s.cpu, s.cpuSampledAt = s.cpuSampler(), now
+		}
+		if cpuLoad := s.cpu / s.maxCPU; cpuLoad > load {
+			load = cpuLoad
+		}
+	}
+
+	return load
+}
+
+// admit counts the call in flight or returns the ShedError
+func (s *LoadShedder) admit(inObj interface{}) error {
+	priority := s.priorityFn(inObj)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	load := s.load(inObj)
+	threshold, ok := s.thresholds[priority]
+	if !ok {
+		threshold = s.thresholds[s.lowestPriority]
+	}
+	if priority != PriorityCritical && load >= threshold {
+		return &ShedError{Name: s.name, Priority: priority, Load: load}
+	}
+	s.inFlight++
+
+	return nil
+}
+
+func (s *LoadShedder) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+}
+
+func (s *LoadShedder) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		if err := s.admit(inObj); err != nil {
+			s.eventBus.Publish(Event{Type: CallRejected, Name: s.name, Time: s.clock.Now(), Err: err})
+			return nil, err
+		}
+		defer s.release()
+
+		return processFn(inObj)
+	}
+}
@@ -0,0 +1,159 @@
+package stabilitytest
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultFakeClockStart is the time a FakeClock created by NewFakeClock starts at
+var DefaultFakeClockStart = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeTimer is a pending After, Sleep or Ticker of the FakeClock.
+// period > 0 means it's a ticker and it's rescheduled after firing.
+type fakeTimer struct {
+	fireAt time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// FakeClock is a stability.Clock which time moves only by Advance.
+// Timers and tickers fire synchronously inside Advance,
+// Sleep blocks until another goroutine advances the clock far enough.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewFakeClock() *FakeClock {
+	return NewFakeClockAt(DefaultFakeClockStart)
+}
+
+func NewFakeClockAt(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.cond = sync.NewCond(&clock.mutex)
+	return clock
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.addTimer(d, 0).ch
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) stability.Ticker {
+	if d <= 0 {
+		panic("stabilitytest: non-positive interval for NewTicker")
+	}
+	return &fakeTicker{clock: c, timer: c.addTimer(d, d)}
+}
+
+func (c *FakeClock) addTimer(d time.Duration, period time.Duration) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	timer := &fakeTimer{fireAt: c.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 && period == 0 {
+		timer.ch <- c.now
+		return timer
+	}
+
+	c.timers = append(c.timers, timer)
+	c.cond.Broadcast()
+	return timer
+}
+
+// Advance moves the time forward and fires every timer
+// which is due, in the order of their firing time.
+// Like time.Ticker a ticker drops the ticks nobody has read.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool {
+			return c.timers[i].fireAt.Before(c.timers[j].fireAt)
+		})
+		if len(c.timers) == 0 || c.timers[0].fireAt.After(target) {
+			break
+		}
+
+		timer := c.timers[0]
+		c.now = timer.fireAt
+		select {
+		case timer.ch <- c.now:
+		default:
+		}
+
+		if timer.period > 0 {
+			timer.fireAt = timer.fireAt.Add(timer.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+	c.now = target
+	c.cond.Broadcast()
+}
+
+// Set moves the time forward to t, see Advance
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// Waiters returns the number of pending timers, sleepers and tickers
+func (c *FakeClock) Waiters() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.timers)
+}
+
+// BlockUntil blocks until there are at least n pending timers, sleepers and tickers.
+// Use it to wait for a goroutine to reach its Sleep before calling Advance.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+func (c *FakeClock) removeTimer(timer *fakeTimer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, t := range c.timers {
+		if t == timer {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			break
+		}
+	}
+	c.cond.Broadcast()
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	timer *fakeTimer
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.timer.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.removeTimer(t.timer)
+}
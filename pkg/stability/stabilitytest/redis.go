@@ -0,0 +1,323 @@
+package stabilitytest
+
+import (
+	"bufio"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/redisstore"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisServer is a small in-memory stand-in for Redis, good enough
+// to test redisstore.Store without a real server. It supports PING, AUTH, SELECT,
+// GET, SET (EX, PX, NX, XX), INCR, INCRBY, DEL, WATCH, UNWATCH, MULTI, EXEC and DISCARD.
+type RedisServer struct {
+	listener net.Listener
+	clock    stability.Clock
+	entries  map[string]redisEntry
+	versions map[string]uint64
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+}
+
+type redisEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// redisNilArray is the EXEC reply of an aborted transaction
+type redisNilArray struct{}
+
+// NewRedisServer starts a server on a random local port,
+// clock is optional (SystemClock if nil) and drives the key expiry
+func NewRedisServer(clock stability.Clock) (*RedisServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = stability.SystemClock
+	}
+
+	server := &RedisServer{
+		listener: listener,
+		clock:    clock,
+		entries:  make(map[string]redisEntry),
+		versions: make(map[string]uint64),
+		conns:    make(map[net.Conn]struct{}),
+	}
+
+	server.wg.Add(1)
+	go server.serve()
+
+	return server, nil
+}
+
+// Addr returns the host:port the server listens on
+func (s *RedisServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes the client connections
+func (s *RedisServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for c := range s.conns {
+		_ = c.Close()
+	}
+	s.mutex.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *RedisServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			_ = c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+type redisSession struct {
+	watched map[string]uint64
+	multi   bool
+	queued  [][]string
+}
+
+func (s *RedisServer) serveConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		_ = c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	session := &redisSession{}
+
+	for {
+		request, err := redisstore.ReadReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := request.([]interface{})
+		if !ok || len(items) == 0 {
+			return
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+
+		writeRedisReply(w, s.handle(session, args))
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeRedisReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case redisNilArray:
+		fmt.Fprint(w, "*-1\r\n")
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeRedisReply(w, item)
+		}
+	}
+}
+
+func (s *RedisServer) handle(session *redisSession, args []string) interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+	if session.multi && cmd != "EXEC" && cmd != "DISCARD" && cmd != "MULTI" && cmd != "WATCH" {
+		session.queued = append(session.queued, args)
+		return "QUEUED"
+	}
+
+	switch cmd {
+	case "WATCH":
+		if session.watched == nil {
+			session.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			s.expire(key)
+			session.watched[key] = s.versions[key]
+		}
+		return "OK"
+	case "UNWATCH":
+		session.watched = nil
+		return "OK"
+	case "MULTI":
+		session.multi = true
+		session.queued = nil
+		return "OK"
+	case "DISCARD":
+		session.multi, session.queued, session.watched = false, nil, nil
+		return "OK"
+	case "EXEC":
+		if !session.multi {
+			return fmt.Errorf("ERR EXEC without MULTI")
+		}
+		queued, watched := session.queued, session.watched
+		session.multi, session.queued, session.watched = false, nil, nil
+		for key, version := range watched {
+			s.expire(key)
+			if s.versions[key] != version {
+				return redisNilArray{}
+			}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, queuedArgs := range queued {
+			replies[i] = s.exec(queuedArgs)
+		}
+		return replies
+	}
+
+	return s.exec(args)
+}
+
+// expire removes the key if it expired, must be called under the mutex
+func (s *RedisServer) expire(key string) {
+	if entry, ok := s.entries[key]; ok && !entry.expiresAt.IsZero() && !s.clock.Now().Before(entry.expiresAt) {
+		delete(s.entries, key)
+		s.versions[key]++
+	}
+}
+
+// exec runs a data command, must be called under the mutex
+func (s *RedisServer) exec(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	for _, key := range args[1:2] {
+		s.expire(key)
+	}
+
+	switch {
+	case cmd == "PING":
+		return "PONG"
+	case cmd == "AUTH" || cmd == "SELECT":
+		return "OK"
+	case cmd == "GET" && len(args) == 2:
+		if entry, ok := s.entries[args[1]]; ok {
+			return []byte(entry.value)
+		}
+		return nil
+	case cmd == "SET" && len(args) >= 3:
+		return s.set(args[1], args[2], args[3:])
+	case cmd == "INCR" && len(args) == 2:
+		return s.incr(args[1], "1")
+	case cmd == "INCRBY" && len(args) == 3:
+		return s.incr(args[1], args[2])
+	case cmd == "DEL" && len(args) >= 2:
+		var deleted int64
+		for _, key := range args[1:] {
+			s.expire(key)
+			if _, ok := s.entries[key]; ok {
+				delete(s.entries, key)
+				s.versions[key]++
+				deleted++
+			}
+		}
+		return deleted
+	}
+
+	return fmt.Errorf("ERR unknown command or wrong number of arguments for '%s'", args[0])
+}
+
+func (s *RedisServer) set(key, value string, options []string) interface{} {
+	entry := redisEntry{value: value}
+	nx, xx := false, false
+	for i := 0; i < len(options); i++ {
+		switch strings.ToUpper(options[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(options) {
+				return fmt.Errorf("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(options[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if strings.ToUpper(options[i]) == "EX" {
+				unit = time.Second
+			}
+			entry.expiresAt = s.clock.Now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	_, exists := s.entries[key]
+	if nx && exists || xx && !exists {
+		return nil
+	}
+
+	s.entries[key] = entry
+	s.versions[key]++
+	return "OK"
+}
+
+func (s *RedisServer) incr(key, delta string) interface{} {
+	d, err := strconv.ParseInt(delta, 10, 64)
+	if err != nil {
+		return fmt.Errorf("ERR value is not an integer or out of range")
+	}
+
+	entry := s.entries[key]
+	var n int64
+	if entry.value != "" {
+		if n, err = strconv.ParseInt(entry.value, 10, 64); err != nil {
+			return fmt.Errorf("ERR value is not an integer or out of range")
+		}
+	}
+	n += d
+
+	entry.value = strconv.FormatInt(n, 10)
+	s.entries[key] = entry
+	s.versions[key]++
+	return n
+}
@@ -0,0 +1,77 @@
+// Package stabilitytest provides test doubles for the stability package
+package stabilitytest
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"context"
+	"sync"
+)
+
+type spanKey struct{}
+
+// SpanEvent is an event recorded by MemorySpan
+type SpanEvent struct {
+	Name  string
+	Attrs []stability.Attr
+}
+
+// Attr returns the value of the attribute with given key
+func (e SpanEvent) Attr(key string) (interface{}, bool) {
+	for _, attr := range e.Attrs {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return nil, false
+}
+
+// MemorySpan keeps the recorded events in memory
+type MemorySpan struct {
+	Name   string
+	events []SpanEvent
+	mutex  sync.Mutex
+}
+
+func (s *MemorySpan) AddEvent(name string, attrs ...stability.Attr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, SpanEvent{Name: name, Attrs: attrs})
+}
+
+// Events returns a copy of the recorded events
+func (s *MemorySpan) Events() []SpanEvent {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SpanEvent(nil), s.events...)
+}
+
+// EventsNamed returns the recorded events with given name
+func (s *MemorySpan) EventsNamed(name string) []SpanEvent {
+	var res []SpanEvent
+	for _, e := range s.Events() {
+		if e.Name == name {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// MemoryTracer is a stability.Tracer for tests
+type MemoryTracer struct{}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+// Start returns a context carrying a new span
+func (*MemoryTracer) Start(ctx context.Context, name string) (context.Context, *MemorySpan) {
+	span := &MemorySpan{Name: name}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (*MemoryTracer) SpanFromContext(ctx context.Context) stability.Span {
+	if span, ok := ctx.Value(spanKey{}).(*MemorySpan); ok {
+		return span
+	}
+	return nil
+}
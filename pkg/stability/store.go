@@ -0,0 +1,127 @@
+package stability
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StateStore keeps policy state shared by the instances of a service,
+// so a fleet of replicas enforces one limit instead of one per replica.
+// MemoryStore is the in-process implementation, redisstore.Store
+// talks to Redis (or anything speaking its protocol).
+type StateStore interface {
+	// Get returns the value of the key, ok is false if the key doesn't exist or expired
+	Get(key string) (value []byte, ok bool, err error)
+	// Set stores the value, ttl <= 0 keeps it for ever
+	Set(key string, value []byte, ttl time.Duration) error
+	// Incr adds delta to the integer value of the key (a missing key counts as 0)
+	// and returns the new value. If the key is created ttl > 0 sets its expiry.
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+	// CompareAndSet stores the value if the current value equals old,
+	// old == nil means the key must not exist. It reports whether the value is stored.
+	CompareAndSet(key string, old, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes the key
+	Delete(key string) error
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryStore is a StateStore in the process memory
+type MemoryStore struct {
+	entries map[string]memoryEntry
+	clock   Clock
+	mutex   sync.Mutex
+}
+
+// NewMemoryStore creates a store, clock is optional (SystemClock if nil)
+func NewMemoryStore(clock Clock) *MemoryStore {
+	return &MemoryStore{entries: make(map[string]memoryEntry), clock: clockOrDefault(clock)}
+}
+
+// get must be called under the mutex
+func (s *MemoryStore) get(key string) ([]byte, bool) {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !entry.expiresAt.IsZero() && !s.clock.Now().Before(entry.expiresAt) {
+		delete(s.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// set must be called under the mutex
+func (s *MemoryStore) set(key string, value []byte, ttl time.Duration) {
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expiresAt = s.clock.Now().Add(ttl)
+	}
+	s.entries[key] = entry
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.get(key)
+	return append([]byte(nil), value...), ok, nil
+}
+
+func (s *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.set(key, value, ttl)
+	return nil
+}
+
+func (s *MemoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	value, ok := s.get(key)
+	if !ok {
+		s.set(key, []byte(strconv.FormatInt(delta, 10)), ttl)
+		return delta, nil
+	}
+
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+
+	// Keep the expiry of the existing key
+	entry := s.entries[key]
+	entry.value = []byte(strconv.FormatInt(n, 10))
+	s.entries[key] = entry
+
+	return n, nil
+}
+
+func (s *MemoryStore) CompareAndSet(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	current, ok := s.get(key)
+	if old == nil && ok || old != nil && (!ok || !bytes.Equal(current, old)) {
+		return false, nil
+	}
+
+	s.set(key, value, ttl)
+	return true, nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
@@ -1,7 +1,7 @@
 package stability
 
 import (
-	"fmt"
+	"errors"
 	"sync"
 	"time"
 )
@@ -14,46 +14,87 @@ import (
 // * A client may restrict itself to call a particular function once every 500 milliseconds.
 // * An account may only be allowed three failed login attempts in a 24-hour period.
 
+var (
+	// ErrTooManyCalls is returned when the throttle bucket is empty
+	ErrTooManyCalls = errors.New("too many calls")
+)
+
 const DefaultMaxTokens = 1
 const DefaultRefillTokensCnt = 1
 const DefaultRefillInterval = time.Duration(1) * time.Second
 
+// ThrottleAlgorithm picks the Limiter built by NewThrottle
+type ThrottleAlgorithm int
+
+const (
+	// TokenBucket holds up to MaxTokens, RefillTokensCnt are added every RefillInterval.
+	// A full bucket allows a burst of MaxTokens calls at once.
+	TokenBucket ThrottleAlgorithm = iota
+	// FixedWindow allows MaxTokens calls per RefillInterval window,
+	// the windows are aligned to the clock (Time.Truncate)
+	FixedWindow
+	// SlidingWindowLog allows exactly MaxTokens calls in any RefillInterval ("N per rolling minute"),
+	// it keeps a timestamp per allowed call
+	SlidingWindowLog
+	// SlidingWindowCounter approximates SlidingWindowLog weighting
+	// the previous window's count, it keeps two counters only
+	SlidingWindowCounter
+	// GCRA spaces the calls evenly at RefillTokensCnt per RefillInterval
+	// allowing bursts of up to MaxTokens calls
+	GCRA
+	// LeakyBucket queues up to MaxTokens calls and lets them out
+	// at RefillTokensCnt per RefillInterval, the queued calls wait for their turn
+	LeakyBucket
+)
+
 type ThrottleSettings struct {
 	Name            string
 	MaxTokens       uint32
 	RefillTokensCnt uint32
 	RefillInterval  time.Duration
+	// Algorithm defaults to TokenBucket
+	Algorithm ThrottleAlgorithm
+	// Limiter if set is used instead of the Algorithm
+	// and the MaxTokens, RefillTokensCnt and RefillInterval are ignored
+	Limiter Limiter
+	// Store if set keeps the limiter state shared by the instances
+	// using the same Name, see NewStoreLimiter
+	Store StateStore
+	// EventBus if set receives TokensExhausted events
+	EventBus *EventBus
+	// Tracer if set records rejections on the span
+	// carried by the input object's context
+	Tracer Tracer
+	// Clock defaults to SystemClock
+	Clock Clock
 }
 
 type Throttle struct {
-	name            string
-	maxTokens       uint32
-	tokensInBucket  uint32
-	refillTokensCnt uint32
-	refillInterval  time.Duration
-	once            sync.Once
-	mutex           sync.Mutex
-}
-
-func (t *Throttle) refill() {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	if t.tokensInBucket += t.refillTokensCnt; t.tokensInBucket > t.maxTokens{
-		t.tokensInBucket = t.maxTokens
-	}
+	name     string
+	limiter  Limiter
+	eventBus *EventBus
+	tracer   Tracer
+	clock    Clock
+	// saturatedSince is the time of the first rejection since the last allowed call,
+	// saturatedUntil is when the limiter lets calls through again after the last rejection
+	saturatedSince time.Time
+	saturatedUntil time.Time
+	mutex          sync.Mutex
 }
 
-func (t *Throttle) isTokenBucketEmpty() bool{
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	return t.tokensInBucket <= 0
-}
-
-func (t *Throttle) decreaseTokensInBucket() uint32{
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-	t.tokensInBucket -= 1
-	return t.tokensInBucket
+// ThrottleStatus is the state of the limiter after Take
+type ThrottleStatus struct {
+	// Allowed is false if the call is rejected
+	Allowed bool
+	// Limit is the bucket size (calls per window)
+	Limit uint32
+	// Remaining is the number of calls which would be allowed now
+	Remaining uint32
+	// Reset is the time left until the limiter lets more calls through
+	Reset time.Duration
+	// Delay is the time an allowed call must wait for its turn (LeakyBucket only),
+	// GetProcessorFn waits for it
+	Delay time.Duration
 }
 
 func NewThrottle(settings ThrottleSettings) *Throttle {
@@ -61,47 +102,129 @@ func NewThrottle(settings ThrottleSettings) *Throttle {
 
 	throttle.name = settings.Name
 
-	if throttle.maxTokens = settings.MaxTokens; throttle.maxTokens <= 0 {
-		throttle.maxTokens = DefaultMaxTokens
+	maxTokens := settings.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
 	}
 
-	throttle.tokensInBucket = throttle.maxTokens
+	refillTokensCnt := settings.RefillTokensCnt
+	if refillTokensCnt <= 0 {
+		refillTokensCnt = DefaultRefillTokensCnt
+	}
 
-	if throttle.refillTokensCnt = settings.RefillTokensCnt; throttle.refillTokensCnt <= 0 {
-		throttle.refillTokensCnt = DefaultRefillTokensCnt
+	refillInterval := settings.RefillInterval
+	if refillInterval <= 0 {
+		refillInterval = DefaultRefillInterval
 	}
 
-	if throttle.refillInterval = settings.RefillInterval; throttle.refillInterval <= 0 {
-		throttle.refillInterval = DefaultRefillInterval
+	switch {
+	case settings.Limiter != nil:
+		throttle.limiter = settings.Limiter
+	case settings.Store != nil:
+		throttle.limiter = NewStoreLimiter(settings.Store, "throttle:"+settings.Name, settings.Algorithm, maxTokens, refillTokensCnt, refillInterval)
+	default:
+		throttle.limiter = NewLimiter(settings.Algorithm, maxTokens, refillTokensCnt, refillInterval)
 	}
 
+	throttle.eventBus = settings.EventBus
+	throttle.tracer = settings.Tracer
+	throttle.clock = clockOrDefault(settings.Clock)
+
 	return throttle
 }
 
+// Take asks the limiter for a call.
+// Use it to guard a call without GetProcessorFn, e.g. in a http middleware.
+func (t *Throttle) Take() ThrottleStatus {
+	now := t.clock.Now()
+	status := t.limiter.Take(now)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if status.Allowed {
+		t.saturatedSince = time.Time{}
+		return status
+	}
+	if t.saturatedSince.IsZero() || t.recovered(now) {
+		t.saturatedSince = now
+	}
+	t.saturatedUntil = time.Time{}
+	if status.Reset > 0 {
+		t.saturatedUntil = now.Add(status.Reset)
+	}
+
+	return status
+}
+
+// Name returns the throttle name
+func (t *Throttle) Name() string {
+	return t.name
+}
+
+// SaturatedFor returns how long the calls have been rejected,
+// 0 if the last call was allowed or the limiter has let calls through
+// since the last rejection (the throttle went idle). A limiter which doesn't
+// report ThrottleStatus.Reset stays saturated until the next allowed call.
+func (t *Throttle) SaturatedFor() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.Now()
+	if t.saturatedSince.IsZero() || t.recovered(now) {
+		return 0
+	}
+	return now.Sub(t.saturatedSince)
+}
+
+// recovered reports whether the limiter has tokens again after the last rejection
+func (t *Throttle) recovered(now time.Time) bool {
+	return !t.saturatedUntil.IsZero() && !now.Before(t.saturatedUntil)
+}
+
 func (t *Throttle) GetProcessorFn(processFn ProcessFn) ProcessFn {
 
 	return func(inObj interface{}) (interface{}, error) {
-		t.once.Do(func() {
-			ticker := time.NewTicker(t.refillInterval)
-
-			go func() {
-				defer ticker.Stop()
-
-				for {
-					select {
-					case <-ticker.C:
-						t.refill()
-					}
-				}
-			}()
-		})
-
-		if t.isTokenBucketEmpty() {
-			return "", fmt.Errorf("too many calls")
+		status := t.Take()
+		if !status.Allowed {
+			t.eventBus.Publish(Event{Type: TokensExhausted, Name: t.name, Time: t.clock.Now()})
+			addSpanEvent(t.tracer, inObj, SpanEventThrottleRejected, Attr{Key: "policy", Value: t.name})
+			return "", ErrTooManyCalls
 		}
 
-		t.decreaseTokensInBucket()
+		if status.Delay > 0 {
+			if err := t.wait(inObj, status.Delay); err != nil {
+				return "", err
+			}
+		}
 
 		return processFn(inObj)
 	}
 }
+
+// wait waits for the turn of the call, the call which gives up on the budget
+// or its context returns the turn to the limiter
+func (t *Throttle) wait(inObj interface{}, delay time.Duration) error {
+	if remaining, ok := RemainingBudget(inObj, t.clock); ok && remaining < delay {
+		t.cancel()
+		return &BudgetExceededError{Name: t.name, Remaining: remaining}
+	}
+
+	// A ticker, unlike After, is stopped when the context is done first
+	timer := t.clock.NewTicker(delay)
+	defer timer.Stop()
+
+	ctx := ContextOf(inObj)
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		t.cancel()
+		return ctx.Err()
+	}
+}
+
+func (t *Throttle) cancel() {
+	if canceler, ok := t.limiter.(LimiterCanceler); ok {
+		canceler.Cancel(t.clock.Now())
+	}
+}
@@ -0,0 +1,114 @@
+package stability
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Timeout stops waiting for the ProcessFn after the timeout or the remaining
+// latency budget, whichever is shorter. The call keeps running in the background:
+// if the input object can carry a context (see BindContext) its context is cancelled
+// and carries the narrowed budget, so the inner policies and the call itself can stop early.
+// A panic of the call is raised again in the caller's goroutine unless the caller
+// has stopped waiting already.
+
+const DefaultTimeout = time.Duration(1) * time.Second
+
+var (
+	// ErrTimeout is returned when the call doesn't finish in the timeout
+	ErrTimeout = errors.New("call timed out")
+)
+
+type TimeoutSettings struct {
+	Name string
+	// Timeout defaults to DefaultTimeout
+	Timeout time.Duration
+	// Tracer if set records the expired timeouts on the span
+	// carried by the input object's context
+	Tracer Tracer
+	// Clock defaults to SystemClock
+	Clock Clock
+}
+
+type Timeout struct {
+	name    string
+	timeout time.Duration
+	tracer  Tracer
+	clock   Clock
+}
+
+func NewTimeout(settings TimeoutSettings) *Timeout {
+	timeout := new(Timeout)
+
+	timeout.name = settings.Name
+
+	if timeout.timeout = settings.Timeout; timeout.timeout <= 0 {
+		timeout.timeout = DefaultTimeout
+	}
+
+	timeout.tracer = settings.Tracer
+	timeout.clock = clockOrDefault(settings.Clock)
+
+	return timeout
+}
+
+type timeoutResult struct {
+	res interface{}
+	err error
+	// panicked is set if processFn panicked with panicValue
+	panicked   bool
+	panicValue interface{}
+}
+
+func (t *Timeout) GetProcessorFn(processFn ProcessFn) ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		timeout, limitedByBudget := t.timeout, false
+		if remaining, ok := RemainingBudget(inObj, t.clock); ok {
+			if remaining <= 0 {
+				return nil, &BudgetExceededError{Name: t.name, Remaining: remaining}
+			}
+			if remaining < timeout {
+				timeout, limitedByBudget = remaining, true
+			}
+		}
+
+		ctx, cancel := context.WithCancel(ContextOf(inObj))
+		defer cancel()
+		callObj, _ := BindContext(inObj, WithBudget(ctx, t.clock.Now().Add(timeout)))
+
+		done := make(chan timeoutResult, 1)
+		go func() {
+			result := timeoutResult{panicked: true}
+			defer func() {
+				if result.panicked {
+					result.panicValue = recover()
+				}
+				done <- result
+			}()
+			result.res, result.err = processFn(callObj)
+			result.panicked = false
+		}()
+
+		// A ticker, unlike After, is stopped when the call returns first
+		timer := t.clock.NewTicker(timeout)
+		defer timer.Stop()
+
+		select {
+		case result := <-done:
+			if result.panicked {
+				panic(result.panicValue)
+			}
+			return result.res, result.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C():
+			addSpanEvent(t.tracer, inObj, SpanEventTimeout, Attr{Key: "policy", Value: t.name},
+				Attr{Key: "timeout", Value: timeout}, Attr{Key: "budget", Value: limitedByBudget})
+			if limitedByBudget {
+				return nil, &BudgetExceededError{Name: t.name, Err: ErrTimeout}
+			}
+			return nil, ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package stability
+
+import "context"
+
+// Span event names recorded by the policies
+const (
+	SpanEventRetryAttempt     = "retry.attempt"
+	SpanEventRetryBackoff     = "retry.backoff"
+	SpanEventBreakerRejected  = "breaker.rejected"
+	SpanEventThrottleRejected = "throttle.rejected"
+	SpanEventTimeout          = "timeout.expired"
+)
+
+// Attr is a key/value pair attached to a span event
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is the part of a tracing span the policies need.
+// It is small on purpose, so adapting e.g. an OpenTelemetry span is a few lines.
+type Span interface {
+	AddEvent(name string, attrs ...Attr)
+}
+
+// Tracer finds the span carried by a context.
+// SpanFromContext returns nil if there is no span to record on.
+type Tracer interface {
+	SpanFromContext(ctx context.Context) Span
+}
+
+// addSpanEvent records the event on the span carried by
+// the input object's context, if there is a tracer and a span
+func addSpanEvent(tracer Tracer, inObj interface{}, name string, attrs ...Attr) {
+	if tracer == nil {
+		return
+	}
+	if span := tracer.SpanFromContext(ContextOf(inObj)); span != nil {
+		span.AddEvent(name, attrs...)
+	}
+}
@@ -1,4 +1,32 @@
 package stability
 
+import "errors"
+
 type ProcessFn func(interface{}) (interface{}, error)
 
+// Policy wraps a ProcessFn with a stability pattern.
+// Breaker, Retry, Throttle etc. implement it.
+type Policy interface {
+	GetProcessorFn(processFn ProcessFn) ProcessFn
+}
+
+// Chain wraps processFn with the policies.
+// The first policy is the outermost one, so
+// Chain(fn, retry, breaker, recover) retries calls rejected by the breaker
+// and the breaker counts the recovered panics as failures.
+func Chain(processFn ProcessFn, policies ...Policy) ProcessFn {
+	for i := len(policies) - 1; i >= 0; i-- {
+		processFn = policies[i].GetProcessorFn(processFn)
+	}
+	return processFn
+}
+
+// IsRejected reports whether the policies refused to make the call,
+// as opposed to the call itself failing: an open breaker, exhausted throttle,
+// concurrency limit or shed load
+func IsRejected(err error) bool {
+	return errors.Is(err, ErrOpenState) ||
+		errors.Is(err, ErrTooManyCalls) ||
+		errors.Is(err, ErrLimitExceeded) ||
+		errors.Is(err, ErrShed)
+}
@@ -0,0 +1,85 @@
+package supervisor
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrExists = errors.New("task exists")
+var ErrConflict = errors.New("task changed")
+
+// Store keeps the tasks
+type Store interface {
+	// Create adds the task with Version 1, ErrExists if the ID is taken
+	Create(task Task) error
+	// Get returns the task, false if there is none
+	Get(id string) (Task, bool, error)
+	// Update replaces the task if its Version is the stored one and returns it
+	// with the Version incremented, ErrConflict otherwise
+	Update(task Task) (Task, error)
+	// List returns the tasks in the state in the Create order
+	List(state TaskState) ([]Task, error)
+}
+
+// MemoryStore is an in-process Store
+type MemoryStore struct {
+	tasks map[string]Task
+	seq   map[string]int64
+	next  int64
+	mutex sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tasks: make(map[string]Task), seq: make(map[string]int64)}
+}
+
+func (s *MemoryStore) Create(task Task) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.tasks[task.ID]; ok {
+		return ErrExists
+	}
+	task.Version = 1
+	s.tasks[task.ID] = task
+	s.next++
+	s.seq[task.ID] = s.next
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (Task, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	task, ok := s.tasks[id]
+	return task, ok, nil
+}
+
+func (s *MemoryStore) Update(task Task) (Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stored, ok := s.tasks[task.ID]; !ok || stored.Version != task.Version {
+		return task, ErrConflict
+	}
+	task.Version++
+	s.tasks[task.ID] = task
+	return task, nil
+}
+
+func (s *MemoryStore) List(state TaskState) ([]Task, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var tasks []Task
+	for _, task := range s.tasks {
+		if task.State == state {
+			tasks = append(tasks, task)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return s.seq[tasks[i].ID] < s.seq[tasks[j].ID]
+	})
+	return tasks, nil
+}
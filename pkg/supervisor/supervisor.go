@@ -0,0 +1,318 @@
+// Package supervisor implements the Scheduler Agent Supervisor pattern:
+// the tasks are kept in a Store, the scheduler hands the pending ones to the agent
+// under a lease, and the supervisor reschedules the failed and stuck ones
+// (their lease expired, e.g. the process crashed) until MaxAttempts,
+// then escalates them: compensates and marks them failed.
+// Several supervisors can share a Store, the updates are optimistic (Task.Version).
+// A panic of the agent or the compensation is recovered as a *stability.PanicError
+// and handled as their error.
+package supervisor
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const DefaultLease = time.Duration(30) * time.Second
+const DefaultMaxAttempts = 3
+const DefaultPollInterval = time.Duration(1) * time.Second
+const DefaultWorkers = 1
+
+var ErrLeaseExpired = errors.New("task lease expired")
+
+// TaskState is the state of a task
+type TaskState int
+
+const (
+	// Pending waits for an agent
+	Pending TaskState = iota
+	// Running is held by an agent until LeaseUntil
+	Running
+	// Succeeded is done
+	Succeeded
+	// Failed is escalated after MaxAttempts
+	Failed
+	// Compensating runs the compensation of an escalated task until LeaseUntil
+	Compensating
+)
+
+// Task is a unit of work of the supervisor
+type Task struct {
+	ID    string
+	Input []byte
+	State TaskState
+	// Attempts is the number of the agent runs started
+	Attempts   int
+	LeaseUntil time.Time
+	// Error is the last error of the task
+	Error string
+	// Version is maintained by the Store
+	Version int64
+}
+
+type Settings struct {
+	Name string
+	// Store defaults to a MemoryStore
+	Store Store
+	// Policies wrap the agent, the first one is the outermost (see stability.Chain).
+	// A Timeout shorter than the Lease keeps a hung agent from running past it.
+	Policies []stability.Policy
+	// Lease is how long an attempt may run, DefaultLease if not set
+	Lease time.Duration
+	// MaxAttempts defaults to DefaultMaxAttempts
+	MaxAttempts int
+	// PollInterval defaults to DefaultPollInterval
+	PollInterval time.Duration
+	// Workers is the number of the agent runs at a time, DefaultWorkers if not set.
+	// A stuck run keeps its worker until it returns.
+	// The running compensations take the workers too, but they don't wait for a free one.
+	Workers int
+	// Compensate if set gets the escalated Task in its own goroutine,
+	// it's retried after the Lease while it fails
+	Compensate stability.ProcessFn
+	// OnEscalate if set gets the task marked failed
+	OnEscalate func(task Task)
+	// OnError if set receives the agent, compensation and Store errors
+	OnError func(task Task, err error)
+	// Clock defaults to stability.SystemClock
+	Clock stability.Clock
+}
+
+type Supervisor struct {
+	name         string
+	store        Store
+	agentFn      stability.ProcessFn
+	lease        time.Duration
+	maxAttempts  int
+	pollInterval time.Duration
+	workers      int
+	compensateFn stability.ProcessFn
+	onEscalate   func(task Task)
+	onError      func(task Task, err error)
+	clock        stability.Clock
+	inFlight     int
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+	mutex        sync.Mutex
+}
+
+// NewSupervisor starts the scheduling, the agent gets the Task as the input object
+func NewSupervisor(agentFn stability.ProcessFn, settings Settings) *Supervisor {
+	supervisor := new(Supervisor)
+
+	supervisor.name = settings.Name
+
+	if supervisor.store = settings.Store; supervisor.store == nil {
+		supervisor.store = NewMemoryStore()
+	}
+
+	supervisor.agentFn = stability.Chain(agentFn, settings.Policies...)
+
+	if supervisor.lease = settings.Lease; supervisor.lease <= 0 {
+		supervisor.lease = DefaultLease
+	}
+
+	if supervisor.maxAttempts = settings.MaxAttempts; supervisor.maxAttempts <= 0 {
+		supervisor.maxAttempts = DefaultMaxAttempts
+	}
+
+	if supervisor.pollInterval = settings.PollInterval; supervisor.pollInterval <= 0 {
+		supervisor.pollInterval = DefaultPollInterval
+	}
+
+	if supervisor.workers = settings.Workers; supervisor.workers <= 0 {
+		supervisor.workers = DefaultWorkers
+	}
+
+	supervisor.compensateFn = settings.Compensate
+
+	if supervisor.onEscalate = settings.OnEscalate; supervisor.onEscalate == nil {
+		supervisor.onEscalate = func(Task) {}
+	}
+
+	if supervisor.onError = settings.OnError; supervisor.onError == nil {
+		supervisor.onError = func(Task, error) {}
+	}
+
+	if supervisor.clock = settings.Clock; supervisor.clock == nil {
+		supervisor.clock = stability.SystemClock
+	}
+
+	supervisor.stopCh = make(chan struct{})
+	supervisor.wg.Add(1)
+	go supervisor.run()
+
+	return supervisor
+}
+
+// Submit adds a pending task, ErrExists if the ID is taken
+func (s *Supervisor) Submit(id string, input []byte) error {
+	return s.store.Create(Task{ID: id, Input: input, State: Pending})
+}
+
+// Get returns the task, false if there is none
+func (s *Supervisor) Get(id string) (Task, bool, error) {
+	return s.store.Get(id)
+}
+
+// Stop stops the scheduling and waits for the agent runs in flight
+func (s *Supervisor) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+func (s *Supervisor) run() {
+	defer s.wg.Done()
+	for {
+		s.supervise()
+		s.schedule()
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.clock.After(s.pollInterval):
+		}
+	}
+}
+
+// supervise reschedules or escalates the tasks with the lease expired
+func (s *Supervisor) supervise() {
+	now := s.clock.Now()
+	for _, state := range []TaskState{Running, Compensating} {
+		tasks, err := s.store.List(state)
+		if err != nil {
+			s.onError(Task{}, err)
+			continue
+		}
+		for _, task := range tasks {
+			if now.Before(task.LeaseUntil) {
+				continue
+			}
+			if state == Running {
+				s.onError(task, ErrLeaseExpired)
+				s.fail(task, ErrLeaseExpired)
+			} else {
+				s.escalate(task)
+			}
+		}
+	}
+}
+
+// schedule hands the pending tasks to the free workers
+func (s *Supervisor) schedule() {
+	s.mutex.Lock()
+	free := s.workers - s.inFlight
+	s.mutex.Unlock()
+	if free <= 0 {
+		return
+	}
+
+	tasks, err := s.store.List(Pending)
+	if err != nil {
+		s.onError(Task{}, err)
+		return
+	}
+	for _, task := range tasks {
+		if free == 0 {
+			return
+		}
+		task.State = Running
+		task.Attempts++
+		task.LeaseUntil = s.clock.Now().Add(s.lease)
+		// A conflict means another supervisor took the task
+		claimed, err := s.store.Update(task)
+		if err != nil {
+			continue
+		}
+
+		free--
+		s.start(func() { s.dispatch(claimed) })
+	}
+}
+
+// start runs fn in a goroutine holding a worker
+func (s *Supervisor) start(fn func()) {
+	s.mutex.Lock()
+	s.inFlight++
+	s.mutex.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			s.mutex.Lock()
+			s.inFlight--
+			s.mutex.Unlock()
+			s.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// call runs the agent or the compensation converting a panic into the error
+func (s *Supervisor) call(fn stability.ProcessFn, task Task) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &stability.PanicError{Name: s.name, Value: v, Stack: debug.Stack()}
+		}
+	}()
+	_, err = fn(task)
+	return err
+}
+
+func (s *Supervisor) dispatch(task Task) {
+	if err := s.call(s.agentFn, task); err != nil {
+		s.onError(task, err)
+		s.fail(task, err)
+		return
+	}
+	task.State = Succeeded
+	task.Error = ""
+	// A conflict means the lease expired and the task was rescheduled
+	_, _ = s.store.Update(task)
+}
+
+// fail reschedules the task, or escalates it after MaxAttempts
+func (s *Supervisor) fail(task Task, err error) {
+	task.Error = err.Error()
+	if task.Attempts < s.maxAttempts {
+		task.State = Pending
+		_, _ = s.store.Update(task)
+		return
+	}
+	s.escalate(task)
+}
+
+// escalate starts the compensation of the task or marks it failed
+func (s *Supervisor) escalate(task Task) {
+	if s.compensateFn == nil {
+		s.markFailed(task)
+		return
+	}
+
+	task.State = Compensating
+	task.LeaseUntil = s.clock.Now().Add(s.lease)
+	claimed, err := s.store.Update(task)
+	if err != nil {
+		return
+	}
+	s.start(func() { s.compensate(claimed) })
+}
+
+func (s *Supervisor) compensate(task Task) {
+	if err := s.call(s.compensateFn, task); err != nil {
+		// Compensating, the supervisor retries it after the lease
+		s.onError(task, err)
+		return
+	}
+	s.markFailed(task)
+}
+
+func (s *Supervisor) markFailed(task Task) {
+	task.State = Failed
+	task, err := s.store.Update(task)
+	if err != nil {
+		return
+	}
+	s.onEscalate(task)
+}
@@ -0,0 +1,180 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// adaptiveRound runs n concurrent calls which all take latency and fail if fail is set
+func adaptiveRound(t *testing.T, limiter *stability.AdaptiveLimiter, clock *stabilitytest.FakeClock, n int, latency time.Duration, fail bool) {
+	started := make(chan struct{}, n)
+	release := make(chan struct{})
+	fn := limiter.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		if fail {
+			return nil, intentionalErr
+		}
+		return inObj, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fn(0); err == stability.ErrLimitExceeded {
+				t.Error("unexpected", err)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-started
+	}
+	clock.Advance(latency)
+	close(release)
+	wg.Wait()
+}
+
+func TestAdaptiveLimiterRejects(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	limiter := stability.NewAdaptiveLimiter(stability.AdaptiveLimiterSettings{
+		Name: "TestAdaptiveLimiterRejects", InitialLimit: 2, Clock: clock,
+	})
+
+	release := make(chan struct{})
+	fn := limiter.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		<-release
+		return inObj, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = fn(0)
+		}()
+	}
+	for limiter.InFlight() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := fn(0); err != stability.ErrLimitExceeded {
+		t.Errorf("err = %v, want %v", err, stability.ErrLimitExceeded)
+	}
+	close(release)
+	wg.Wait()
+
+	if _, err := fn(0); err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
+
+func TestAdaptiveLimiterAIMD(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	limiter := stability.NewAdaptiveLimiter(stability.AdaptiveLimiterSettings{
+		Name: "TestAdaptiveLimiterAIMD", InitialLimit: 10, MinLimit: 2, MaxLimit: 20,
+		LatencyThreshold: time.Second, Clock: clock,
+	})
+
+	// Stable latency raises the limit additively up to MaxLimit
+	for i := 0; i < 5; i++ {
+		before := limiter.Limit()
+		adaptiveRound(t, limiter, clock, int(before), time.Millisecond, false)
+		if limit := limiter.Limit(); limit <= before && limit != 20 {
+			t.Errorf("limit = %v, want more than %v", limit, before)
+		}
+	}
+	if limit := limiter.Limit(); limit != 20 {
+		t.Errorf("limit = %v, want MaxLimit %v", limit, 20)
+	}
+
+	// Errors and slow calls lower it multiplicatively, down to MinLimit
+	adaptiveRound(t, limiter, clock, 5, time.Millisecond, true)
+	if limit := limiter.Limit(); limit != 11 {
+		t.Errorf("limit = %v, want %v", limit, 11)
+	}
+	adaptiveRound(t, limiter, clock, 10, 2*time.Second, false)
+	if limit := limiter.Limit(); limit != 4 {
+		t.Errorf("limit = %v, want %v", limit, 4)
+	}
+	adaptiveRound(t, limiter, clock, 4, time.Millisecond, true)
+	adaptiveRound(t, limiter, clock, 2, time.Millisecond, true)
+	if limit := limiter.Limit(); limit != 2 {
+		t.Errorf("limit = %v, want MinLimit %v", limit, 2)
+	}
+}
+
+func TestAdaptiveLimiterLatencySpike(t *testing.T) {
+	for _, algorithm := range []stability.AdaptiveAlgorithm{stability.Vegas, stability.Gradient2} {
+		clock := stabilitytest.NewFakeClock()
+		limiter := stability.NewAdaptiveLimiter(stability.AdaptiveLimiterSettings{
+			Name: "TestAdaptiveLimiterLatencySpike", Algorithm: algorithm, InitialLimit: 20, Clock: clock,
+		})
+
+		adaptiveRound(t, limiter, clock, 20, 10*time.Millisecond, false)
+		stable := limiter.Limit()
+		if stable < 20 {
+			t.Errorf("algorithm %v: limit = %v after stable latency, want at least %v", algorithm, stable, 20)
+		}
+
+		adaptiveRound(t, limiter, clock, int(stable), 100*time.Millisecond, false)
+		if limit := limiter.Limit(); limit >= stable {
+			t.Errorf("algorithm %v: limit = %v after latency spike, want less than %v", algorithm, limit, stable)
+		}
+
+		adaptiveRound(t, limiter, clock, int(limiter.Limit()), 10*time.Millisecond, true)
+		if limit := limiter.Limit(); limit >= stable {
+			t.Errorf("algorithm %v: limit = %v after errors, want less than %v", algorithm, limit, stable)
+		}
+	}
+}
+
+func TestAdaptiveLimiterMinRTTWindow(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	limiter := stability.NewAdaptiveLimiter(stability.AdaptiveLimiterSettings{
+		Name: "TestAdaptiveLimiterMinRTTWindow", Algorithm: stability.Vegas, InitialLimit: 20,
+		MinRTTWindow: time.Minute, Clock: clock,
+	})
+
+	// The dependency becomes slower for good, Vegas takes it for a queue
+	adaptiveRound(t, limiter, clock, 20, 10*time.Millisecond, false)
+	adaptiveRound(t, limiter, clock, int(limiter.Limit()), 100*time.Millisecond, false)
+	lowered := limiter.Limit()
+
+	// After the window the slower latency is the new minimum and the limit grows again
+	clock.Advance(time.Minute)
+	adaptiveRound(t, limiter, clock, int(lowered), 100*time.Millisecond, false)
+	if limit := limiter.Limit(); limit <= lowered {
+		t.Errorf("limit = %v after the window, want more than %v", limit, lowered)
+	}
+}
+
+func TestAdaptiveLimiterPanic(t *testing.T) {
+	limiter := stability.NewAdaptiveLimiter(stability.AdaptiveLimiterSettings{
+		Name: "TestAdaptiveLimiterPanic", InitialLimit: 10,
+	})
+	fn := limiter.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		panic(intentionalErr)
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != intentionalErr {
+				t.Errorf("recovered %v, want %v", r, intentionalErr)
+			}
+		}()
+		_, _ = fn(0)
+	}()
+
+	if inFlight := limiter.InFlight(); inFlight != 0 {
+		t.Errorf("inFlight = %v after a panic, want 0", inFlight)
+	}
+	if limit := limiter.Limit(); limit != 9 {
+		t.Errorf("limit = %v, want %v after the dropped call", limit, 9)
+	}
+}
@@ -2,6 +2,7 @@ package test
 
 import (
 	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
 	"errors"
 	"fmt"
 	"github.com/lissdx/yapgo/pkg/pipeline"
@@ -82,10 +83,12 @@ func TestBreaker(t *testing.T) {
 
 func TestBreakerOpenClose(t *testing.T) {
 
+	clock := stabilitytest.NewFakeClock()
 	breakerSettings := stability.BreakerSettings{
 		Name: "BreakerSettingsTest", FailureThreshold: 2, ExpiryFn: func(tryCnt int) time.Duration {
 			return time.Millisecond * time.Duration(500)
 		},
+		Clock: clock,
 	}
 
 
@@ -97,7 +100,7 @@ func TestBreakerOpenClose(t *testing.T) {
 	doesCircuitOpen := false
 	doesCircuitReclose := false
 	count := 0
-	for range time.NewTicker(250 * time.Millisecond).C {
+	for ; ; clock.Advance(250 * time.Millisecond) {
 		_, err := processorFn(0)
 
 		if err != nil {
@@ -202,3 +205,28 @@ func TestCircuitBreakerDataRace(t *testing.T) {
 	}
 }
 
+
+func TestBreakerState(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	breaker := stability.NewBreaker(stability.BreakerSettings{
+		Name: "TestBreakerState", FailureThreshold: 1, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Second
+		},
+	})
+	processorFn := breaker.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		return nil, intentionalErr
+	})
+
+	if state := breaker.State(); state != stability.StateClosed {
+		t.Errorf("state = %v, want %v", state, stability.StateClosed)
+	}
+	_, _ = processorFn(0)
+	if state := breaker.State(); state != stability.StateOpen {
+		t.Errorf("state = %v, want %v", state, stability.StateOpen)
+	}
+	clock.Advance(time.Second)
+	if state := breaker.State(); state != stability.StateHalfOpen {
+		t.Errorf("state = %v, want %v", state, stability.StateHalfOpen)
+	}
+}
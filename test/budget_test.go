@@ -0,0 +1,187 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetrySkipsAttemptOverBudget(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	attempts := 0
+	retried := stability.NewRetry(stability.RetrySettings{
+		Name: "TestRetrySkipsAttemptOverBudget", RetryThreshold: 10, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return 0
+		},
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		attempts++
+		clock.Advance(300 * time.Millisecond)
+		return nil, intentionalErr
+	})
+
+	// Each attempt takes 300ms of the 1s budget, the fourth one can't finish in it
+	ctx := stability.WithBudget(context.Background(), clock.Now().Add(time.Second))
+	_, err := retried(stability.WithContext(ctx, 0))
+	var budgetErr *stability.BudgetExceededError
+	if !errors.Is(err, stability.ErrBudgetExceeded) || !errors.As(err, &budgetErr) || !errors.Is(err, intentionalErr) {
+		t.Fatalf("err = %v, want %v wrapping %v", err, stability.ErrBudgetExceeded, intentionalErr)
+	}
+	if attempts != 3 || budgetErr.Remaining != 100*time.Millisecond {
+		t.Errorf("attempts = %v, remaining = %v, want %v, %v", attempts, budgetErr.Remaining, 3, 100*time.Millisecond)
+	}
+
+	// A spent budget makes no attempt at all
+	attempts = 0
+	clock.Advance(100 * time.Millisecond)
+	if _, err := retried(stability.WithContext(ctx, 0)); !errors.Is(err, stability.ErrBudgetExceeded) || attempts != 0 {
+		t.Errorf("err = %v, attempts = %v, want %v, %v", err, attempts, stability.ErrBudgetExceeded, 0)
+	}
+}
+
+func TestRetryStopsOnCancel(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	retried := stability.NewRetry(stability.RetrySettings{
+		Name: "TestRetryStopsOnCancel", Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Hour
+		},
+	}).GetProcessorFn(failAfter(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := retried(stability.WithContext(ctx, 0))
+		done <- err
+	}()
+
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, test := range []struct {
+		budget    time.Duration
+		wait      time.Duration
+		remaining time.Duration
+		err       error
+	}{
+		{budget: time.Minute, wait: time.Second, remaining: time.Second, err: stability.ErrTimeout},
+		{budget: 500 * time.Millisecond, wait: 500 * time.Millisecond, remaining: 500 * time.Millisecond, err: stability.ErrBudgetExceeded},
+	} {
+		clock := stabilitytest.NewFakeClock()
+		release := make(chan struct{})
+		remaining := make(chan time.Duration, 1)
+		timed := stability.NewTimeout(stability.TimeoutSettings{
+			Name: "TestTimeout", Timeout: time.Second, Clock: clock,
+		}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+			// The inner layers see the budget narrowed to the timeout
+			budget, _ := stability.RemainingBudget(inObj, clock)
+			remaining <- budget
+			<-release
+			return inObj, nil
+		})
+
+		ctx := stability.WithBudget(context.Background(), clock.Now().Add(test.budget))
+		done := make(chan error)
+		go func() {
+			_, err := timed(stability.WithContext(ctx, 0))
+			done <- err
+		}()
+
+		if budget := <-remaining; budget != test.remaining {
+			t.Errorf("budget %v: inner remaining = %v, want %v", test.budget, budget, test.remaining)
+		}
+		clock.BlockUntil(1)
+		clock.Advance(test.wait)
+		if err := <-done; !errors.Is(err, test.err) {
+			t.Errorf("budget %v: err = %v, want %v", test.budget, err, test.err)
+		}
+		close(release)
+	}
+
+	timed := stability.NewTimeout(stability.TimeoutSettings{Name: "TestTimeout"}).GetProcessorFn(echo)
+	if res, err := timed(1); res != 1 || err != nil {
+		t.Errorf("res = %v %v, want %v", res, err, 1)
+	}
+}
+
+func TestTimeoutRequestContext(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	tracer := stabilitytest.NewMemoryTracer()
+	ctx, span := tracer.Start(context.Background(), "TestTimeoutRequestContext")
+
+	remaining := make(chan time.Duration, 1)
+	cancelled := make(chan error, 1)
+	timed := stability.NewTimeout(stability.TimeoutSettings{
+		Name: "TestTimeoutRequestContext", Timeout: time.Second, Tracer: tracer, Clock: clock,
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		req := inObj.(*http.Request)
+		budget, _ := stability.RemainingBudget(req, clock)
+		remaining <- budget
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+		return nil, req.Context().Err()
+	})
+
+	// The request gets the narrowed context and is cancelled on the timeout
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := timed(req)
+		done <- err
+	}()
+
+	if budget := <-remaining; budget != time.Second {
+		t.Errorf("inner remaining = %v, want %v", budget, time.Second)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if err := <-done; err != stability.ErrTimeout {
+		t.Errorf("err = %v, want %v", err, stability.ErrTimeout)
+	}
+	if err := <-cancelled; err != context.Canceled {
+		t.Errorf("request context err = %v, want %v", err, context.Canceled)
+	}
+
+	events := span.EventsNamed(stability.SpanEventTimeout)
+	if len(events) != 1 {
+		t.Fatalf("timeout events = %v, want %v", len(events), 1)
+	}
+	if timeout, _ := events[0].Attr("timeout"); timeout != time.Second {
+		t.Errorf("timeout = %v, want %v", timeout, time.Second)
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	timeout := stability.NewTimeout(stability.TimeoutSettings{Name: "TestTimeoutPanic", Clock: clock})
+
+	// The panic of the call is raised in the caller, not in the background goroutine
+	func() {
+		defer func() {
+			if r := recover(); r != intentionalErr {
+				t.Errorf("recovered %v, want %v", r, intentionalErr)
+			}
+		}()
+		_, _ = timeout.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+			panic(intentionalErr)
+		})(0)
+	}()
+
+	// The timer of a finished call is stopped
+	if _, err := timeout.GetProcessorFn(echo)(0); err != nil {
+		t.Error("expected no error; got", err)
+	}
+	if waiters := clock.Waiters(); waiters != 0 {
+		t.Errorf("waiters = %v, want 0 after the calls", waiters)
+	}
+}
@@ -0,0 +1,259 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingFn returns "<inObj>:<call number>" or err if it's set
+type countingFn struct {
+	calls int
+	err   error
+	mutex sync.Mutex
+}
+
+func (f *countingFn) process(inObj interface{}) (interface{}, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return fmt.Sprintf("%v:%d", inObj, f.calls), nil
+}
+
+func (f *countingFn) setErr(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+func (f *countingFn) callCnt() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls
+}
+
+func TestCacheTTL(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{}
+	cached := stability.NewCache(stability.CacheSettings{
+		Name: "TestCacheTTL", TTL: time.Second, Clock: clock,
+	}).GetProcessorFn(fn.process)
+
+	for _, want := range []string{"a:1", "a:1", "b:2"} {
+		if res, err := cached(want[:1]); res != want || err != nil {
+			t.Errorf("res = %v %v, want %v", res, err, want)
+		}
+	}
+
+	clock.Advance(time.Second)
+	if res, _ := cached("a"); res != "a:3" {
+		t.Errorf("res = %v after TTL, want %v", res, "a:3")
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	fn := &countingFn{}
+	cache := stability.NewCache(stability.CacheSettings{Name: "TestCacheMaxEntries", MaxEntries: 2})
+	cached := cache.GetProcessorFn(fn.process)
+
+	// b is the least recently used when c is added
+	for _, key := range []string{"a", "b", "a", "c", "a", "c"} {
+		_, _ = cached(key)
+	}
+	if cache.Len() != 2 || fn.callCnt() != 3 {
+		t.Errorf("len = %v, calls = %v, want %v, %v", cache.Len(), fn.callCnt(), 2, 3)
+	}
+	if res, _ := cached("b"); res != "b:4" {
+		t.Errorf("res = %v, want %v", res, "b:4")
+	}
+
+	cache.Invalidate("c")
+	if res, _ := cached("c"); res != "c:5" {
+		t.Errorf("res = %v, want %v", res, "c:5")
+	}
+}
+
+func TestCacheNegative(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{err: intentionalErr}
+	cached := stability.NewCache(stability.CacheSettings{
+		Name: "TestCacheNegative", NegativeTTL: time.Second, Clock: clock,
+	}).GetProcessorFn(fn.process)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cached("a"); err != intentionalErr {
+			t.Errorf("err = %v, want %v", err, intentionalErr)
+		}
+	}
+	if fn.callCnt() != 1 {
+		t.Errorf("calls = %v, want %v", fn.callCnt(), 1)
+	}
+
+	fn.setErr(nil)
+	clock.Advance(time.Second)
+	if res, err := cached("a"); res != "a:2" || err != nil {
+		t.Errorf("res = %v %v, want %v", res, err, "a:2")
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := &countingFn{}
+	cached := stability.NewCache(stability.CacheSettings{Name: "TestCacheSingleflight"}).GetProcessorFn(
+		func(inObj interface{}) (interface{}, error) {
+			if fn.callCnt() == 0 {
+				close(started)
+			}
+			<-release
+			return fn.process(inObj)
+		})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := cached("a"); res != "a:1" || err != nil {
+				t.Errorf("res = %v %v, want %v", res, err, "a:1")
+			}
+		}()
+		if i == 0 {
+			<-started
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	if fn.callCnt() != 1 {
+		t.Errorf("calls = %v, want %v", fn.callCnt(), 1)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{}
+	cached := stability.NewCache(stability.CacheSettings{
+		Name: "TestCacheStaleWhileRevalidate", TTL: time.Second, StaleWhileRevalidate: time.Minute, Clock: clock,
+	}).GetProcessorFn(fn.process)
+
+	_, _ = cached("a")
+	clock.Advance(time.Second)
+
+	// The stale result is returned at once and refreshed in the background
+	if res, _ := cached("a"); res != "a:1" {
+		t.Errorf("res = %v, want stale %v", res, "a:1")
+	}
+	deadline := time.Now().Add(time.Second)
+	for res, _ := cached("a"); res != "a:2"; res, _ = cached("a") {
+		if time.Now().After(deadline) {
+			t.Fatalf("res = %v, want refreshed %v", res, "a:2")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	clock.Advance(time.Second + time.Minute)
+	if res, _ := cached("a"); res != "a:3" {
+		t.Errorf("res = %v after the stale window, want %v", res, "a:3")
+	}
+}
+
+func TestCacheRefreshDetached(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{}
+	cache := stability.NewCache(stability.CacheSettings{
+		Name: "TestCacheRefreshDetached", TTL: time.Second, StaleWhileRevalidate: time.Minute, Clock: clock,
+		KeyFn: func(inObj interface{}) string {
+			return inObj.(stability.ContextObj).Obj.(string)
+		},
+	})
+	cached := cache.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		if err := stability.ContextOf(inObj).Err(); err != nil {
+			return nil, err
+		}
+		return fn.process(inObj.(stability.ContextObj).Obj)
+	})
+
+	_, _ = cached(stability.WithContext(context.Background(), "a"))
+	clock.Advance(time.Second)
+
+	// The caller which triggered the refresh is gone, the refresh isn't
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _ = cached(stability.WithContext(ctx, "a"))
+	deadline := time.Now().Add(time.Second)
+	for res, _ := cached(stability.WithContext(ctx, "a")); res != "a:2"; res, _ = cached(stability.WithContext(ctx, "a")) {
+		if time.Now().After(deadline) {
+			t.Fatalf("res = %v, want refreshed %v", res, "a:2")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheRefreshPanic(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{}
+	cached := stability.NewCache(stability.CacheSettings{
+		Name: "TestCacheRefreshPanic", TTL: time.Second, StaleWhileRevalidate: time.Minute, Clock: clock,
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		res, err := fn.process(inObj)
+		if res == "a:2" {
+			panic(intentionalErr)
+		}
+		return res, err
+	})
+
+	_, _ = cached("a")
+	clock.Advance(time.Second)
+
+	// The panicking refresh keeps the stale entry, the next one replaces it
+	deadline := time.Now().Add(time.Second)
+	for res, _ := cached("a"); res != "a:3"; res, _ = cached("a") {
+		if res != "a:1" {
+			t.Fatalf("res = %v, want stale %v", res, "a:1")
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("res = %v, want refreshed %v", res, "a:3")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheFallbackOnOpenBreaker(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	fn := &countingFn{}
+	cached := stability.Chain(fn.process,
+		stability.NewCache(stability.CacheSettings{
+			Name: "TestCacheFallbackOnOpenBreaker", TTL: time.Second, StaleIfError: time.Minute, Clock: clock,
+			Fallback: func(err error) bool {
+				return errors.Is(err, stability.ErrOpenState)
+			},
+		}),
+		stability.NewBreaker(stability.BreakerSettings{
+			Name: "TestCacheFallbackOnOpenBreaker", FailureThreshold: 1, Clock: clock,
+		}),
+	)
+
+	_, _ = cached("a")
+	clock.Advance(time.Second)
+
+	// The failure itself isn't replaced, the rejection of the open breaker is
+	fn.setErr(intentionalErr)
+	if _, err := cached("a"); err != intentionalErr {
+		t.Errorf("err = %v, want %v", err, intentionalErr)
+	}
+	if res, err := cached("a"); res != "a:1" || err != nil {
+		t.Errorf("res = %v %v, want stale %v", res, err, "a:1")
+	}
+	if _, err := cached("b"); err != stability.ErrOpenState {
+		t.Errorf("err = %v, want %v", err, stability.ErrOpenState)
+	}
+}
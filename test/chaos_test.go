@@ -0,0 +1,120 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"testing"
+	"time"
+)
+
+func echo(inObj interface{}) (interface{}, error) {
+	return inObj, nil
+}
+
+func TestFaultInjectorScript(t *testing.T) {
+	script, err := stability.ParseFaultScript("fail 3, succeed 2, drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	injectorSettings := stability.FaultInjectorSettings{
+		Name: "TestFaultInjectorScript", Enabled: true, Script: script, RepeatScript: true, Err: intentionalErr,
+	}
+	processorFn := stability.NewFaultInjector(injectorSettings).GetProcessorFn(echo)
+
+	var got []error
+	for i := 0; i < 12; i++ {
+		_, err := processorFn(i)
+		got = append(got, err)
+	}
+
+	want := []error{
+		intentionalErr, intentionalErr, intentionalErr, nil, nil, stability.ErrInjectedDrop,
+		intentionalErr, intentionalErr, intentionalErr, nil, nil, stability.ErrInjectedDrop,
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("call %d: err = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFaultInjectorSeed(t *testing.T) {
+	injectorSettings := stability.FaultInjectorSettings{
+		Name: "TestFaultInjectorSeed", Enabled: true, Seed: 42, ErrorRate: 0.3, DropRate: 0.2,
+	}
+
+	run := func() (errCnt, dropCnt int) {
+		processorFn := stability.NewFaultInjector(injectorSettings).GetProcessorFn(echo)
+		for i := 0; i < 1000; i++ {
+			switch _, err := processorFn(i); err {
+			case stability.ErrInjectedFault:
+				errCnt++
+			case stability.ErrInjectedDrop:
+				dropCnt++
+			}
+		}
+		return
+	}
+
+	errCnt, dropCnt := run()
+	if errCnt < 250 || errCnt > 350 {
+		t.Errorf("errCnt = %v, want about %v", errCnt, 300)
+	}
+	if dropCnt < 150 || dropCnt > 250 {
+		t.Errorf("dropCnt = %v, want about %v", dropCnt, 200)
+	}
+
+	// The same seed injects the same faults
+	if errCnt2, dropCnt2 := run(); errCnt2 != errCnt || dropCnt2 != dropCnt {
+		t.Errorf("second run = %v/%v, want %v/%v", errCnt2, dropCnt2, errCnt, dropCnt)
+	}
+}
+
+func TestFaultInjectorLatencyAndPanic(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	injectorSettings := stability.FaultInjectorSettings{
+		Name: "TestFaultInjectorLatencyAndPanic", Enabled: true, Clock: clock, Latency: time.Second,
+		Script: []stability.FaultStep{{Fault: stability.FaultLatency, Count: 1}, {Fault: stability.FaultPanic, Count: 1}},
+	}
+	processorFn := stability.NewFaultInjector(injectorSettings).GetProcessorFn(echo)
+
+	done := make(chan interface{})
+	go func() {
+		res, _ := processorFn("delayed")
+		done <- res
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if res := <-done; res != "delayed" {
+		t.Errorf("res = %v, want %v", res, "delayed")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic; got none")
+			}
+		}()
+		_, _ = processorFn(0)
+	}()
+
+	// The script is over
+	if _, err := processorFn(0); err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
+
+func TestFaultInjectorDisabled(t *testing.T) {
+	if _, err := stability.ParseFaultScript("fail 3, explode 2"); err == nil {
+		t.Error("expected parse err; got none")
+	}
+
+	injectorSettings := stability.FaultInjectorSettings{
+		Name: "TestFaultInjectorDisabled", ErrorRate: 1,
+	}
+	processorFn := stability.NewFaultInjector(injectorSettings).GetProcessorFn(echo)
+	if _, err := processorFn(0); err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
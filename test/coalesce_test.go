@@ -0,0 +1,103 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForWaiting blocks until n callers wait for the call of the key
+func waitForWaiting(t *testing.T, coalesce *stability.Coalesce, key string, n int) {
+	deadline := time.Now().Add(time.Second)
+	for coalesce.Waiting(key) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("waiting = %v, want %v", coalesce.Waiting(key), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	release := make(chan struct{})
+	fn := &countingFn{}
+	coalesce := stability.NewCoalesce(stability.CoalesceSettings{Name: "TestCoalesce"})
+	coalesced := coalesce.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		<-release
+		return fn.process(inObj)
+	})
+
+	// 50 fan-out workers ask for the same key
+	var wg sync.WaitGroup
+	results := make(chan interface{}, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, _ := coalesced("hot")
+			results <- res
+		}()
+	}
+	waitForWaiting(t, coalesce, "hot", 49)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for res := range results {
+		if res != "hot:1" {
+			t.Errorf("res = %v, want %v", res, "hot:1")
+		}
+	}
+	if fn.callCnt() != 1 {
+		t.Errorf("calls = %v, want %v", fn.callCnt(), 1)
+	}
+
+	// Calls after it completed aren't coalesced with it
+	if res, _ := coalesced("hot"); res != "hot:2" {
+		t.Errorf("res = %v, want %v", res, "hot:2")
+	}
+}
+
+func TestCoalesceMaxShare(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fn := &countingFn{}
+	coalesce := stability.NewCoalesce(stability.CoalesceSettings{
+		Name: "TestCoalesceMaxShare", MaxShare: time.Second, Clock: clock,
+		KeyFn: func(interface{}) string { return "key" },
+	})
+	coalesced := coalesce.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		if inObj == "hung" {
+			close(started)
+			<-release
+		}
+		return fn.process(inObj)
+	})
+
+	results := make(chan interface{}, 2)
+	for _, inObj := range []string{"hung", "joined"} {
+		go func(inObj string) {
+			res, _ := coalesced(inObj)
+			results <- res
+		}(inObj)
+		if inObj == "hung" {
+			<-started
+		}
+	}
+
+	// The call is shared until it runs for MaxShare
+	waitForWaiting(t, coalesce, "key", 1)
+	clock.Advance(time.Second)
+	if res, _ := coalesced("fresh"); res != "fresh:1" {
+		t.Errorf("res = %v, want a new call %v", res, "fresh:1")
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if res := <-results; res != "hung:2" {
+			t.Errorf("res = %v, want %v", res, "hung:2")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/consumer"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/deadletter"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForLen polls the queue until it has n messages
+func waitForLen(t *testing.T, queue *consumer.MemoryQueue, n int) {
+	deadline := time.Now().Add(time.Second)
+	for queue.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("len = %v, want %v", queue.Len(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumerPool(t *testing.T) {
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{})
+	var bodies []interface{}
+	var mutex sync.Mutex
+	pool := consumer.NewPool(queue, func(inObj interface{}) (interface{}, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		bodies = append(bodies, inObj.(*consumer.Message).Body)
+		return inObj, nil
+	}, consumer.Settings{Name: "TestConsumerPool", Workers: 3})
+
+	for i := 0; i < 10; i++ {
+		queue.Send(i)
+	}
+	waitForLen(t, queue, 0)
+	pool.Stop()
+
+	if len(bodies) != 10 {
+		t.Errorf("processed = %v, want 10 messages", bodies)
+	}
+}
+
+func TestConsumerNackBackoff(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{Clock: clock})
+	letters := make(chan deadletter.Letter, 1)
+	attempts := make(chan int, 10)
+	pool := consumer.NewPool(queue, func(inObj interface{}) (interface{}, error) {
+		msg := inObj.(*consumer.Message)
+		attempts <- msg.Attempt
+		if msg.Body == "poison" || msg.Attempt < 2 {
+			return nil, intentionalErr
+		}
+		return inObj, nil
+	}, consumer.Settings{
+		Name: "TestConsumerNackBackoff", Clock: clock, MaxAttempts: 3, DeadLetter: deadletter.ChanSink(letters),
+		Retry: &stability.RetrySettings{
+			RetryThreshold: 1,
+			ExpiryFn: func(tryCnt int) time.Duration {
+				return time.Second * time.Duration(tryCnt+1)
+			},
+		},
+	})
+
+	// deliver expects the retried delivery and advances the clock over its retry
+	deliver := func(want int) {
+		for i := 0; i < 2; i++ {
+			if attempt := <-attempts; attempt != want {
+				t.Errorf("attempt = %v, want %v", attempt, want)
+			}
+			if i == 0 {
+				clock.BlockUntil(1)
+				clock.Advance(time.Second)
+			}
+		}
+	}
+
+	// The failed message is retried, then Nacked for the retry backoff 1s and it succeeds
+	queue.Send("order")
+	deliver(1)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if attempt := <-attempts; attempt != 2 {
+		t.Errorf("attempt = %v, want %v", attempt, 2)
+	}
+	waitForLen(t, queue, 0)
+
+	// The poison message is dead-lettered after MaxAttempts
+	queue.Send("poison")
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		deliver(i + 1)
+		clock.BlockUntil(1)
+		clock.Advance(delay)
+	}
+	deliver(3)
+	letter := <-letters
+	if letter.Input != "poison" || letter.Err != intentionalErr {
+		t.Errorf("letter = %+v", letter)
+	}
+	waitForLen(t, queue, 0)
+	pool.Stop()
+}
+
+// stoppingSource delivers the messages only once the receive context is done
+type stoppingSource struct {
+	*consumer.MemoryQueue
+}
+
+func (s stoppingSource) Receive(ctx context.Context) (*consumer.Message, error) {
+	<-ctx.Done()
+	return s.MemoryQueue.Receive(context.Background())
+}
+
+func TestConsumerStopNack(t *testing.T) {
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{})
+	pool := consumer.NewPool(stoppingSource{queue}, func(inObj interface{}) (interface{}, error) {
+		t.Error("processed", inObj.(*consumer.Message).Body)
+		return inObj, nil
+	}, consumer.Settings{Name: "TestConsumerStopNack"})
+
+	// The message received as the pool stops is given back at once
+	queue.Send("late")
+	pool.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if msg, err := queue.Receive(ctx); err != nil || msg.Body != "late" || msg.Attempt != 2 {
+		t.Errorf("msg, err = %+v, %v, want attempt 2 of late", msg, err)
+	}
+}
+
+func TestConsumerPanic(t *testing.T) {
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{})
+	letters := make(chan deadletter.Letter, 1)
+	pool := consumer.NewPool(queue, func(inObj interface{}) (interface{}, error) {
+		panic(intentionalErr)
+	}, consumer.Settings{
+		Name: "TestConsumerPanic", MaxAttempts: 2, DeadLetter: deadletter.ChanSink(letters),
+	})
+
+	// The panicking message is Nacked, then dead-lettered by the surviving worker
+	queue.Send("poison")
+	letter := <-letters
+	var panicErr *stability.PanicError
+	if !errors.As(letter.Err, &panicErr) || panicErr.Value != intentionalErr || letter.Input != "poison" {
+		t.Errorf("letter = %+v, want the PanicError of poison", letter)
+	}
+	waitForLen(t, queue, 0)
+	pool.Stop()
+}
+
+func TestConsumerGracefulStop(t *testing.T) {
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pool := consumer.NewPool(queue, func(inObj interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return inObj, nil
+	}, consumer.Settings{Name: "TestConsumerGracefulStop"})
+
+	queue.Send("in flight")
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned before the message in flight was processed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	<-stopped
+	if queue.Len() != 0 {
+		t.Errorf("len = %v, want the message acknowledged", queue.Len())
+	}
+}
+
+func TestMemoryQueueVisibility(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	queue := consumer.NewMemoryQueue(consumer.MemoryQueueSettings{Visibility: time.Minute, Clock: clock})
+	ctx := context.Background()
+	queue.Send("job")
+
+	msg, _ := queue.Receive(ctx)
+	if err := queue.Extend(ctx, msg, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// A consumer which didn't ack in the visibility timeout loses the message
+	clock.Advance(2 * time.Minute)
+	redelivered, _ := queue.Receive(ctx)
+	if redelivered.ID != msg.ID || redelivered.Attempt != 2 {
+		t.Errorf("redelivered = %+v, want attempt 2 of %v", redelivered, msg.ID)
+	}
+	if err := queue.Ack(ctx, msg); err != consumer.ErrStaleReceipt {
+		t.Errorf("err = %v, want %v", err, consumer.ErrStaleReceipt)
+	}
+	if err := queue.Ack(ctx, redelivered); err != nil || queue.Len() != 0 {
+		t.Errorf("err = %v, len = %v, want no error, 0", err, queue.Len())
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := queue.Receive(cancelled); err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
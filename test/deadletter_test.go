@@ -0,0 +1,116 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/deadletter"
+	"cloud-design-patterns/pkg/stability/pipelinex"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID  int    `json:"id"`
+	SKU string `json:"sku"`
+}
+
+func TestDeadLetterPipelineStage(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	letters := make(chan deadletter.Letter, 10)
+	retry := stability.NewRetry(stability.RetrySettings{
+		Name: "TestDeadLetterPipelineStage", RetryThreshold: 2, ReturnRetryError: true, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return 0
+		},
+	})
+
+	resCnt, errCnt, _ := runStage(pipelinex.StageSettings{
+		Name: "orders", Policies: []stability.Policy{retry}, DeadLetter: deadletter.ChanSink(letters), Clock: clock,
+	}, failOn(3), 1, 2, 3, 4)
+	close(letters)
+
+	if resCnt != 3 || errCnt != 1 || len(letters) != 1 {
+		t.Fatalf("results, errors, letters = %v, %v, %v, want %v, %v, %v", resCnt, errCnt, len(letters), 3, 1, 1)
+	}
+	letter := <-letters
+	if letter.Name != "orders" || letter.Input != 3 || letter.Attempts != 3 || len(letter.Errors) != 3 || letter.Rejected {
+		t.Errorf("letter = %+v", letter)
+	}
+	if !errors.Is(letter.Err, intentionalErr) || !letter.FirstAttempt.Equal(clock.Now()) || !letter.Time.Equal(clock.Now()) {
+		t.Errorf("letter = %+v", letter)
+	}
+}
+
+func TestDeadLetterFileReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	sink, err := deadletter.NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := stability.ProcessFn(func(inObj interface{}) (interface{}, error) {
+		if inObj.(order).SKU == "" {
+			return nil, intentionalErr
+		}
+		return inObj, nil
+	})
+	clock := stabilitytest.NewFakeClock()
+	policy := deadletter.NewPolicy(deadletter.Settings{Name: "orders", Sink: sink, Clock: clock})
+	processFn := policy.GetProcessorFn(process)
+
+	for i, sku := range []string{"a", "", "", "b"} {
+		_, _ = processFn(order{ID: i, SKU: sku})
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	letters, err := deadletter.ReadFile(path, func(input json.RawMessage) (interface{}, error) {
+		var o order
+		err := json.Unmarshal(input, &o)
+		return o, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 2 || letters[0].Input != (order{ID: 1}) || letters[1].Error != intentionalErr.Error() {
+		t.Fatalf("letters = %+v", letters)
+	}
+
+	// The replay returns the letters which failed again
+	clock.Advance(time.Hour)
+	failed := policy.Replay(letters, func(inObj interface{}) (interface{}, error) {
+		o := inObj.(order)
+		if o.ID == 1 {
+			o.SKU = "fixed"
+		}
+		return process(o)
+	})
+	if len(failed) != 1 || failed[0].Input != (order{ID: 2}) || !failed[0].Time.Equal(clock.Now()) {
+		t.Errorf("failed = %+v", failed)
+	}
+}
+
+func TestDeadLetterSendError(t *testing.T) {
+	sinkErr := errors.New("sink is full")
+	var sendErrs []error
+	processFn := deadletter.NewPolicy(deadletter.Settings{
+		Name: "TestDeadLetterSendError",
+		Sink: deadletter.SinkFunc(func(letter deadletter.Letter) error {
+			return sinkErr
+		}),
+		OnSendError: func(letter deadletter.Letter, err error) {
+			sendErrs = append(sendErrs, err)
+		},
+	}).GetProcessorFn(failAfter(0))
+
+	if _, err := processFn(0); err != intentionalErr {
+		t.Errorf("err = %v, want %v", err, intentionalErr)
+	}
+	if len(sendErrs) != 1 || sendErrs[0] != sinkErr {
+		t.Errorf("send errors = %v, want [%v]", sendErrs, sinkErr)
+	}
+}
@@ -0,0 +1,228 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/election"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyLockStore fails while down is set and blocks while hang is set
+type flakyLockStore struct {
+	election.LockStore
+	down  bool
+	hang  chan struct{}
+	mutex sync.Mutex
+}
+
+func (s *flakyLockStore) setDown(down bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.down = down
+}
+
+func (s *flakyLockStore) setHang(hang chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hang = hang
+}
+
+func (s *flakyLockStore) Acquire(name, holder string, ttl time.Duration) (election.Lease, bool, error) {
+	s.mutex.Lock()
+	down, hang := s.down, s.hang
+	s.mutex.Unlock()
+	if hang != nil {
+		<-hang
+	}
+	if down {
+		return election.Lease{}, false, intentionalErr
+	}
+	return s.LockStore.Acquire(name, holder, ttl)
+}
+
+// newCandidate starts the campaign of id, sending "elected <token>" and "revoked" to events
+func newCandidate(id string, store election.LockStore, clock *stabilitytest.FakeClock, events chan string) (*election.Election, chan error) {
+	candidate := election.NewElection(election.Settings{
+		Name: "leader", ID: id, Store: store, TTL: 3 * time.Second, RenewInterval: time.Second, Clock: clock,
+		OnElected: func(token uint64) {
+			events <- fmt.Sprintf("elected %d", token)
+		},
+		OnRevoked: func() {
+			events <- "revoked"
+		},
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- candidate.Campaign(context.Background())
+	}()
+	return candidate, done
+}
+
+func expectEvent(t *testing.T, events chan string, want string) {
+	if event := <-events; event != want {
+		t.Errorf("event = %v, want %v", event, want)
+	}
+}
+
+func TestElectionResign(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := election.NewMemoryStore(clock)
+	aEvents, bEvents := make(chan string, 2), make(chan string, 2)
+
+	a, aDone := newCandidate("a", store, clock, aEvents)
+	expectEvent(t, aEvents, "elected 1")
+	b, bDone := newCandidate("b", store, clock, bEvents)
+	clock.BlockUntil(2)
+	if _, leader := b.Leader(); leader {
+		t.Error("b is the leader along with a")
+	}
+
+	// The resigned leader releases the lock, b takes it on its next try
+	a.Resign()
+	expectEvent(t, aEvents, "revoked")
+	if err := <-aDone; err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+	clock.Advance(time.Second)
+	expectEvent(t, bEvents, "elected 2")
+	if token, leader := b.Leader(); !leader || token != 2 {
+		t.Errorf("token, leader = %v, %v, want 2, true", token, leader)
+	}
+
+	b.Resign()
+	<-bDone
+}
+
+func TestElectionLeaseExpiry(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := election.NewMemoryStore(clock)
+	aStore := &flakyLockStore{LockStore: store}
+	aEvents, bEvents := make(chan string, 2), make(chan string, 2)
+
+	a, aDone := newCandidate("a", aStore, clock, aEvents)
+	expectEvent(t, aEvents, "elected 1")
+
+	// a can't renew, it stays the leader until the safety margin (RenewInterval)
+	// before its lease expires, then b takes over when it does
+	aStore.setDown(true)
+	b, bDone := newCandidate("b", store, clock, bEvents)
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	clock.BlockUntil(2)
+	if _, leader := a.Leader(); !leader {
+		t.Error("a revoked before the safety margin")
+	}
+	clock.Advance(time.Second)
+	expectEvent(t, aEvents, "revoked")
+	clock.BlockUntil(2)
+	if _, leader := b.Leader(); leader {
+		t.Error("b elected before the lease of a expired")
+	}
+	clock.Advance(time.Second)
+	expectEvent(t, bEvents, "elected 2")
+
+	a.Resign()
+	b.Resign()
+	<-aDone
+	<-bDone
+}
+
+func TestElectionStuckStore(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	aStore := &flakyLockStore{LockStore: election.NewMemoryStore(clock)}
+	aEvents := make(chan string, 2)
+
+	a, aDone := newCandidate("a", aStore, clock, aEvents)
+	expectEvent(t, aEvents, "elected 1")
+
+	// The renewal hangs, Leader turns false at the deadline anyway
+	hang := make(chan struct{})
+	aStore.setHang(hang)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if _, leader := a.Leader(); !leader {
+		t.Error("a isn't the leader before its deadline")
+	}
+	clock.Advance(time.Second)
+	if _, leader := a.Leader(); leader {
+		t.Error("a is the leader past its deadline")
+	}
+
+	close(hang)
+	expectEvent(t, aEvents, "revoked")
+	a.Resign()
+	<-aDone
+}
+
+func TestElectionRenewInterval(t *testing.T) {
+	// 6s is clamped to TTL/3, the renewal must come before the deadline
+	for _, renewInterval := range []time.Duration{4 * time.Second, 6 * time.Second, 10 * time.Second} {
+		clock := stabilitytest.NewFakeClock()
+		events := make(chan string, 100)
+		candidate := election.NewElection(election.Settings{
+			Name: "leader", ID: "a", Store: election.NewMemoryStore(clock), TTL: 10 * time.Second,
+			RenewInterval: renewInterval, Clock: clock,
+			OnElected: func(token uint64) {
+				events <- fmt.Sprintf("elected %d", token)
+			},
+			OnRevoked: func() {
+				events <- "revoked"
+			},
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- candidate.Campaign(context.Background())
+		}()
+
+		expectEvent(t, events, "elected 1")
+		for i := 0; i < 60; i++ {
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+			if _, leader := candidate.Leader(); !leader {
+				t.Errorf("renew interval %v: not the leader after %v", renewInterval, time.Duration(i+1)*time.Second)
+			}
+		}
+		clock.BlockUntil(1)
+		if len(events) != 0 {
+			t.Errorf("renew interval %v: %v more events, want none", renewInterval, len(events))
+		}
+
+		candidate.Resign()
+		<-done
+	}
+}
+
+func TestElectionFileStore(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	dir := t.TempDir()
+	// Two stores on the directory stand for two processes
+	first, err := election.NewFileStore(dir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := election.NewFileStore(dir, clock)
+
+	if lease, ok, err := first.Acquire("job", "a", 3*time.Second); !ok || err != nil || lease.Token != 1 {
+		t.Errorf("lease, ok, err = %+v, %v, %v, want token 1", lease, ok, err)
+	}
+	if lease, ok, _ := second.Acquire("job", "b", 3*time.Second); ok || lease.Holder != "a" {
+		t.Errorf("lease, ok = %+v, %v, want held by a", lease, ok)
+	}
+
+	_ = first.Release("job", "a")
+	if lease, ok, _ := second.Acquire("job", "b", 3*time.Second); !ok || lease.Token != 2 {
+		t.Errorf("lease, ok = %+v, %v, want token 2", lease, ok)
+	}
+	clock.Advance(time.Second)
+	if lease, ok, _ := second.Acquire("job", "b", 3*time.Second); !ok || lease.Token != 2 {
+		t.Errorf("renewed lease, ok = %+v, %v, want token 2", lease, ok)
+	}
+
+	clock.Advance(3 * time.Second)
+	if lease, ok, _ := first.Acquire("job", "a", 3*time.Second); !ok || lease.Token != 3 {
+		t.Errorf("lease, ok = %+v, %v, want the expired lock taken with token 3", lease, ok)
+	}
+}
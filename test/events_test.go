@@ -0,0 +1,101 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"testing"
+	"time"
+)
+
+func TestBreakerEvents(t *testing.T) {
+	bus := stability.NewEventBus()
+	events := make(chan stability.Event, 100)
+	unsubscribe := bus.SubscribeChan(events, stability.ByName("TestBreakerEvents"))
+	defer unsubscribe()
+
+	breakerSettings := stability.BreakerSettings{
+		Name: "TestBreakerEvents", FailureThreshold: 2, EventBus: bus,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Millisecond * time.Duration(100)
+		},
+	}
+
+	processorFn := stability.NewBreaker(breakerSettings).GetProcessorFn(failAfter(0))
+
+	// 2 failures open the breaker, next 3 calls are rejected
+	for i := 0; i < 5; i++ {
+		_, _ = processorFn(i)
+	}
+	// After expiry the trial call fails and opens the breaker again
+	time.Sleep(time.Millisecond * time.Duration(150))
+	_, _ = processorFn(0)
+
+	got := map[stability.EventType]int{}
+	for len(events) > 0 {
+		e := <-events
+		if e.Name != "TestBreakerEvents" || e.Time.IsZero() {
+			t.Errorf("unexpected event %+v", e)
+		}
+		got[e.Type]++
+	}
+
+	want := map[stability.EventType]int{
+		stability.BreakerOpened:     2,
+		stability.CallRejected:      3,
+		stability.BreakerHalfOpened: 1,
+	}
+	for eventType, cnt := range want {
+		if got[eventType] != cnt {
+			t.Errorf("%v events = %v, want %v", eventType, got[eventType], cnt)
+		}
+	}
+}
+
+func TestEventBusFilters(t *testing.T) {
+	bus := stability.NewEventBus()
+
+	var scheduled, exhausted, other int
+	bus.Subscribe(func(e stability.Event) {
+		switch e.Type {
+		case stability.RetryScheduled:
+			scheduled++
+		case stability.RetryExhausted:
+			exhausted++
+		}
+	}, stability.ByName("TestEventBusFilters"), stability.ByType(stability.RetryScheduled, stability.RetryExhausted))
+	unsubscribe := bus.Subscribe(func(e stability.Event) {
+		other++
+	}, stability.ByName("SomeOtherPolicy"))
+
+	retrySettings := stability.RetrySettings{
+		Name: "TestEventBusFilters", RetryThreshold: 2, EventBus: bus,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Millisecond
+		},
+	}
+	processorFn := stability.NewRetry(retrySettings).GetProcessorFn(failAfter(0))
+	if _, err := processorFn(0); err == nil {
+		t.Error("expected err; got none")
+	}
+	unsubscribe()
+
+	if scheduled != 2 {
+		t.Errorf("scheduled = %v, want %v", scheduled, 2)
+	}
+	if exhausted != 1 {
+		t.Errorf("exhausted = %v, want %v", exhausted, 1)
+	}
+	if other != 0 {
+		t.Errorf("other = %v, want %v", other, 0)
+	}
+
+	throttleSettings := stability.ThrottleSettings{
+		Name: "SomeOtherPolicy", MaxTokens: 1, EventBus: bus,
+	}
+	throttleFn := stability.NewThrottle(throttleSettings).GetProcessorFn(failAfter(10))
+	_, _ = throttleFn(0)
+	_, _ = throttleFn(0)
+
+	if other != 0 {
+		t.Errorf("other after unsubscribe = %v, want %v", other, 0)
+	}
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/health"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveReport calls the handler and decodes its report
+func serveReport(t *testing.T, handler http.Handler) (int, health.Report) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	var report health.Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestHealthBreaker(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	breaker := stability.NewBreaker(stability.BreakerSettings{
+		Name: "payments", FailureThreshold: 1, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Hour
+		},
+	})
+	checker := health.NewChecker(health.Settings{Clock: clock})
+	checker.Register(health.BreakerCheck(breaker, true))
+	checker.Register(health.Check{Name: "process", Liveness: true, Probe: func(context.Context) error {
+		return nil
+	}})
+
+	if code, report := serveReport(t, checker.ReadinessHandler()); code != http.StatusOK || report.Status != health.StatusUp {
+		t.Errorf("code, report = %v, %+v, want ready", code, report)
+	}
+
+	// The open breaker turns the readiness down, the liveness doesn't check it
+	_, _ = breaker.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		return nil, intentionalErr
+	})(0)
+	clock.Advance(time.Second) // CacheTTL
+	code, report := serveReport(t, checker.ReadinessHandler())
+	if code != http.StatusServiceUnavailable || report.Status != health.StatusDown {
+		t.Errorf("code, status = %v, %v, want not ready", code, report.Status)
+	}
+	if result := report.Checks[0]; result.Name != "breaker:payments" || result.Error != stability.ErrOpenState.Error() {
+		t.Errorf("result = %+v, want the open breaker", result)
+	}
+	if code, report := serveReport(t, checker.LivenessHandler()); code != http.StatusOK || len(report.Checks) != 1 {
+		t.Errorf("code, report = %v, %+v, want live", code, report)
+	}
+}
+
+func TestHealthThrottleSaturation(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{Name: "api", MaxTokens: 1, RefillInterval: time.Hour, Clock: clock})
+	checker := health.NewChecker(health.Settings{Clock: clock})
+	checker.Register(health.ThrottleCheck(throttle, 5*time.Second, true))
+
+	throttle.Take()
+	throttle.Take()
+	clock.Advance(5 * time.Second)
+	if report := checker.Readiness(context.Background()); report.Status != health.StatusUp {
+		t.Errorf("report = %+v, want up at the saturation limit", report)
+	}
+	clock.Advance(time.Second)
+	if report := checker.Readiness(context.Background()); report.Status != health.StatusDown {
+		t.Errorf("report = %+v, want down", report)
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	probes := 0
+	checker := health.NewChecker(health.Settings{CacheTTL: time.Second, Clock: clock})
+	checker.Register(health.Check{Name: "db", Probe: func(context.Context) error {
+		probes++
+		return intentionalErr
+	}})
+
+	// A failed non-critical check is reported only
+	report := checker.Readiness(context.Background())
+	if report.Status != health.StatusUp || report.Checks[0].Status != health.StatusDown {
+		t.Errorf("report = %+v, want up with db down", report)
+	}
+	checker.Readiness(context.Background())
+	if probes != 1 {
+		t.Errorf("probes = %v, want the cached result", probes)
+	}
+	clock.Advance(time.Second)
+	checker.Readiness(context.Background())
+	if probes != 2 {
+		t.Errorf("probes = %v, want 2 after the CacheTTL", probes)
+	}
+}
+
+func TestHealthCheckTimeout(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	cancelled := make(chan error, 1)
+	checker := health.NewChecker(health.Settings{Clock: clock})
+	checker.Register(health.Check{Name: "hung", Critical: true, Timeout: time.Second, Probe: func(ctx context.Context) error {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return ctx.Err()
+	}})
+
+	done := make(chan health.Report)
+	go func() {
+		done <- checker.Readiness(context.Background())
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	report := <-done
+	if report.Status != health.StatusDown || report.Checks[0].Error != health.ErrCheckTimeout.Error() {
+		t.Errorf("report = %+v, want timed out", report)
+	}
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want the probe cancelled", err)
+	}
+}
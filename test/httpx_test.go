@@ -0,0 +1,348 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/httpx"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first failCnt requests with the status
+func flakyServer(t *testing.T, failCnt int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if atomic.AddInt32(&calls, 1) <= failCnt {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte("failed " + string(body)))
+			return
+		}
+		_, _ = w.Write([]byte("ok " + string(body)))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func fastRetry() *stability.RetrySettings {
+	return &stability.RetrySettings{
+		RetryThreshold: 3,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Millisecond
+		},
+	}
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestTransportRetriesWithBody(t *testing.T) {
+	server, calls := flakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	client := &http.Client{Transport: httpx.NewTransport(httpx.TransportSettings{
+		Name: "TestTransportRetriesWithBody", Retry: fastRetry(),
+	})}
+
+	// POST is not idempotent, the 503 is returned as is
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); res.StatusCode != http.StatusServiceUnavailable || body != "failed payload" {
+		t.Errorf("POST res = %v %q, want 503 %q", res.Status, body, "failed payload")
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("POST calls = %v, want %v", got, 1)
+	}
+
+	// Idempotency-Key makes the POST retryable, every attempt gets the whole body
+	req, _ := http.NewRequest(http.MethodPost, server.URL, io.MultiReader(strings.NewReader("pay"), strings.NewReader("load")))
+	req.Header.Set("Idempotency-Key", "key1")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); res.StatusCode != http.StatusOK || body != "ok payload" {
+		t.Errorf("res = %v %q, want 200 %q", res.Status, body, "ok payload")
+	}
+	if got := atomic.LoadInt32(calls); got != 3 {
+		t.Errorf("calls = %v, want %v", got, 3)
+	}
+}
+
+func TestTransportHonoursRetryAfter(t *testing.T) {
+	server, calls := flakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"2"}})
+	clock := stabilitytest.NewFakeClock()
+	retry := fastRetry()
+	retry.Clock = clock
+	client := &http.Client{Transport: httpx.NewTransport(httpx.TransportSettings{
+		Name: "TestTransportHonoursRetryAfter", Retry: retry,
+	})}
+
+	done := make(chan *http.Response)
+	go func() {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- res
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("calls before Retry-After = %v, want %v", got, 1)
+	}
+	clock.Advance(time.Second)
+
+	if res := <-done; res == nil || res.StatusCode != http.StatusOK {
+		t.Errorf("res = %v, want %v", res, http.StatusOK)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Errorf("calls = %v, want %v", got, 2)
+	}
+}
+
+func TestTransportCapsRetryAfter(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	// The date is read on the Retry clock
+	retryAt := clock.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	server, calls := flakyServer(t, 1, http.StatusServiceUnavailable, http.Header{"Retry-After": {retryAt}})
+	retry := fastRetry()
+	retry.Clock = clock
+	client := &http.Client{Transport: httpx.NewTransport(httpx.TransportSettings{
+		Name: "TestTransportCapsRetryAfter", Retry: retry, MaxRetryAfter: 2 * time.Second,
+	})}
+
+	done := make(chan *http.Response)
+	go func() {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- res
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Errorf("calls before MaxRetryAfter = %v, want %v", got, 1)
+	}
+	clock.Advance(time.Second)
+	if res := <-done; res == nil || res.StatusCode != http.StatusOK {
+		t.Errorf("res = %v, want %v", res, http.StatusOK)
+	}
+}
+
+func TestTransportMaxKeys(t *testing.T) {
+	server, _ := flakyServer(t, 1, http.StatusInternalServerError, nil)
+	transport := httpx.NewTransport(httpx.TransportSettings{
+		Name: "TestTransportMaxKeys", KeyFn: httpx.ByRoute, MaxKeys: 2,
+		Breaker: &stability.BreakerSettings{
+			FailureThreshold: 1,
+			ExpiryFn: func(tryCnt int) time.Duration {
+				return time.Minute
+			},
+		},
+	})
+	client := &http.Client{Transport: transport}
+	get := func(path string) error {
+		res, err := client.Get(server.URL + path)
+		if err == nil {
+			_ = res.Body.Close()
+		}
+		return err
+	}
+
+	// The open breaker of /a outlives the less recently used /b
+	_ = get("/a")
+	for _, path := range []string{"/b", "/c"} {
+		if err := get(path); err != nil {
+			t.Errorf("%s: expected no error; got %v", path, err)
+		}
+	}
+	if transport.Len() != 2 {
+		t.Errorf("Len = %v, want %v", transport.Len(), 2)
+	}
+	if err := get("/a"); !errors.Is(err, stability.ErrOpenState) {
+		t.Errorf("err = %v, want %v", err, stability.ErrOpenState)
+	}
+}
+
+func TestTransportBreakerPerHost(t *testing.T) {
+	failing, failingCalls := flakyServer(t, 100, http.StatusInternalServerError, nil)
+	healthy, _ := flakyServer(t, 0, http.StatusOK, nil)
+	client := &http.Client{Transport: httpx.NewTransport(httpx.TransportSettings{
+		Name: "TestTransportBreakerPerHost",
+		Breaker: &stability.BreakerSettings{
+			FailureThreshold: 2,
+			ExpiryFn: func(tryCnt int) time.Duration {
+				return time.Minute
+			},
+		},
+	})}
+
+	for i := 0; i < 5; i++ {
+		res, err := client.Get(failing.URL)
+		switch {
+		case i < 2 && (err != nil || res.StatusCode != http.StatusInternalServerError):
+			t.Errorf("call %d: expected 500; got %v %v", i, res, err)
+		case i >= 2 && err == nil:
+			t.Errorf("call %d: expected open breaker err; got none", i)
+		}
+		if res != nil {
+			_ = res.Body.Close()
+		}
+	}
+	if got := atomic.LoadInt32(failingCalls); got != 2 {
+		t.Errorf("failing calls = %v, want %v", got, 2)
+	}
+
+	res, err := client.Get(healthy.URL)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("healthy host: expected 200; got %v %v", res, err)
+	} else {
+		_ = res.Body.Close()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"120":                           2 * time.Minute,
+		"Fri, 01 Jan 2021 00:00:30 GMT": 30 * time.Second,
+		"Thu, 31 Dec 2020 23:00:00 GMT": 0,
+	} {
+		if got, ok := httpx.ParseRetryAfter(value, now); !ok || got != want {
+			t.Errorf("ParseRetryAfter(%q) = %v %v, want %v", value, got, ok, want)
+		}
+	}
+	if _, ok := httpx.ParseRetryAfter("soon", now); ok {
+		t.Error("expected ParseRetryAfter to fail")
+	}
+}
+
+func TestRateLimiterPerKey(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	limiter := httpx.NewRateLimiter(httpx.RateLimiterSettings{
+		Name:  "TestRateLimiterPerKey",
+		KeyFn: httpx.ByHeader("X-API-Key"),
+		Throttle: stability.ThrottleSettings{
+			MaxTokens: 2, RefillTokensCnt: 2, RefillInterval: 10 * time.Second,
+		},
+		IdleTTL: time.Minute,
+		Clock:   clock,
+	})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	serve := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve("tenant1"); rec.Code != http.StatusOK {
+			t.Errorf("call %d: code = %v, want %v", i, rec.Code, http.StatusOK)
+		}
+	}
+
+	clock.Advance(3 * time.Second)
+	rec := serve("tenant1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("code = %v, want %v", rec.Code, http.StatusTooManyRequests)
+	}
+	for header, want := range map[string]string{
+		"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Reset": "7", "Retry-After": "7",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Another key has its own bucket
+	if rec := serve("tenant2"); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Errorf("tenant2: code = %v, remaining = %v", rec.Code, rec.Header().Get("RateLimit-Remaining"))
+	}
+
+	// Evicted key starts over
+	limiter.Evict("tenant1")
+	if rec := serve("tenant1"); rec.Code != http.StatusOK {
+		t.Errorf("after Evict: code = %v, want %v", rec.Code, http.StatusOK)
+	}
+
+	// Idle keys are swept
+	clock.Advance(2 * time.Minute)
+	serve("tenant3")
+	if limiter.Len() != 1 {
+		t.Errorf("Len = %v, want %v", limiter.Len(), 1)
+	}
+}
+
+func TestRateLimiterLeakyBucket(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	limiter := httpx.NewRateLimiter(httpx.RateLimiterSettings{
+		Name: "TestRateLimiterLeakyBucket",
+		Throttle: stability.ThrottleSettings{
+			Algorithm: stability.LeakyBucket, MaxTokens: 5, RefillTokensCnt: 1, RefillInterval: time.Second,
+		},
+		Clock: clock,
+	})
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	serve := func(ctx context.Context) chan int {
+		codes := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+			codes <- rec.Code
+		}()
+		return codes
+	}
+
+	if code := <-serve(context.Background()); code != http.StatusOK {
+		t.Errorf("code = %v, want %v", code, http.StatusOK)
+	}
+
+	// The queued requests wait for their turn, the one which goes away gives it back
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := serve(ctx)
+	clock.BlockUntil(1)
+	queued := serve(context.Background())
+	clock.BlockUntil(2)
+	cancel()
+	if code := <-gone; code != http.StatusTooManyRequests {
+		t.Errorf("gone: code = %v, want %v", code, http.StatusTooManyRequests)
+	}
+	clock.Advance(time.Second)
+	select {
+	case code := <-queued:
+		t.Errorf("queued: code = %v before its turn", code)
+	default:
+	}
+	clock.Advance(time.Second)
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("queued: code = %v, want %v", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,209 @@
+package test
+
+import (
+	"bytes"
+	"cloud-design-patterns/pkg/consumer"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"testing"
+	"time"
+)
+
+// heartbeatStore signals the CompareAndSet calls keeping a value
+type heartbeatStore struct {
+	stability.StateStore
+	extended chan struct{}
+}
+
+func (s *heartbeatStore) CompareAndSet(key string, old, value []byte, ttl time.Duration) (bool, error) {
+	stored, err := s.StateStore.CompareAndSet(key, old, value, ttl)
+	if old != nil && bytes.Equal(old, value) {
+		s.extended <- struct{}{}
+	}
+	return stored, err
+}
+
+func TestIdempotent(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	for name, store := range map[string]stability.StateStore{
+		"memory": stability.NewMemoryStore(clock),
+		"redis":  newRedisStore(t, clock),
+	} {
+		fn := &countingFn{}
+		charge := stability.NewIdempotent(stability.IdempotentSettings{
+			Name: "TestIdempotent", Store: store, TTL: time.Hour, Clock: clock,
+		}).GetProcessorFn(fn.process)
+
+		// A failed call isn't stored, so the retry runs
+		fn.setErr(intentionalErr)
+		if _, err := charge("order-1"); err != intentionalErr {
+			t.Errorf("%v: err = %v, want %v", name, err, intentionalErr)
+		}
+		fn.setErr(nil)
+
+		for i := 0; i < 3; i++ {
+			if res, err := charge("order-1"); res != "order-1:2" || err != nil {
+				t.Errorf("%v: res = %v %v, want %v", name, res, err, "order-1:2")
+			}
+		}
+		if res, _ := charge("order-2"); res != "order-2:3" {
+			t.Errorf("%v: res = %v, want %v", name, res, "order-2:3")
+		}
+
+		clock.Advance(time.Hour)
+		if res, _ := charge("order-1"); res != "order-1:4" {
+			t.Errorf("%v: res = %v after TTL, want %v", name, res, "order-1:4")
+		}
+	}
+}
+
+func TestIdempotentDefaultKey(t *testing.T) {
+	calls := 0
+	charge := stability.NewIdempotent(stability.IdempotentSettings{
+		Name: "TestIdempotentDefaultKey",
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		calls++
+		return calls, nil
+	})
+
+	// The redeliveries of a message and the calls bound to other contexts share the key
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, inObj := range []interface{}{
+		&consumer.Message{ID: "1", Attempt: 1, Receipt: "1"},
+		&consumer.Message{ID: "1", Attempt: 2, Receipt: "2"},
+		stability.WithContext(context.Background(), "order-1"),
+		stability.WithContext(ctx, "order-1"),
+	} {
+		_, _ = charge(inObj)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %v, want %v", calls, 2)
+	}
+
+	// An input object without a key isn't deduplicated
+	_, _ = charge(42)
+	_, _ = charge(42)
+	if calls != 4 {
+		t.Errorf("calls = %v, want %v", calls, 4)
+	}
+}
+
+func TestIdempotentDuplicateInProgress(t *testing.T) {
+	for _, mode := range []stability.DuplicateMode{stability.DuplicateReject, stability.DuplicateWait} {
+		clock := stabilitytest.NewFakeClock()
+		started := make(chan struct{})
+		release := make(chan struct{})
+		fn := &countingFn{}
+		charge := stability.NewIdempotent(stability.IdempotentSettings{
+			Name: "TestIdempotentDuplicateInProgress", OnDuplicate: mode, PollInterval: time.Second, Clock: clock,
+		}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return fn.process(inObj)
+		})
+
+		first := make(chan interface{})
+		go func() {
+			res, _ := charge("order-1")
+			first <- res
+		}()
+		<-started
+
+		if mode == stability.DuplicateReject {
+			if _, err := charge("order-1"); err != stability.ErrInProgress {
+				t.Errorf("err = %v, want %v", err, stability.ErrInProgress)
+			}
+			close(release)
+			<-first
+			continue
+		}
+
+		// The duplicate polls the store until the first call stores its result
+		duplicate := make(chan interface{})
+		go func() {
+			res, _ := charge("order-1")
+			duplicate <- res
+		}()
+		// The marker heartbeat of the first call and the poll of the duplicate
+		clock.BlockUntil(2)
+		close(release)
+		if res := <-first; res != "order-1:1" {
+			t.Errorf("res = %v, want %v", res, "order-1:1")
+		}
+		clock.Advance(time.Second)
+		if res := <-duplicate; res != "order-1:1" {
+			t.Errorf("duplicate res = %v, want %v", res, "order-1:1")
+		}
+		if fn.callCnt() != 1 {
+			t.Errorf("calls = %v, want %v", fn.callCnt(), 1)
+		}
+	}
+}
+
+func TestIdempotentLongCall(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := &heartbeatStore{StateStore: stability.NewMemoryStore(clock), extended: make(chan struct{})}
+	release := make(chan struct{})
+	fn := &countingFn{}
+	charge := stability.NewIdempotent(stability.IdempotentSettings{
+		Name: "TestIdempotentLongCall", Store: store, PendingTTL: 30 * time.Second,
+		OnDuplicate: stability.DuplicateReject, Clock: clock,
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		<-release
+		return fn.process(inObj)
+	})
+
+	first := make(chan interface{})
+	go func() {
+		res, _ := charge("order-1")
+		first <- res
+	}()
+
+	// The marker of the running call outlives the PendingTTL
+	clock.BlockUntil(1)
+	for i := 0; i < 6; i++ {
+		clock.Advance(10 * time.Second)
+		<-store.extended
+	}
+	if _, err := charge("order-1"); err != stability.ErrInProgress {
+		t.Errorf("err = %v, want %v", err, stability.ErrInProgress)
+	}
+
+	close(release)
+	if res := <-first; res != "order-1:1" {
+		t.Errorf("res = %v, want %v", res, "order-1:1")
+	}
+	if res, _ := charge("order-1"); res != "order-1:1" || fn.callCnt() != 1 {
+		t.Errorf("res = %v, calls = %v, want order-1:1 run once", res, fn.callCnt())
+	}
+}
+
+func TestIdempotentLostMarker(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := stability.NewMemoryStore(clock)
+	release := make(chan struct{})
+	charge := stability.NewIdempotent(stability.IdempotentSettings{
+		Name: "TestIdempotentLostMarker", Store: store, Clock: clock,
+	}).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		<-release
+		return nil, intentionalErr
+	})
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = charge("order-1")
+		close(done)
+	}()
+	clock.BlockUntil(1)
+
+	// Another owner's value isn't touched by the failed call
+	key := "idempotent:TestIdempotentLostMarker:order-1"
+	_ = store.Set(key, []byte("r\"theirs\""), time.Hour)
+	close(release)
+	<-done
+	if value, _, _ := store.Get(key); string(value) != "r\"theirs\"" {
+		t.Errorf("value = %q, want the other result kept", value)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type loginAttempt struct {
+	account string
+}
+
+func TestKeyedThrottleLoginAttempts(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewKeyedThrottle(stability.KeyedThrottleSettings{
+		Name: "TestKeyedThrottleLoginAttempts",
+		KeyFn: func(inObj interface{}) string {
+			return inObj.(loginAttempt).account
+		},
+		Throttle: stability.ThrottleSettings{
+			MaxTokens: 3, RefillTokensCnt: 3, RefillInterval: 24 * time.Hour,
+		},
+		Overrides: map[string]stability.ThrottleSettings{
+			"admin": {MaxTokens: 1, RefillTokensCnt: 1, RefillInterval: 24 * time.Hour},
+		},
+		Clock: clock,
+	})
+	processorFn := throttle.GetProcessorFn(echo)
+
+	allowed := map[string]int{}
+	for i := 0; i < 5; i++ {
+		for _, account := range []string{"alice", "bob", "admin"} {
+			if _, err := processorFn(loginAttempt{account: account}); err == nil {
+				allowed[account]++
+			} else if err != stability.ErrTooManyCalls {
+				t.Errorf("err = %v, want %v", err, stability.ErrTooManyCalls)
+			}
+		}
+	}
+
+	want := map[string]int{"alice": 3, "bob": 3, "admin": 1}
+	for account, cnt := range want {
+		if allowed[account] != cnt {
+			t.Errorf("%s allowed = %v, want %v", account, allowed[account], cnt)
+		}
+	}
+
+	clock.Advance(24 * time.Hour)
+	if _, err := processorFn(loginAttempt{account: "alice"}); err != nil {
+		t.Error("expected no error after refill; got", err)
+	}
+}
+
+func TestKeyedThrottleEviction(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewKeyedThrottle(stability.KeyedThrottleSettings{
+		Name:     "TestKeyedThrottleEviction",
+		Throttle: stability.ThrottleSettings{MaxTokens: 1, RefillInterval: time.Minute},
+		MaxKeys:  100,
+		Clock:    clock,
+	})
+
+	for i := 0; i < 100; i++ {
+		throttle.Take(fmt.Sprintf("key%d", i))
+	}
+
+	// The exhausted buckets aren't evicted, a new key waits for one to refill
+	if status := throttle.Take("key100"); status.Allowed || status.Reset != time.Minute {
+		t.Errorf("status = %+v, want rejected for %v", status, time.Minute)
+	}
+	if status := throttle.Take("key0"); status.Allowed {
+		t.Error("expected the exhausted key to stay throttled")
+	}
+	if throttle.Len() != 100 {
+		t.Errorf("Len = %v, want %v", throttle.Len(), 100)
+	}
+
+	// Without IdleTTL the keys are evicted once refilled
+	clock.Advance(time.Minute)
+	if status := throttle.Take("fresh"); !status.Allowed {
+		t.Error("expected a new key to be allowed after the refill")
+	}
+	if throttle.Len() != 1 {
+		t.Errorf("Len after the refill = %v, want %v", throttle.Len(), 1)
+	}
+}
+
+func TestKeyedThrottleIdleTTL(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewKeyedThrottle(stability.KeyedThrottleSettings{
+		Name:     "TestKeyedThrottleIdleTTL",
+		Throttle: stability.ThrottleSettings{MaxTokens: 1, RefillInterval: time.Minute},
+		Overrides: map[string]stability.ThrottleSettings{
+			"slow": {MaxTokens: 1, RefillInterval: time.Hour},
+		},
+		MaxKeys: 2,
+		IdleTTL: 10 * time.Minute,
+		Clock:   clock,
+	})
+
+	throttle.Take("slow")
+	throttle.Take("a")
+	clock.Advance(time.Minute)
+
+	// Over MaxKeys the refilled key is evicted, not the least recently used one
+	if status := throttle.Take("b"); !status.Allowed {
+		t.Error("expected b to be allowed")
+	}
+	if status := throttle.Take("slow"); status.Allowed {
+		t.Error("expected slow to stay throttled")
+	}
+
+	// IdleTTL longer than the refill keeps the idle keys, the override's refill is longer still
+	clock.Advance(8 * time.Minute)
+	throttle.Take("b")
+	if throttle.Len() != 2 {
+		t.Errorf("Len = %v, want %v", throttle.Len(), 2)
+	}
+	clock.Advance(10 * time.Minute)
+	throttle.Take("b")
+	if throttle.Len() != 2 {
+		t.Errorf("Len = %v, want %v with slow still refilling", throttle.Len(), 2)
+	}
+	clock.Advance(time.Hour)
+	throttle.Take("c")
+	if throttle.Len() != 1 {
+		t.Errorf("Len = %v, want %v", throttle.Len(), 1)
+	}
+}
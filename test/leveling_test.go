@@ -0,0 +1,162 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/leveling"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForStats polls the queue stats until cond holds
+func waitForStats(t *testing.T, queue *leveling.Queue, cond func(stats leveling.Stats) bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond(queue.Stats()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats = %+v", queue.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLevelingOverflow(t *testing.T) {
+	for _, overflow := range []leveling.Overflow{leveling.RejectNew, leveling.DropOldest, leveling.Block} {
+		release := make(chan struct{})
+		var dropped []interface{}
+		queue := leveling.NewQueue(func(inObj interface{}) (interface{}, error) {
+			<-release
+			return inObj, nil
+		}, leveling.Settings{
+			Name: "TestLevelingOverflow", Capacity: 2, Overflow: overflow,
+			OnDrop: func(inObj interface{}) {
+				dropped = append(dropped, inObj)
+			},
+		})
+
+		// The worker holds "a", "b" and "c" fill the queue
+		_ = queue.Put("a")
+		waitForStats(t, queue, func(stats leveling.Stats) bool { return stats.Depth == 0 })
+		_ = queue.Put("b")
+		_ = queue.Put("c")
+
+		switch overflow {
+		case leveling.RejectNew:
+			if err := queue.Put("d"); err != leveling.ErrQueueFull {
+				t.Errorf("err = %v, want %v", err, leveling.ErrQueueFull)
+			}
+		case leveling.DropOldest:
+			if err := queue.Put("d"); err != nil || len(dropped) != 1 || dropped[0] != "b" {
+				t.Errorf("err = %v, dropped = %v, want no error, [b]", err, dropped)
+			}
+		case leveling.Block:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			if err := queue.Put(stability.WithContext(ctx, "d")); err != context.DeadlineExceeded {
+				t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+			}
+			cancel()
+
+			done := make(chan error)
+			go func() {
+				done <- queue.Put("e")
+			}()
+			close(release)
+			if err := <-done; err != nil {
+				t.Error("expected no error; got", err)
+			}
+		}
+
+		if overflow != leveling.Block {
+			close(release)
+		}
+		queue.Stop()
+
+		// Block processes "e" after the rejected "d"
+		wantProcessed := map[leveling.Overflow]uint64{leveling.RejectNew: 3, leveling.DropOldest: 3, leveling.Block: 4}[overflow]
+		if stats := queue.Stats(); stats.Depth != 0 || stats.Processed != wantProcessed || stats.Enqueued+stats.Rejected != wantProcessed+1 {
+			t.Errorf("overflow %v: stats = %+v", overflow, stats)
+		}
+		if err := queue.Put("f"); err != leveling.ErrStopped {
+			t.Errorf("err = %v, want %v", err, leveling.ErrStopped)
+		}
+	}
+}
+
+func TestLevelingDropAndPanic(t *testing.T) {
+	release := make(chan struct{})
+	errs := make(chan error, 1)
+	var droppedCnt uint64
+	var queue *leveling.Queue
+	queue = leveling.NewQueue(func(inObj interface{}) (interface{}, error) {
+		if inObj == "boom" {
+			panic(intentionalErr)
+		}
+		<-release
+		return inObj, nil
+	}, leveling.Settings{
+		Name: "TestLevelingDropAndPanic", Capacity: 1, Overflow: leveling.DropOldest,
+		OnDrop: func(inObj interface{}) {
+			// The queue may be used from OnDrop
+			droppedCnt = queue.Stats().Dropped
+		},
+		OnError: func(inObj interface{}, err error) {
+			errs <- err
+		},
+	})
+
+	// The worker survives the panic
+	_ = queue.Put("boom")
+	var panicErr *stability.PanicError
+	if err := <-errs; !errors.As(err, &panicErr) || !errors.Is(err, intentionalErr) {
+		t.Errorf("err = %v, want a panic of %v", err, intentionalErr)
+	}
+
+	_ = queue.Put("hold")
+	waitForStats(t, queue, func(stats leveling.Stats) bool { return stats.Depth == 0 })
+	_ = queue.Put("x")
+	_ = queue.Put("y")
+	if droppedCnt != 1 {
+		t.Errorf("dropped = %v, want %v", droppedCnt, 1)
+	}
+
+	close(release)
+	queue.Stop()
+	if stats := queue.Stats(); stats.Processed != 3 || stats.Failed != 1 {
+		t.Errorf("stats = %+v, want 3 processed, 1 failed", stats)
+	}
+}
+
+func TestLevelingThrottledWorkers(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestLevelingThrottledWorkers", MaxTokens: 2, RefillTokensCnt: 2, RefillInterval: time.Second, Clock: clock,
+	})
+	var failed []interface{}
+	queue := leveling.NewQueue(failOn(6), leveling.Settings{
+		Name: "TestLevelingThrottledWorkers", Workers: 3, Throttle: throttle, Clock: clock,
+		OnError: func(inObj interface{}, err error) {
+			failed = append(failed, inObj)
+		},
+	})
+
+	// A burst of 6 items is drained at 2 per second
+	for i := 1; i <= 6; i++ {
+		if err := queue.Put(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for processed := uint64(2); processed <= 6; processed += 2 {
+		waitForStats(t, queue, func(stats leveling.Stats) bool { return stats.Processed == processed })
+		if processed < 6 {
+			clock.BlockUntil(1)
+			clock.Advance(time.Second)
+		}
+	}
+	queue.Stop()
+
+	stats := queue.Stats()
+	if stats.MaxWait != 2*time.Second || stats.AvgWait != time.Second || stats.Failed != 1 || len(failed) != 1 || failed[0] != 6 {
+		t.Errorf("stats = %+v, failed = %v", stats, failed)
+	}
+}
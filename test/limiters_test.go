@@ -0,0 +1,163 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// allowedAt takes from the throttle at the given offsets and counts the allowed calls
+func allowedAt(clock *stabilitytest.FakeClock, throttle *stability.Throttle, offsets ...time.Duration) int {
+	start := clock.Now()
+	allowed := 0
+	for _, offset := range offsets {
+		clock.Set(start.Add(offset))
+		if throttle.Take().Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func newAlgorithmThrottle(clock *stabilitytest.FakeClock, algorithm stability.ThrottleAlgorithm) *stability.Throttle {
+	return stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestThrottleAlgorithms", Algorithm: algorithm, Clock: clock,
+		MaxTokens: 10, RefillTokensCnt: 10, RefillInterval: time.Minute,
+	})
+}
+
+func TestThrottleAlgorithmsBoundaryBurst(t *testing.T) {
+	// 10 calls at the end of a minute and 10 right after the boundary
+	var offsets []time.Duration
+	for i := 0; i < 10; i++ {
+		offsets = append(offsets, 59*time.Second)
+	}
+	for i := 0; i < 10; i++ {
+		offsets = append(offsets, 61*time.Second)
+	}
+
+	want := map[stability.ThrottleAlgorithm]int{
+		stability.FixedWindow:          20, // bursts at the boundary
+		stability.SlidingWindowLog:     10, // exactly 10 per rolling minute
+		stability.SlidingWindowCounter: 10,
+		stability.GCRA:                 10,
+	}
+	for algorithm, wantAllowed := range want {
+		clock := stabilitytest.NewFakeClock()
+		if got := allowedAt(clock, newAlgorithmThrottle(clock, algorithm), offsets...); got != wantAllowed {
+			t.Errorf("algorithm %v: allowed = %v, want %v", algorithm, got, wantAllowed)
+		}
+	}
+}
+
+func TestSlidingWindowLogRolling(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := newAlgorithmThrottle(clock, stability.SlidingWindowLog)
+
+	// 5 calls at 0s and 5 at 30s use the quota
+	if got := allowedAt(clock, throttle, 0, 0, 0, 0, 0, 30*time.Second, 30*time.Second, 30*time.Second, 30*time.Second, 30*time.Second); got != 10 {
+		t.Fatalf("allowed = %v, want %v", got, 10)
+	}
+
+	clock.Advance(29 * time.Second)
+	if status := throttle.Take(); status.Allowed || status.Reset != time.Second {
+		t.Errorf("at 59s: status = %+v, want rejected with 1s reset", status)
+	}
+
+	// The calls made at 0s left the window
+	clock.Advance(time.Second)
+	if got := allowedAt(clock, throttle, 0, 0, 0, 0, 0, 0); got != 5 {
+		t.Errorf("at 60s: allowed = %v, want %v", got, 5)
+	}
+}
+
+func TestGCRASpacing(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestGCRASpacing", Algorithm: stability.GCRA, Clock: clock,
+		MaxTokens: 2, RefillTokensCnt: 10, RefillInterval: time.Second,
+	})
+
+	// Burst of 2, then one call per 100ms
+	if got := allowedAt(clock, throttle, 0, 0, 0); got != 2 {
+		t.Errorf("burst allowed = %v, want %v", got, 2)
+	}
+	if got := allowedAt(clock, throttle, 50*time.Millisecond, 100*time.Millisecond, 150*time.Millisecond, 200*time.Millisecond); got != 2 {
+		t.Errorf("spaced allowed = %v, want %v", got, 2)
+	}
+}
+
+func TestLeakyBucketQueue(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestLeakyBucketQueue", Algorithm: stability.LeakyBucket, Clock: clock,
+		MaxTokens: 3, RefillTokensCnt: 10, RefillInterval: time.Second,
+	})
+
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		status := throttle.Take()
+		if i < 3 != status.Allowed {
+			t.Errorf("call %d: allowed = %v", i, status.Allowed)
+		}
+		delays = append(delays, status.Delay)
+	}
+	want := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 0}
+	for i := range want {
+		if delays[i] != want[i] {
+			t.Errorf("call %d: delay = %v, want %v", i, delays[i], want[i])
+		}
+	}
+
+	// GetProcessorFn waits for the turn
+	clock.Advance(time.Second)
+	processorFn := throttle.GetProcessorFn(echo)
+	_, _ = processorFn(0)
+	done := make(chan error)
+	go func() {
+		_, err := processorFn(1)
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(100 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
+
+func TestLeakyBucketGiveUp(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestLeakyBucketGiveUp", Algorithm: stability.LeakyBucket, Clock: clock,
+		MaxTokens: 3, RefillTokensCnt: 1, RefillInterval: time.Second,
+	})
+	processorFn := throttle.GetProcessorFn(echo)
+	_, _ = processorFn(0)
+
+	// A cancelled context stops the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := processorFn(stability.WithContext(ctx, 1))
+		done <- err
+	}()
+	clock.BlockUntil(1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+
+	// A budget shorter than the delay is rejected at once
+	budgetCtx := stability.WithBudget(context.Background(), clock.Now().Add(500*time.Millisecond))
+	if _, err := processorFn(stability.WithContext(budgetCtx, 2)); !errors.Is(err, stability.ErrBudgetExceeded) {
+		t.Errorf("err = %v, want %v", err, stability.ErrBudgetExceeded)
+	}
+
+	// Both gave their turns back, the next call is second in the queue
+	if status := throttle.Take(); !status.Allowed || status.Delay != time.Second {
+		t.Errorf("status = %+v, want allowed after %v", status, time.Second)
+	}
+}
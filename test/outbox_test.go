@@ -0,0 +1,445 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/outbox"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOutboxDB is an outbox table behind the "fakeoutbox" database/sql driver,
+// it understands the statements of outbox.SQLStore only
+type fakeOutboxDB struct {
+	rows    []fakeOutboxRow
+	queries []string
+	mutex   sync.Mutex
+}
+
+type fakeOutboxRow struct {
+	id        int64
+	key       string
+	payload   []byte
+	createdAt time.Time
+	sentAt    time.Time
+}
+
+var fakeOutboxDBs = make(map[string]*fakeOutboxDB)
+var fakeOutboxMutex sync.Mutex
+
+func init() {
+	sql.Register("fakeoutbox", fakeOutboxDriver{})
+}
+
+// openFakeOutbox opens the table of the name
+func openFakeOutbox(t *testing.T, name string) (*sql.DB, *fakeOutboxDB) {
+	fakeOutboxMutex.Lock()
+	table := &fakeOutboxDB{}
+	fakeOutboxDBs[name] = table
+	fakeOutboxMutex.Unlock()
+
+	db, err := sql.Open("fakeoutbox", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, table
+}
+
+func (d *fakeOutboxDB) lastQuery() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.queries[len(d.queries)-1]
+}
+
+func (d *fakeOutboxDB) exec(query string, args []driver.Value) (driver.Result, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queries = append(d.queries, query)
+
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO outbox "):
+		d.rows = append(d.rows, fakeOutboxRow{
+			id: int64(len(d.rows) + 1), key: args[0].(string), payload: args[1].([]byte), createdAt: args[2].(time.Time),
+		})
+	case strings.HasPrefix(query, "UPDATE outbox SET sent_at"):
+		for _, id := range args[1:] {
+			d.rows[id.(int64)-1].sentAt = args[0].(time.Time)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (d *fakeOutboxDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queries = append(d.queries, query)
+
+	if !strings.HasPrefix(query, "SELECT id, aggregate_key, payload, created_at FROM outbox WHERE sent_at IS NULL") {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	skip := make(map[string]bool)
+	for _, key := range args[:len(args)-1] {
+		skip[key.(string)] = true
+	}
+	limit := int(args[len(args)-1].(int64))
+
+	rows := &fakeOutboxRows{}
+	for _, row := range d.rows {
+		if len(rows.values) < limit && row.sentAt.IsZero() && !skip[row.key] {
+			rows.values = append(rows.values, []driver.Value{row.id, row.key, row.payload, row.createdAt})
+		}
+	}
+	return rows, nil
+}
+
+type fakeOutboxDriver struct{}
+
+func (fakeOutboxDriver) Open(name string) (driver.Conn, error) {
+	fakeOutboxMutex.Lock()
+	defer fakeOutboxMutex.Unlock()
+	return fakeOutboxConn{db: fakeOutboxDBs[name]}, nil
+}
+
+// fakeOutboxConn is its own transaction, the statements aren't rolled back
+type fakeOutboxConn struct {
+	db *fakeOutboxDB
+}
+
+func (c fakeOutboxConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeOutboxStmt{db: c.db, query: query}, nil
+}
+
+func (c fakeOutboxConn) Close() error              { return nil }
+func (c fakeOutboxConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeOutboxConn) Commit() error             { return nil }
+func (c fakeOutboxConn) Rollback() error           { return nil }
+
+type fakeOutboxStmt struct {
+	db    *fakeOutboxDB
+	query string
+}
+
+func (s fakeOutboxStmt) Close() error  { return nil }
+func (s fakeOutboxStmt) NumInput() int { return -1 }
+
+func (s fakeOutboxStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.db.exec(s.query, args)
+}
+
+func (s fakeOutboxStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeOutboxRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeOutboxRows) Columns() []string {
+	return []string{"id", "aggregate_key", "payload", "created_at"}
+}
+
+func (r *fakeOutboxRows) Close() error { return nil }
+
+func (r *fakeOutboxRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// recordPublish returns a publish ProcessFn appending the payloads,
+// failing while fail returns true for the payload
+func recordPublish(published *[]string, fail func(payload string) bool) stability.ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		event := inObj.(stability.ContextObj).Obj.(outbox.Event)
+		if fail(string(event.Payload)) {
+			return nil, intentionalErr
+		}
+		*published = append(*published, string(event.Payload))
+		return inObj, nil
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	store := outbox.NewMemoryStore(nil)
+	for _, payload := range []string{"a1", "b1", "a2", "b2", "a3"} {
+		store.Add(payload[:1], []byte(payload))
+	}
+
+	var published []string
+	relay := outbox.NewRelay(store, recordPublish(&published, func(string) bool { return false }),
+		outbox.RelaySettings{Name: "TestOutboxRelay", BatchSize: 3})
+
+	ctx := context.Background()
+	if n, err := relay.RelayOnce(ctx); n != 3 || err != nil {
+		t.Errorf("n, err = %v, %v, want 3, nil", n, err)
+	}
+	if n, err := relay.RelayOnce(ctx); n != 2 || err != nil {
+		t.Errorf("n, err = %v, %v, want 2, nil", n, err)
+	}
+	if n, _ := relay.RelayOnce(ctx); n != 0 || store.Len() != 0 {
+		t.Errorf("n = %v, len = %v, want 0, 0", n, store.Len())
+	}
+	if want := []string{"a1", "b1", "a2", "b2", "a3"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published = %v, want %v", published, want)
+	}
+}
+
+func TestOutboxAggregateOrdering(t *testing.T) {
+	store := outbox.NewMemoryStore(nil)
+	for _, payload := range []string{"a1", "b1", "a2", "b2"} {
+		store.Add(payload[:1], []byte(payload))
+	}
+
+	var published []string
+	var failed []int64
+	down := true
+	relay := outbox.NewRelay(store, recordPublish(&published, func(payload string) bool {
+		return down && payload == "a1"
+	}), outbox.RelaySettings{
+		Name: "TestOutboxAggregateOrdering",
+		OnError: func(event outbox.Event, err error) {
+			failed = append(failed, event.ID)
+		},
+	})
+
+	// a2 waits for a1, the aggregate b goes on
+	ctx := context.Background()
+	if n, _ := relay.RelayOnce(ctx); n != 2 {
+		t.Errorf("n = %v, want 2", n)
+	}
+	if want := []string{"b1", "b2"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published = %v, want %v", published, want)
+	}
+	if want := []int64{1}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("failed = %v, want %v", failed, want)
+	}
+
+	down = false
+	if n, _ := relay.RelayOnce(ctx); n != 2 {
+		t.Errorf("n = %v, want 2", n)
+	}
+	if want := []string{"b1", "b2", "a1", "a2"}; !reflect.DeepEqual(published, want) {
+		t.Errorf("published = %v, want %v", published, want)
+	}
+}
+
+func TestOutboxRetryAndBreaker(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := outbox.NewMemoryStore(clock)
+	store.Add("a", []byte("a1"))
+
+	var published []string
+	calls := 0
+	relay := outbox.NewRelay(store, recordPublish(&published, func(string) bool {
+		calls++
+		return true
+	}), outbox.RelaySettings{
+		Name:    "TestOutboxRetryAndBreaker",
+		Retry:   &stability.RetrySettings{RetryThreshold: 5, ExpiryFn: func(int) time.Duration { return time.Millisecond }},
+		Breaker: &stability.BreakerSettings{FailureThreshold: 2, ExpiryFn: func(int) time.Duration { return time.Hour }},
+		Clock:   clock,
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := relay.RelayOnce(context.Background())
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+			// The open breaker rejects the retries after 2 failures
+			if calls != 2 || store.Len() != 1 {
+				t.Errorf("calls = %v, len = %v, want 2, 1", calls, store.Len())
+			}
+			return
+		default:
+			clock.Advance(time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestOutboxRun(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := outbox.NewMemoryStore(clock)
+	published := make(chan string, 10)
+	relay := outbox.NewRelay(store, func(inObj interface{}) (interface{}, error) {
+		published <- string(inObj.(stability.ContextObj).Obj.(outbox.Event).Payload)
+		return inObj, nil
+	}, outbox.RelaySettings{Name: "TestOutboxRun", PollInterval: time.Second, Clock: clock})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- relay.Run(ctx) }()
+
+	// The event added while the relay waits is published on the next poll
+	clock.BlockUntil(1)
+	store.Add("a", []byte("a1"))
+	clock.Advance(time.Second)
+	if payload := <-published; payload != "a1" {
+		t.Errorf("payload = %v, want a1", payload)
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestOutboxBlockedAggregate(t *testing.T) {
+	db, _ := openFakeOutbox(t, "TestOutboxBlockedAggregate")
+	defer db.Close()
+	sqlStore := outbox.NewSQLStore(db, outbox.SQLStoreSettings{})
+	memoryStore := outbox.NewMemoryStore(nil)
+
+	for name, store := range map[string]outbox.Store{"memory": memoryStore, "sql": sqlStore} {
+		// The failing aggregate fills more than a batch ahead of the others
+		for _, payload := range []string{"a1", "a2", "a3", "a4", "a5", "b1", "c1", "b2"} {
+			if name == "memory" {
+				memoryStore.Add(payload[:1], []byte(payload))
+			} else if err := sqlStore.Add(context.Background(), db, payload[:1], []byte(payload)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var published []string
+		relay := outbox.NewRelay(store, recordPublish(&published, func(payload string) bool {
+			return payload[:1] == "a"
+		}), outbox.RelaySettings{Name: "TestOutboxBlockedAggregate", BatchSize: 2})
+
+		// A full batch is followed by the next one, like Run does
+		for _, want := range []int{2, 1} {
+			if n, err := relay.RelayOnce(context.Background()); n != want || err != nil {
+				t.Errorf("%v: n, err = %v, %v, want %v, nil", name, n, err, want)
+			}
+		}
+		if want := []string{"b1", "c1", "b2"}; !reflect.DeepEqual(published, want) {
+			t.Errorf("%v: published = %v, want %v", name, published, want)
+		}
+	}
+}
+
+// countingOutbox counts the Pending calls
+type countingOutbox struct {
+	outbox.Store
+	pending int
+}
+
+func (s *countingOutbox) Pending(ctx context.Context, limit int, skip []string) ([]outbox.Event, error) {
+	s.pending++
+	return s.Store.Pending(ctx, limit, skip)
+}
+
+func TestOutboxPassLimits(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		settings    outbox.RelaySettings
+		wantPending int
+	}{
+		// The open breaker would reject the other aggregates, the pass ends
+		{"breaker", outbox.RelaySettings{Breaker: &stability.BreakerSettings{ExpiryFn: func(int) time.Duration { return time.Hour }}}, 1},
+		// The pass ends once MaxBlocked aggregates failed
+		{"max blocked", outbox.RelaySettings{MaxBlocked: 3}, 2},
+	} {
+		memoryStore := outbox.NewMemoryStore(nil)
+		for i := 0; i < 10; i++ {
+			memoryStore.Add(fmt.Sprint(i), []byte("payload"))
+		}
+		store := &countingOutbox{Store: memoryStore}
+
+		var published []string
+		settings := test.settings
+		settings.Name, settings.BatchSize = "TestOutboxPassLimits", 2
+		relay := outbox.NewRelay(store, recordPublish(&published, func(string) bool { return true }), settings)
+
+		if n, err := relay.RelayOnce(context.Background()); n != 0 || err != nil {
+			t.Errorf("%v: n, err = %v, %v, want 0, nil", test.name, n, err)
+		}
+		if store.pending != test.wantPending {
+			t.Errorf("%v: pending = %v, want %v", test.name, store.pending, test.wantPending)
+		}
+	}
+}
+
+func TestOutboxSQLStore(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	db, table := openFakeOutbox(t, "TestOutboxSQLStore")
+	defer db.Close()
+	store := outbox.NewSQLStore(db, outbox.SQLStoreSettings{
+		Placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		Clock:       clock,
+	})
+	ctx := context.Background()
+
+	for _, payload := range []string{"a1", "b1", "a2"} {
+		if err := store.Add(ctx, db, payload[:1], []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The event is added in the transaction of the business change
+	tx, _ := db.Begin()
+	if err := store.Add(ctx, tx, "b", []byte("b2")); err != nil {
+		t.Fatal(err)
+	}
+	_ = tx.Commit()
+	if want := "INSERT INTO outbox (aggregate_key, payload, created_at) VALUES ($1, $2, $3)"; table.lastQuery() != want {
+		t.Errorf("query = %q, want %q", table.lastQuery(), want)
+	}
+
+	payloads := func(events []outbox.Event) []string {
+		var payloads []string
+		for _, event := range events {
+			payloads = append(payloads, string(event.Payload))
+		}
+		return payloads
+	}
+
+	events, err := store.Pending(ctx, 10, nil)
+	if want := []string{"a1", "b1", "a2", "b2"}; err != nil || !reflect.DeepEqual(payloads(events), want) {
+		t.Errorf("pending, err = %v, %v, want %v", payloads(events), err, want)
+	}
+	if !events[0].CreatedAt.Equal(clock.Now()) || events[0].ID != 1 {
+		t.Errorf("event = %+v, want id 1 created now", events[0])
+	}
+
+	events, _ = store.Pending(ctx, 10, []string{"a"})
+	if want := []string{"b1", "b2"}; !reflect.DeepEqual(payloads(events), want) {
+		t.Errorf("pending = %v, want %v", payloads(events), want)
+	}
+	if want := "SELECT id, aggregate_key, payload, created_at FROM outbox WHERE sent_at IS NULL AND aggregate_key NOT IN ($1) ORDER BY id LIMIT $2"; table.lastQuery() != want {
+		t.Errorf("query = %q, want %q", table.lastQuery(), want)
+	}
+
+	clock.Advance(time.Second)
+	if err := store.MarkSent(ctx, []int64{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "UPDATE outbox SET sent_at = $1 WHERE id IN ($2, $3)"; table.lastQuery() != want {
+		t.Errorf("query = %q, want %q", table.lastQuery(), want)
+	}
+	if sentAt := table.rows[0].sentAt; !sentAt.Equal(clock.Now()) {
+		t.Errorf("sent_at = %v, want %v", sentAt, clock.Now())
+	}
+	events, _ = store.Pending(ctx, 1, nil)
+	if want := []string{"a2"}; !reflect.DeepEqual(payloads(events), want) {
+		t.Errorf("pending = %v, want %v", payloads(events), want)
+	}
+}
@@ -0,0 +1,95 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/pipelinex"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"github.com/lissdx/yapgo/pkg/pipeline"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failOn fails the calls with inObj == n
+func failOn(n int) stability.ProcessFn {
+	return func(inObj interface{}) (interface{}, error) {
+		if inObj == n {
+			return nil, intentionalErr
+		}
+		return inObj, nil
+	}
+}
+
+// runStage runs the values through the stage and counts the results, errors and rejections
+func runStage(settings pipelinex.StageSettings, processFn stability.ProcessFn, vals ...interface{}) (resCnt, errCnt, rejectedCnt int) {
+	errs := make(chan error, len(vals))
+	rejected := make(chan error, len(vals))
+	settings.OnError = pipelinex.ToChan(errs)
+	settings.OnRejected = pipelinex.ToChan(rejected)
+
+	doneCh := make(chan interface{})
+	defer close(doneCh)
+	pl := pipeline.New()
+	pipelinex.AddStage(&pl, processFn, settings)
+
+	for range pl.Run(doneCh, pipeline.Generator(doneCh, vals...)) {
+		resCnt++
+	}
+	return resCnt, len(errs), len(rejected)
+}
+
+func TestPipelinexRoutesRejections(t *testing.T) {
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestPipelinexRoutesRejections", MaxTokens: 5, RefillTokensCnt: 5, RefillInterval: time.Minute,
+		Clock: stabilitytest.NewFakeClock(),
+	})
+
+	resCnt, errCnt, rejectedCnt := runStage(pipelinex.StageSettings{
+		Policies: []stability.Policy{throttle},
+	}, failOn(3), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	// The failed call takes a token too
+	if resCnt != 4 || errCnt != 1 || rejectedCnt != 5 {
+		t.Errorf("results, errors, rejections = %v, %v, %v, want %v, %v, %v", resCnt, errCnt, rejectedCnt, 4, 1, 5)
+	}
+}
+
+func TestPipelinexPerWorkerPolicies(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	var workers []int
+	var mutex sync.Mutex
+
+	resCnt, errCnt, rejectedCnt := runStage(pipelinex.StageSettings{
+		NewPolicies: func(worker int) []stability.Policy {
+			mutex.Lock()
+			defer mutex.Unlock()
+			workers = append(workers, worker)
+			return []stability.Policy{stability.NewThrottle(stability.ThrottleSettings{
+				Name: "TestPipelinexPerWorkerPolicies", MaxTokens: 5, RefillTokensCnt: 5, RefillInterval: time.Minute, Clock: clock,
+			})}
+		},
+		FanSize: 2,
+	}, echo, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+
+	// Every worker has its own 5 tokens, so 10 calls pass whichever worker takes them
+	if len(workers) != 2 || workers[0] != 0 || workers[1] != 1 {
+		t.Errorf("workers = %v, want [0 1]", workers)
+	}
+	if resCnt+rejectedCnt != 10 || errCnt != 0 || resCnt < 5 {
+		t.Errorf("results, errors, rejections = %v, %v, %v", resCnt, errCnt, rejectedCnt)
+	}
+}
+
+func TestPipelinexBreakerRejections(t *testing.T) {
+	breaker := stability.NewBreaker(stability.BreakerSettings{
+		Name: "TestPipelinexBreakerRejections", FailureThreshold: 2, Clock: stabilitytest.NewFakeClock(),
+	})
+
+	resCnt, errCnt, rejectedCnt := runStage(pipelinex.StageSettings{
+		Policies: []stability.Policy{breaker},
+	}, failAfter(3), 1, 2, 3, 4, 5, 6, 7, 8)
+
+	if resCnt != 3 || errCnt != 2 || rejectedCnt != 3 {
+		t.Errorf("results, errors, rejections = %v, %v, %v, want %v, %v, %v", resCnt, errCnt, rejectedCnt, 3, 2, 3)
+	}
+}
@@ -0,0 +1,85 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lissdx/yapgo/pkg/pipeline"
+)
+
+func TestRecoverInPipeline(t *testing.T) {
+	eh := make(errHandlerChan)
+	defer close(eh)
+	doneCh := make(chan interface{})
+	defer close(doneCh)
+
+	var recovered []interface{}
+	recoverSettings := stability.RecoverSettings{
+		Name: "TestRecoverInPipeline",
+		OnPanic: func(inObj interface{}, panicErr *stability.PanicError) {
+			if len(panicErr.Stack) == 0 {
+				t.Error("expected stack trace; got none")
+			}
+		},
+	}
+
+	// Every even value panics
+	processorFn := stability.NewRecover(recoverSettings).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		if inObj.(int)%2 == 0 {
+			panic(inObj)
+		}
+		return inObj, nil
+	})
+
+	vals := []interface{}{1, 2, 3, 4, 5, 6, 7, 8}
+	pl := pipeline.New()
+	pl.AddStageWithFanOut(pipeline.ProcessFn(processorFn), eh.getErrorHandlerFn(), 3)
+	outChan := pl.Run(doneCh, pipeline.Generator(doneCh, vals...))
+
+	resCnt := 0
+	for i := 0; i < len(vals); i++ {
+		select {
+		case <-outChan:
+			resCnt++
+		case e := <-eh:
+			var panicErr *stability.PanicError
+			if !errors.As(e.(error), &panicErr) {
+				t.Fatalf("err = %v, want *PanicError", e)
+			}
+			recovered = append(recovered, panicErr.Value)
+		}
+	}
+
+	if resCnt != 4 {
+		t.Errorf("resCnt = %v, want %v", resCnt, 4)
+	}
+	if len(recovered) != 4 {
+		t.Errorf("recovered = %v, want %v panics", recovered, 4)
+	}
+}
+
+func TestRecoverCountsAsBreakerFailure(t *testing.T) {
+	breaker := stability.NewBreaker(stability.BreakerSettings{
+		Name: "TestRecoverCountsAsBreakerFailure", FailureThreshold: 2,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Minute
+		},
+	})
+	recoverer := stability.NewRecover(stability.RecoverSettings{Name: "TestRecoverCountsAsBreakerFailure"})
+
+	processorFn := stability.Chain(func(inObj interface{}) (interface{}, error) {
+		panic(intentionalErr)
+	}, breaker, recoverer)
+
+	for i := 0; i < 2; i++ {
+		_, err := processorFn(i)
+		if !errors.Is(err, intentionalErr) {
+			t.Errorf("err = %v, want %v", err, intentionalErr)
+		}
+	}
+	if _, err := processorFn(0); err != stability.ErrOpenState {
+		t.Errorf("err = %v, want %v", err, stability.ErrOpenState)
+	}
+}
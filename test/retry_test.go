@@ -2,9 +2,11 @@ package test
 
 import (
 	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
 	"errors"
 	"fmt"
 	"testing"
+	"time"
 )
 
 var (
@@ -57,6 +59,72 @@ func TestRetry(t *testing.T) {
 	}
 }
 
+func TestRetryBackoffSchedule(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	start := clock.Now()
+	retrySettings := stability.RetrySettings{
+		Name: "TestRetryBackoffSchedule", RetryThreshold: 3, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Second * time.Duration(tryCnt+1)
+		},
+	}
+
+	var calledAt []time.Duration
+	processorFn := stability.NewRetry(retrySettings).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		calledAt = append(calledAt, clock.Since(start))
+		return nil, retryErr
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := processorFn("url1.com")
+		done <- err
+	}()
+
+	for i := 1; i <= 3; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second * time.Duration(i))
+	}
+
+	if err := <-done; err != retryErr {
+		t.Errorf("err = %v, want %v", err, retryErr)
+	}
+	want := []time.Duration{0, time.Second, 3 * time.Second, 6 * time.Second}
+	if fmt.Sprint(calledAt) != fmt.Sprint(want) {
+		t.Errorf("calledAt = %v, want %v", calledAt, want)
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	start := clock.Now()
+	processorFn := stability.NewRetry(stability.RetrySettings{
+		Name: "TestRetryError", RetryThreshold: 2, ReturnRetryError: true, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Second
+		},
+	}).GetProcessorFn(failAfter(0))
+
+	done := make(chan error)
+	go func() {
+		_, err := processorFn(0)
+		done <- err
+	}()
+	for i := 0; i < 2; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(time.Second)
+	}
+
+	err := <-done
+	var exhaustedErr *stability.RetryError
+	if !errors.As(err, &exhaustedErr) || !errors.Is(err, intentionalErr) {
+		t.Fatalf("err = %v, want a RetryError of %v", err, intentionalErr)
+	}
+	if exhaustedErr.Attempts() != 3 || !exhaustedErr.First.Equal(start) || exhaustedErr.Last.Sub(start) != 2*time.Second {
+		t.Errorf("attempts = %v from %v to %v, want %v from %v to %v", exhaustedErr.Attempts(), exhaustedErr.First, exhaustedErr.Last, 3, start, start.Add(2*time.Second))
+	}
+}
+
 //
 //func TestBreakerOpenClose(t *testing.T) {
 //
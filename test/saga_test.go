@@ -0,0 +1,171 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/saga"
+	"cloud-design-patterns/pkg/stability"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// orderSteps returns the steps reserve, charge and ship recording their calls,
+// fail is called before each action and compensation with its name
+func orderSteps(calls *[]string, fail func(name string) bool) []saga.Step {
+	var steps []saga.Step
+	for _, name := range []string{"reserve", "charge", "ship"} {
+		name := name
+		steps = append(steps, saga.Step{
+			Name: name,
+			Action: func(inObj interface{}) (interface{}, error) {
+				*calls = append(*calls, name)
+				if fail(name) {
+					return nil, intentionalErr
+				}
+				return inObj.(string) + "+" + name, nil
+			},
+			Compensate: func(inObj interface{}) (interface{}, error) {
+				*calls = append(*calls, "undo "+inObj.(string))
+				if fail("undo " + name) {
+					return nil, intentionalErr
+				}
+				return inObj, nil
+			},
+		})
+	}
+	return steps
+}
+
+// crashingLog fails the Save number crashAt (from 1) like a crashed process
+type crashingLog struct {
+	*saga.MemoryLog
+	saves   int
+	crashAt int
+}
+
+func (l *crashingLog) Save(state saga.State) error {
+	l.saves++
+	if l.saves == l.crashAt {
+		return errors.New("crashed")
+	}
+	return l.MemoryLog.Save(state)
+}
+
+func TestSagaCompleted(t *testing.T) {
+	var calls []string
+	log := saga.NewMemoryLog()
+	order := saga.NewSaga(orderSteps(&calls, func(string) bool { return false }),
+		saga.Settings{Name: "TestSagaCompleted", Log: log})
+
+	res, err := order.Run("order-1", "order")
+	if res != "order+reserve+charge+ship" || err != nil {
+		t.Errorf("res, err = %v, %v", res, err)
+	}
+	if state, _, _ := log.Load("TestSagaCompleted", "order-1"); state.Status != saga.Completed {
+		t.Errorf("status = %v, want %v", state.Status, saga.Completed)
+	}
+
+	// A finished saga isn't run again
+	res, err = order.Run("order-1", "order")
+	if res != "order+reserve+charge+ship" || err != nil || len(calls) != 3 {
+		t.Errorf("res, err, calls = %v, %v, %v", res, err, calls)
+	}
+}
+
+func TestSagaCompensation(t *testing.T) {
+	var calls []string
+	log := saga.NewMemoryLog()
+	order := saga.NewSaga(orderSteps(&calls, func(name string) bool { return name == "ship" }),
+		saga.Settings{Name: "TestSagaCompensation", Log: log})
+
+	_, err := order.Run("order-1", "order")
+	var sagaErr *saga.Error
+	if !errors.As(err, &sagaErr) || !errors.Is(err, saga.ErrAborted) || !errors.Is(err, intentionalErr) || sagaErr.Step != "ship" {
+		t.Fatalf("err = %v", err)
+	}
+	want := []string{"reserve", "charge", "ship", "undo order+reserve+charge", "undo order+reserve"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if state, _, _ := log.Load("TestSagaCompensation", "order-1"); state.Status != saga.Compensated {
+		t.Errorf("status = %v, want %v", state.Status, saga.Compensated)
+	}
+}
+
+func TestSagaStepRetry(t *testing.T) {
+	var calls []string
+	failures := 2
+	steps := orderSteps(&calls, func(name string) bool {
+		if name == "charge" && failures > 0 {
+			failures--
+			return true
+		}
+		return false
+	})
+	steps[1].Policies = []stability.Policy{stability.NewRetry(stability.RetrySettings{
+		Name: "TestSagaStepRetry", RetryThreshold: 3,
+		ExpiryFn: func(int) time.Duration { return time.Millisecond },
+	})}
+	order := saga.NewSaga(steps, saga.Settings{Name: "TestSagaStepRetry"})
+
+	if res, err := order.Run("order-1", "order"); res != "order+reserve+charge+ship" || err != nil {
+		t.Errorf("res, err = %v, %v", res, err)
+	}
+	if want := []string{"reserve", "charge", "charge", "charge", "ship"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestSagaResume(t *testing.T) {
+	// The process crashes saving the charge step: the initial state and reserve are saved
+	var calls []string
+	log := &crashingLog{MemoryLog: saga.NewMemoryLog(), crashAt: 3}
+	steps := orderSteps(&calls, func(string) bool { return false })
+	if _, err := saga.NewSaga(steps, saga.Settings{Name: "TestSagaResume", Log: log}).Run("order-1", "order"); err == nil {
+		t.Fatal("err = nil, want the crash")
+	}
+
+	// The restarted process runs charge again and goes on
+	calls = nil
+	restarted := saga.NewSaga(steps, saga.Settings{Name: "TestSagaResume", Log: log})
+	if err := restarted.ResumeAll(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"charge", "ship"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	if res, err := restarted.Resume("order-1"); res != "order+reserve+charge+ship" || err != nil {
+		t.Errorf("res, err = %v, %v", res, err)
+	}
+	if _, err := restarted.Resume("order-2"); err != saga.ErrNotFound {
+		t.Errorf("err = %v, want %v", err, saga.ErrNotFound)
+	}
+}
+
+func TestSagaCompensationFailed(t *testing.T) {
+	var calls []string
+	undoDown := true
+	log := saga.NewMemoryLog()
+	order := saga.NewSaga(orderSteps(&calls, func(name string) bool {
+		return name == "ship" || (undoDown && name == "undo reserve")
+	}), saga.Settings{Name: "TestSagaCompensationFailed", Log: log})
+
+	_, err := order.Run("order-1", "order")
+	var sagaErr *saga.Error
+	if !errors.As(err, &sagaErr) || sagaErr.CompensateStep != "reserve" {
+		t.Fatalf("err = %v, want reserve compensation failed", err)
+	}
+	if state, _, _ := log.Load("TestSagaCompensationFailed", "order-1"); state.Status != saga.CompensationFailed {
+		t.Errorf("status = %v, want %v", state.Status, saga.CompensationFailed)
+	}
+
+	// Resume compensates from the failed compensation only
+	calls = nil
+	undoDown = false
+	if _, err := order.Resume("order-1"); !errors.As(err, &sagaErr) || sagaErr.CompensateErr != nil || sagaErr.Err.Error() != intentionalErr.Error() {
+		t.Errorf("err = %v, want compensated", err)
+	}
+	if want := []string{"undo order+reserve"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
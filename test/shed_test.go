@@ -0,0 +1,147 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// priorityOf reads the priority from the input object
+func priorityOf(inObj interface{}) stability.Priority {
+	if priority, ok := inObj.(stability.Priority); ok {
+		return priority
+	}
+	return stability.PriorityNormal
+}
+
+func TestLoadShedderInFlight(t *testing.T) {
+	shedder := stability.NewLoadShedder(stability.LoadShedderSettings{
+		Name: "TestLoadShedderInFlight", Priority: priorityOf, MaxInFlight: 10,
+	})
+
+	release := make(chan struct{})
+	blocking := shedder.GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		<-release
+		return inObj, nil
+	})
+	fn := shedder.GetProcessorFn(echo)
+
+	var wg sync.WaitGroup
+	hold := func(n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = blocking(stability.PriorityCritical)
+			}()
+		}
+	}
+
+	// The lowest priorities are shed first as the load grows,
+	// an unknown one like the lowest known one
+	for _, step := range []struct {
+		inFlight uint32
+		shed     []stability.Priority
+		admitted []stability.Priority
+	}{
+		{8, []stability.Priority{stability.PriorityBackground, stability.Priority(10)}, []stability.Priority{stability.PriorityBatch, stability.PriorityNormal}},
+		{9, []stability.Priority{stability.PriorityBatch}, []stability.Priority{stability.PriorityNormal, stability.PriorityHigh}},
+		{10, []stability.Priority{stability.PriorityNormal}, []stability.Priority{stability.PriorityHigh}},
+		{12, []stability.Priority{stability.PriorityHigh}, []stability.Priority{stability.PriorityCritical}},
+	} {
+		hold(int(step.inFlight - shedder.InFlight()))
+		for shedder.InFlight() < step.inFlight {
+			time.Sleep(time.Millisecond)
+		}
+
+		for _, priority := range step.shed {
+			_, err := fn(priority)
+			var shedErr *stability.ShedError
+			if !errors.Is(err, stability.ErrShed) || !errors.As(err, &shedErr) || shedErr.Priority != priority {
+				t.Errorf("in flight %v: %v call err = %v, want %v", step.inFlight, priority, err, stability.ErrShed)
+			}
+		}
+		for _, priority := range step.admitted {
+			if _, err := fn(priority); err != nil {
+				t.Errorf("in flight %v: %v call err = %v, want no error", step.inFlight, priority, err)
+			}
+		}
+	}
+
+	close(release)
+	wg.Wait()
+	if _, err := fn(stability.PriorityBackground); err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
+
+type queuedObj struct {
+	priority   stability.Priority
+	enqueuedAt time.Time
+}
+
+func TestLoadShedderQueueWait(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	shedder := stability.NewLoadShedder(stability.LoadShedderSettings{
+		Name: "TestLoadShedderQueueWait", Clock: clock,
+		Priority: func(inObj interface{}) stability.Priority {
+			return inObj.(queuedObj).priority
+		},
+		EnqueuedAt: func(inObj interface{}) time.Time {
+			return inObj.(queuedObj).enqueuedAt
+		},
+		MaxQueueWait: time.Second,
+	})
+	fn := shedder.GetProcessorFn(echo)
+
+	enqueuedAt := clock.Now()
+	clock.Advance(900 * time.Millisecond)
+	if _, err := fn(queuedObj{stability.PriorityBackground, enqueuedAt}); !errors.Is(err, stability.ErrShed) {
+		t.Errorf("err = %v, want %v", err, stability.ErrShed)
+	}
+	if _, err := fn(queuedObj{stability.PriorityNormal, enqueuedAt}); err != nil {
+		t.Error("expected no error; got", err)
+	}
+	if _, err := fn(queuedObj{stability.PriorityBackground, clock.Now()}); err != nil {
+		t.Error("expected no error; got", err)
+	}
+}
+
+func TestLoadShedderCPU(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	cpu, samples := 0.95, 0
+	shedder := stability.NewLoadShedder(stability.LoadShedderSettings{
+		Name: "TestLoadShedderCPU", Priority: priorityOf, Clock: clock,
+		CPUSampler: func() float64 {
+			samples++
+			return cpu
+		},
+		MaxCPU: 0.9,
+	})
+	fn := shedder.GetProcessorFn(echo)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fn(stability.PriorityNormal); !errors.Is(err, stability.ErrShed) {
+			t.Errorf("err = %v, want %v", err, stability.ErrShed)
+		}
+	}
+	if _, err := fn(stability.PriorityHigh); err != nil {
+		t.Error("expected no error; got", err)
+	}
+	if samples != 1 {
+		t.Errorf("samples = %v, want %v", samples, 1)
+	}
+
+	// The usage is sampled again after the interval
+	cpu = 0.5
+	clock.Advance(stability.DefaultCPUSampleInterval)
+	if _, err := fn(stability.PriorityBackground); err != nil {
+		t.Error("expected no error; got", err)
+	}
+	if samples != 2 {
+		t.Errorf("samples = %v, want %v", samples, 2)
+	}
+}
@@ -0,0 +1,306 @@
+package test
+
+import (
+	"bufio"
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/redisstore"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStateStore checks the StateStore contract, clock drives the store expiry
+func testStateStore(t *testing.T, store stability.StateStore, clock *stabilitytest.FakeClock) {
+	if _, ok, err := store.Get("missing"); ok || err != nil {
+		t.Errorf("Get(missing) = %v %v, want not found", ok, err)
+	}
+
+	if err := store.Set("key", []byte("v1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := store.Get("key"); string(value) != "v1" || !ok || err != nil {
+		t.Errorf("Get = %q %v %v, want v1", value, ok, err)
+	}
+
+	if stored, err := store.CompareAndSet("key", []byte("v0"), []byte("v2"), 0); stored || err != nil {
+		t.Errorf("CompareAndSet(v0) = %v %v, want not stored", stored, err)
+	}
+	if stored, err := store.CompareAndSet("key", []byte("v1"), []byte("v2"), time.Second); !stored || err != nil {
+		t.Errorf("CompareAndSet(v1) = %v %v, want stored", stored, err)
+	}
+	if stored, err := store.CompareAndSet("key", nil, []byte("v3"), 0); stored || err != nil {
+		t.Errorf("CompareAndSet(nil) of existing key = %v %v, want not stored", stored, err)
+	}
+
+	clock.Advance(time.Second)
+	if _, ok, _ := store.Get("key"); ok {
+		t.Error("expected the key to expire")
+	}
+	if stored, err := store.CompareAndSet("key", nil, []byte("v3"), 0); !stored || err != nil {
+		t.Errorf("CompareAndSet(nil) = %v %v, want stored", stored, err)
+	}
+
+	for i, want := range []int64{5, 3} {
+		if n, err := store.Incr("counter", []int64{5, -2}[i], time.Minute); n != want || err != nil {
+			t.Errorf("Incr = %v %v, want %v", n, err, want)
+		}
+	}
+	clock.Advance(time.Minute)
+	if n, _ := store.Incr("counter", 1, 0); n != 1 {
+		t.Errorf("Incr after expiry = %v, want %v", n, 1)
+	}
+
+	if err := store.Delete("counter"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get("counter"); ok {
+		t.Error("expected the key to be deleted")
+	}
+}
+
+func newRedisStore(t *testing.T, clock stability.Clock) *redisstore.Store {
+	server, err := stabilitytest.NewRedisServer(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := redisstore.New(redisstore.Settings{Addr: server.Addr(), Prefix: "test:"})
+	t.Cleanup(func() {
+		_ = store.Close()
+		_ = server.Close()
+	})
+	return store
+}
+
+// scriptedRedis serves the RESP replies of reply (empty to hang),
+// conns receives the number of every accepted connection
+func scriptedRedis(t *testing.T, reply func(args []interface{}) string) (string, chan int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	conns := make(chan int, 10)
+	go func() {
+		for n := 1; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- n
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					cmd, err := redisstore.ReadReply(r)
+					if err != nil {
+						return
+					}
+					if line := reply(cmd.([]interface{})); line != "" {
+						_, _ = conn.Write([]byte(line))
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), conns
+}
+
+func TestRedisStoreCommandTimeout(t *testing.T) {
+	addr, conns := scriptedRedis(t, func([]interface{}) string { return "" })
+	store := redisstore.New(redisstore.Settings{Addr: addr, CommandTimeout: 20 * time.Millisecond})
+	defer store.Close()
+
+	var netErr net.Error
+	if _, _, err := store.Get("key"); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+	// The timed out connection isn't reused
+	_, _, _ = store.Get("key")
+	if n := <-conns + <-conns; n != 3 {
+		t.Errorf("conns = %v, want 2 connections", n)
+	}
+}
+
+func TestRedisStoreFailedTransaction(t *testing.T) {
+	addr, conns := scriptedRedis(t, func(args []interface{}) string {
+		switch string(args[0].([]byte)) {
+		case "GET":
+			return "$2\r\nv1\r\n"
+		case "MULTI":
+			return "-ERR MULTI calls can not be nested\r\n"
+		}
+		return "+OK\r\n"
+	})
+	store := redisstore.New(redisstore.Settings{Addr: addr})
+	defer store.Close()
+
+	var replyErr *redisstore.Error
+	if _, err := store.CompareAndSet("key", []byte("v1"), []byte("v2"), 0); !errors.As(err, &replyErr) {
+		t.Errorf("err = %v, want the error reply", err)
+	}
+	// The connection left with the WATCH active isn't reused
+	if value, _, err := store.Get("key"); string(value) != "v1" || err != nil {
+		t.Errorf("value, err = %q, %v, want v1", value, err)
+	}
+	if n := <-conns + <-conns; n != 3 {
+		t.Errorf("conns = %v, want 2 connections", n)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	testStateStore(t, stability.NewMemoryStore(clock), clock)
+}
+
+func TestRedisStore(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	testStateStore(t, newRedisStore(t, clock), clock)
+}
+
+func TestRedisStoreConcurrentCompareAndSet(t *testing.T) {
+	store := newRedisStore(t, nil)
+
+	// Every goroutine increments the value with a CAS loop
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					old, ok, err := store.Get("cas")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					n := len(old)
+					if !ok {
+						old = nil
+					}
+					if stored, _ := store.CompareAndSet("cas", old, make([]byte, n+1), 0); stored {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _, _ := store.Get("cas"); len(value) != 100 {
+		t.Errorf("value length = %v, want %v", len(value), 100)
+	}
+}
+
+func TestSharedThrottle(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := newRedisStore(t, clock)
+
+	for _, algorithm := range []stability.ThrottleAlgorithm{stability.TokenBucket, stability.FixedWindow, stability.GCRA} {
+		// Two replicas share one limit of 10 calls per minute
+		var replicas []stability.ProcessFn
+		for i := 0; i < 2; i++ {
+			replicas = append(replicas, stability.NewThrottle(stability.ThrottleSettings{
+				Name: fmt.Sprintf("TestSharedThrottle%d", algorithm), Algorithm: algorithm, Store: store, Clock: clock,
+				MaxTokens: 10, RefillTokensCnt: 10, RefillInterval: time.Minute,
+			}).GetProcessorFn(echo))
+		}
+
+		allowed := 0
+		for i := 0; i < 30; i++ {
+			if _, err := replicas[i%2](i); err == nil {
+				allowed++
+			}
+		}
+		if allowed != 10 {
+			t.Errorf("algorithm %v: allowed = %v, want %v", algorithm, allowed, 10)
+		}
+		clock.Advance(time.Minute)
+	}
+}
+
+func TestSharedBreaker(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := stability.NewMemoryStore(clock)
+	breakerSettings := stability.BreakerSettings{
+		Name: "TestSharedBreaker", FailureThreshold: 2, Store: store, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Second
+		},
+	}
+
+	failing := stability.NewBreaker(breakerSettings).GetProcessorFn(failAfter(0))
+	healthy := stability.NewBreaker(breakerSettings).GetProcessorFn(echo)
+
+	// Failures on one replica open the breaker on the other
+	_, _ = failing(0)
+	_, _ = failing(0)
+	if _, err := healthy(0); err != stability.ErrOpenState {
+		t.Errorf("err = %v, want %v", err, stability.ErrOpenState)
+	}
+
+	// A successful trial call on one replica closes it for both
+	clock.Advance(time.Second)
+	if _, err := healthy(0); err != nil {
+		t.Error("expected no error; got", err)
+	}
+	if _, err := failing(0); err != intentionalErr {
+		t.Errorf("err = %v, want %v", err, intentionalErr)
+	}
+}
+
+func TestSharedBreakerExpiry(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := stability.NewMemoryStore(clock)
+	failing := stability.NewBreaker(stability.BreakerSettings{
+		Name: "TestSharedBreakerExpiry", FailureThreshold: 2, Store: store, StateTTL: time.Second, Clock: clock,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Duration(tryCnt+1) * time.Second
+		},
+	}).GetProcessorFn(failAfter(0))
+
+	for _, key := range []string{"breaker:TestSharedBreakerExpiry:failures", "breaker:TestSharedBreakerExpiry:last"} {
+		// The third failure opens the breaker for 2s, the keys last 4s (more than the StateTTL)
+		_, _ = failing(0)
+		_, _ = failing(0)
+		clock.Advance(time.Second)
+		_, _ = failing(0)
+
+		clock.Advance(time.Duration(3900) * time.Millisecond)
+		if _, ok, _ := store.Get(key); !ok {
+			t.Errorf("%v expired before 4s", key)
+		}
+		clock.Advance(time.Duration(200) * time.Millisecond)
+		if _, ok, _ := store.Get(key); ok {
+			t.Errorf("%v didn't expire after 4s", key)
+		}
+	}
+}
+
+func TestSharedBreakerSparseFailures(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	store := stability.NewMemoryStore(clock)
+	breakerSettings := stability.BreakerSettings{
+		Name: "TestSharedBreakerSparseFailures", FailureThreshold: 3, Store: store, Clock: clock,
+	}
+
+	// The failures far apart add up like in the local breaker
+	failing := stability.NewBreaker(breakerSettings).GetProcessorFn(failAfter(0))
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Duration(100) * time.Millisecond)
+		_, _ = failing(0)
+	}
+	if _, err := stability.NewBreaker(breakerSettings).GetProcessorFn(echo)(0); err != stability.ErrOpenState {
+		t.Errorf("err = %v, want %v", err, stability.ErrOpenState)
+	}
+
+	// The failures are forgotten StateTTL after the last one
+	clock.Advance(stability.DefaultBreakerStateTTL)
+	if failures, ok, _ := store.Get("breaker:TestSharedBreakerSparseFailures:failures"); ok {
+		t.Errorf("failures = %s after the StateTTL, want none", failures)
+	}
+}
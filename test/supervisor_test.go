@@ -0,0 +1,160 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"cloud-design-patterns/pkg/supervisor"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForTask polls the supervisor until the task is in the state after the attempts
+func waitForTask(t *testing.T, sup *supervisor.Supervisor, id string, state supervisor.TaskState, attempts int) supervisor.Task {
+	deadline := time.Now().Add(time.Second)
+	for {
+		task, _, _ := sup.Get(id)
+		if task.State == state && task.Attempts == attempts {
+			return task
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task = %+v, want state %v after %v attempts", task, state, attempts)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSupervisorRuns(t *testing.T) {
+	sup := supervisor.NewSupervisor(func(inObj interface{}) (interface{}, error) {
+		return inObj, nil
+	}, supervisor.Settings{Name: "TestSupervisorRuns", Workers: 2, PollInterval: time.Millisecond})
+	defer sup.Stop()
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := sup.Submit(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sup.Submit("a", nil); err != supervisor.ErrExists {
+		t.Errorf("err = %v, want %v", err, supervisor.ErrExists)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		waitForTask(t, sup, id, supervisor.Succeeded, 1)
+	}
+}
+
+func TestSupervisorEscalation(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	escalated := make(chan supervisor.Task, 1)
+	compensated := make(chan string, 1)
+	sup := supervisor.NewSupervisor(func(inObj interface{}) (interface{}, error) {
+		return nil, intentionalErr
+	}, supervisor.Settings{
+		Name: "TestSupervisorEscalation", MaxAttempts: 2, Clock: clock,
+		Compensate: func(inObj interface{}) (interface{}, error) {
+			compensated <- inObj.(supervisor.Task).ID
+			return inObj, nil
+		},
+		OnEscalate: func(task supervisor.Task) {
+			escalated <- task
+		},
+	})
+	defer sup.Stop()
+
+	clock.BlockUntil(1)
+	_ = sup.Submit("job", nil)
+	clock.Advance(time.Second)
+
+	// The failed attempt is rescheduled
+	if task := waitForTask(t, sup, "job", supervisor.Pending, 1); task.Error != intentionalErr.Error() {
+		t.Errorf("error = %v, want %v", task.Error, intentionalErr)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	task := <-escalated
+	if id := <-compensated; id != "job" {
+		t.Errorf("compensated = %v, want job", id)
+	}
+	if task.State != supervisor.Failed || task.Attempts != 2 {
+		t.Errorf("task = %+v, want failed after 2 attempts", task)
+	}
+}
+
+func TestSupervisorLeaseExpiry(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	attempts := make(chan int, 2)
+	release := make(chan struct{})
+	sup := supervisor.NewSupervisor(func(inObj interface{}) (interface{}, error) {
+		task := inObj.(supervisor.Task)
+		attempts <- task.Attempts
+		if task.Attempts == 1 {
+			<-release
+		}
+		return inObj, nil
+	}, supervisor.Settings{Name: "TestSupervisorLeaseExpiry", Lease: 10 * time.Second, Workers: 2, Clock: clock})
+
+	clock.BlockUntil(1)
+	_ = sup.Submit("job", nil)
+	clock.Advance(time.Second)
+	<-attempts
+
+	// The stuck attempt loses the lease and the task runs again
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Second)
+	if attempt := <-attempts; attempt != 2 {
+		t.Errorf("attempt = %v, want 2", attempt)
+	}
+	waitForTask(t, sup, "job", supervisor.Succeeded, 2)
+
+	// The late result of the stuck attempt is dropped
+	close(release)
+	sup.Stop()
+	if task, _, _ := sup.Get("job"); task.State != supervisor.Succeeded || task.Attempts != 2 {
+		t.Errorf("task = %+v, want succeeded on attempt 2", task)
+	}
+}
+
+func TestSupervisorPanics(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	errs := make(chan error, 2)
+	compensating := make(chan struct{})
+	release := make(chan struct{})
+	sup := supervisor.NewSupervisor(func(inObj interface{}) (interface{}, error) {
+		if inObj.(supervisor.Task).ID == "job" {
+			panic(intentionalErr)
+		}
+		return inObj, nil
+	}, supervisor.Settings{
+		Name: "TestSupervisorPanics", MaxAttempts: 1, Workers: 2, Clock: clock,
+		Compensate: func(inObj interface{}) (interface{}, error) {
+			close(compensating)
+			<-release
+			return inObj, nil
+		},
+		OnError: func(task supervisor.Task, err error) {
+			errs <- err
+		},
+	})
+	defer sup.Stop()
+
+	clock.BlockUntil(1)
+	_ = sup.Submit("job", nil)
+	clock.Advance(time.Second)
+
+	// The panic fails the attempt and escalates the task
+	var panicErr *stability.PanicError
+	if err := <-errs; !errors.As(err, &panicErr) || !errors.Is(err, intentionalErr) {
+		t.Errorf("err = %v, want a panic of %v", err, intentionalErr)
+	}
+	<-compensating
+
+	// The compensation in progress doesn't hold up the scheduling
+	_ = sup.Submit("other", nil)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	waitForTask(t, sup, "other", supervisor.Succeeded, 1)
+
+	close(release)
+	waitForTask(t, sup, "job", supervisor.Failed, 1)
+}
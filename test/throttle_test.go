@@ -2,6 +2,7 @@ package test
 
 import (
 	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
 	"fmt"
 	"testing"
 	"time"
@@ -95,8 +96,10 @@ func TestThrottleMax10Refill3Times(t *testing.T) {
 		}
 	}()
 
+	clock := stabilitytest.NewFakeClock()
 	throttleSettings := stability.ThrottleSettings{
 		Name: "TestThrottleMax1", MaxTokens: 10, RefillTokensCnt: 10, RefillInterval: time.Duration(300) * time.Millisecond,
+		Clock: clock,
 	}
 
 	throttle := stability.NewThrottle(throttleSettings)
@@ -115,7 +118,7 @@ func TestThrottleMax10Refill3Times(t *testing.T) {
 			}
 		}
 		//fmt.Printf("resGot: %d, errCnt: %d\n", resGot, errCnt)
-		time.Sleep(time.Duration(1) * time.Second)
+		clock.Advance(time.Duration(1) * time.Second)
 	}
 
 	if errCnt != 270 {
@@ -137,8 +140,10 @@ func TestThrottleQuickRefill(t *testing.T) {
 		}
 	}()
 
+	clock := stabilitytest.NewFakeClock()
 	throttleSettings := stability.ThrottleSettings{
 		Name: "TestThrottleMax1", MaxTokens: 10, RefillTokensCnt: 10, RefillInterval: time.Duration(10) * time.Millisecond,
+		Clock: clock,
 	}
 
 	throttle := stability.NewThrottle(throttleSettings)
@@ -154,7 +159,7 @@ func TestThrottleQuickRefill(t *testing.T) {
 		} else {
 			errCnt++
 		}
-		time.Sleep(time.Duration(1) * time.Millisecond)
+		clock.Advance(time.Duration(1) * time.Millisecond)
 	}
 	fmt.Printf("resGot: %d, errCnt: %d\n", resGot, errCnt)
 
@@ -178,8 +183,10 @@ func TestThrottleFrequency5Seconds(t *testing.T) {
 		}
 	}()
 
+	clock := stabilitytest.NewFakeClock()
 	throttleSettings := stability.ThrottleSettings{
 		Name: "TestThrottleMax1", MaxTokens: 1, RefillTokensCnt: 1, RefillInterval: time.Duration(1) * time.Second,
+		Clock: clock,
 	}
 
 	throttle := stability.NewThrottle(throttleSettings)
@@ -187,10 +194,9 @@ func TestThrottleFrequency5Seconds(t *testing.T) {
 
 	var resGot int
 	var errCnt int
-	ticker := time.NewTicker(250 * time.Millisecond).C
 	tickCounts := 0
 
-	for range ticker {
+	for ; ; clock.Advance(250 * time.Millisecond) {
 		tickCounts++
 		res, err := throttleEffector(0)
 		if err == nil {
@@ -225,8 +231,10 @@ func TestThrottleRefill(t *testing.T) {
 		}
 	}()
 
+	clock := stabilitytest.NewFakeClock()
 	throttleSettings := stability.ThrottleSettings{
 		Name: "TestThrottleMax1", MaxTokens: 5, RefillTokensCnt: 1, RefillInterval: time.Duration(1) * time.Second,
+		Clock: clock,
 	}
 
 	throttle := stability.NewThrottle(throttleSettings)
@@ -242,7 +250,7 @@ func TestThrottleRefill(t *testing.T) {
 			errCnt++
 		}
 	}
-	time.Sleep(time.Duration(3500) * time.Millisecond)
+	clock.Advance(time.Duration(3500) * time.Millisecond)
 
 	for i := 0; i < 10; i++ {
 		res, err := throttleEffector(i)
@@ -264,3 +272,55 @@ func TestThrottleRefill(t *testing.T) {
 		t.Errorf("resGot = %v, want %v", resGot, 8)
 	}
 }
+
+func TestThrottleSaturatedFor(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestThrottleSaturatedFor", MaxTokens: 1, RefillTokensCnt: 1, RefillInterval: time.Minute, Clock: clock,
+	})
+
+	throttle.Take()
+	if saturated := throttle.SaturatedFor(); saturated != 0 {
+		t.Errorf("saturated = %v, want 0", saturated)
+	}
+	throttle.Take()
+	clock.Advance(10 * time.Second)
+	throttle.Take()
+	if saturated := throttle.SaturatedFor(); saturated != 10*time.Second {
+		t.Errorf("saturated = %v, want %v", saturated, 10*time.Second)
+	}
+
+	clock.Advance(time.Minute)
+	throttle.Take()
+	if saturated := throttle.SaturatedFor(); saturated != 0 {
+		t.Errorf("saturated = %v, want 0 after the refill", saturated)
+	}
+}
+
+func TestThrottleSaturatedForIdle(t *testing.T) {
+	clock := stabilitytest.NewFakeClock()
+	throttle := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestThrottleSaturatedForIdle", MaxTokens: 1, RefillTokensCnt: 1, RefillInterval: time.Minute, Clock: clock,
+	})
+
+	throttle.Take()
+	throttle.Take()
+	clock.Advance(30 * time.Second)
+	if saturated := throttle.SaturatedFor(); saturated != 30*time.Second {
+		t.Errorf("saturated = %v, want %v", saturated, 30*time.Second)
+	}
+
+	// No calls since, the refilled throttle isn't saturated anymore
+	clock.Advance(30 * time.Second)
+	if saturated := throttle.SaturatedFor(); saturated != 0 {
+		t.Errorf("saturated = %v, want 0 when idle after the refill", saturated)
+	}
+
+	// A rejection after the recovery starts a new saturation period
+	throttle.Take()
+	throttle.Take()
+	clock.Advance(10 * time.Second)
+	if saturated := throttle.SaturatedFor(); saturated != 10*time.Second {
+		t.Errorf("saturated = %v, want %v", saturated, 10*time.Second)
+	}
+}
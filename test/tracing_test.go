@@ -0,0 +1,78 @@
+package test
+
+import (
+	"cloud-design-patterns/pkg/stability"
+	"cloud-design-patterns/pkg/stability/stabilitytest"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryTracing(t *testing.T) {
+	tracer := stabilitytest.NewMemoryTracer()
+	ctx, span := tracer.Start(context.Background(), "TestRetryTracing")
+
+	retrySettings := stability.RetrySettings{
+		Name: "TestRetryTracing", RetryThreshold: 2, Tracer: tracer,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Millisecond * time.Duration(tryCnt+1)
+		},
+	}
+	processorFn := stability.NewRetry(retrySettings).GetProcessorFn(func(inObj interface{}) (interface{}, error) {
+		if stability.ContextOf(inObj) != ctx {
+			t.Error("wrapped function didn't get the context")
+		}
+		return nil, intentionalErr
+	})
+
+	if _, err := processorFn(stability.WithContext(ctx, "url1.com")); err != intentionalErr {
+		t.Errorf("err = %v, want %v", err, intentionalErr)
+	}
+
+	attempts := span.EventsNamed(stability.SpanEventRetryAttempt)
+	if len(attempts) != 3 {
+		t.Fatalf("attempt events = %v, want %v", len(attempts), 3)
+	}
+	for i, e := range attempts {
+		if attempt, _ := e.Attr("attempt"); attempt != i+1 {
+			t.Errorf("attempt = %v, want %v", attempt, i+1)
+		}
+	}
+
+	backoffs := span.EventsNamed(stability.SpanEventRetryBackoff)
+	if len(backoffs) != 2 {
+		t.Fatalf("backoff events = %v, want %v", len(backoffs), 2)
+	}
+	if delay, _ := backoffs[1].Attr("delay"); delay != 2*time.Millisecond {
+		t.Errorf("delay = %v, want %v", delay, 2*time.Millisecond)
+	}
+}
+
+func TestBreakerAndThrottleTracing(t *testing.T) {
+	tracer := stabilitytest.NewMemoryTracer()
+	ctx, span := tracer.Start(context.Background(), "TestBreakerAndThrottleTracing")
+
+	breakerFn := stability.NewBreaker(stability.BreakerSettings{
+		Name: "TestBreakerTracing", FailureThreshold: 1, Tracer: tracer,
+		ExpiryFn: func(tryCnt int) time.Duration {
+			return time.Minute
+		},
+	}).GetProcessorFn(failAfter(0))
+	throttleFn := stability.NewThrottle(stability.ThrottleSettings{
+		Name: "TestThrottleTracing", MaxTokens: 1, Tracer: tracer,
+	}).GetProcessorFn(failAfter(10))
+
+	for i := 0; i < 3; i++ {
+		_, _ = breakerFn(stability.WithContext(ctx, i))
+		_, _ = throttleFn(stability.WithContext(ctx, i))
+	}
+	// Calls without a span are not recorded
+	_, _ = breakerFn(0)
+
+	if got := len(span.EventsNamed(stability.SpanEventBreakerRejected)); got != 2 {
+		t.Errorf("breaker rejections = %v, want %v", got, 2)
+	}
+	if got := len(span.EventsNamed(stability.SpanEventThrottleRejected)); got != 2 {
+		t.Errorf("throttle rejections = %v, want %v", got, 2)
+	}
+}